@@ -0,0 +1,216 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "strings"
+    "text/tabwriter"
+    "time"
+    "github.com/samchelini/dns-manager/auth"
+    "github.com/samchelini/dns-manager/jsend"
+)
+
+// returns the bearer token of a request, or "" if it has none
+func bearerToken(r *http.Request) string {
+    scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+    if !ok || !strings.EqualFold(scheme, "Bearer") {
+        return ""
+    }
+    return strings.TrimSpace(token)
+}
+
+// sends a 401 jsend fail asking for a bearer token
+func sendUnauthorized(w http.ResponseWriter, message string) {
+    w.Header().Set("WWW-Authenticate", `Bearer realm="dns-manager"`)
+    sendResponse(w, jsend.Fail(nil, message, nil, http.StatusUnauthorized))
+}
+
+// returns the identity for a jwt or api token
+func authenticate(s *settings, r *http.Request, bearer string) (*auth.Identity, error) {
+    if auth.IsJWT(bearer) {
+        if s.jwtVerifier == nil {
+            return nil, auth.ErrInvalidToken
+        }
+        return s.jwtVerifier.Verify(r.Context(), bearer)
+    }
+    if s.tokenStore == nil {
+        return nil, auth.ErrInvalidToken
+    }
+    token, err := s.tokenStore.Verify(bearer)
+    if err != nil {
+        return nil, err
+    }
+    return &auth.Identity{Subject: "token:" + token.ID, Method: "token", Roles: token.Roles}, nil
+}
+
+// parse role mappings in "group=role,role;group=role" format, mapping jwt
+// claim values or client certificate organizational units to roles
+func parseRoleMap(roleMap string) (map[string][]string, error) {
+    roles := make(map[string][]string)
+    for _, entry := range strings.Split(roleMap, ";") {
+        if strings.TrimSpace(entry) == "" {
+            continue
+        }
+        value, list, ok := strings.Cut(entry, "=")
+        value = strings.TrimSpace(value)
+        if !ok || value == "" || len(splitList(list)) == 0 {
+            return nil, fmt.Errorf("invalid entry %q, expected group=role[,role]", entry)
+        }
+        roles[value] = append(roles[value], splitList(list)...)
+    }
+    return roles, nil
+}
+
+// requires a valid bearer token and adds the caller identity to the request context
+func authHandler(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        s := current()
+        if s.tokenStore == nil && s.jwtVerifier == nil && !clientCerts {
+            handler.ServeHTTP(w, r)
+            return
+        }
+
+        // a verified client certificate identifies the caller when no bearer token is sent
+        bearer := bearerToken(r)
+        if bearer == "" {
+            if id := certIdentity(r); id != nil {
+                slog.InfoContext(r.Context(), "authenticated request", "subject", id.Subject)
+                handler.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), id)))
+                return
+            }
+            sendUnauthorized(w, "missing bearer token")
+            return
+        }
+        id, err := authenticate(s, r, bearer)
+        if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrExpiredToken) || errors.Is(err, auth.ErrInvalidJWT) || errors.Is(err, auth.ErrExpiredJWT) {
+            slog.InfoContext(r.Context(), "authentication failed", "error", err)
+            sendUnauthorized(w, err.Error())
+            return
+        }
+        if err != nil {
+            slog.ErrorContext(r.Context(), "error verifying token", "error", err)
+            sendResponse(w, jsend.Error(nil, "error verifying token", nil, http.StatusInternalServerError))
+            return
+        }
+
+        slog.InfoContext(r.Context(), "authenticated request", "subject", id.Subject)
+        handler.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), id)))
+    })
+}
+
+// request details sent with a denial
+type authorizationRequest struct {
+    Subject string      `json:"subject,omitempty"`
+    Action  auth.Action `json:"action"`
+    Zone    string      `json:"zone"`
+    Name    string      `json:"name,omitempty"`
+    Type    string      `json:"type,omitempty"`
+}
+
+// denial sent as jsend data, Rule is nil when no rule matched
+type authorizationDenial struct {
+    Rule        *auth.Rule              `json:"rule"`
+    RuleIndex   int                     `json:"ruleIndex"`
+    Request     authorizationRequest    `json:"request"`
+}
+
+// check the policy before any dns message is built, returns a 403 fail
+// response when the caller may not perform action. name and t are empty for
+// zone wide requests.
+func authorize(r *http.Request, action auth.Action, zone string, name string, t string) *jsend.Response {
+    policy := current().policy
+    if policy == nil {
+        return nil
+    }
+    id := auth.FromContext(r.Context())
+    t = strings.ToUpper(strings.TrimPrefix(t, "Type"))
+    decision := policy.Evaluate(auth.Request{Identity: id, Action: action, Zone: zone, Name: name, Type: t})
+    if decision.Allowed {
+        return nil
+    }
+
+    denial := authorizationDenial{
+        Rule:       decision.Rule,
+        RuleIndex:  decision.Index,
+        Request:    authorizationRequest{Action: action, Zone: zone, Name: name, Type: t},
+    }
+    if id != nil {
+        denial.Request.Subject = id.Subject
+    }
+    message := "no policy rule allows this request"
+    if decision.Rule != nil {
+        message = fmt.Sprintf("denied by policy rule %d", decision.Index)
+    }
+    slog.InfoContext(r.Context(), "request denied by policy", "subject", denial.Request.Subject, "action", action, "zone", zone, "name", name, "type", t, "rule", decision.Index)
+    return jsend.Fail(denial, message, nil, http.StatusForbidden)
+}
+
+// token subcommand: create, list or revoke api tokens
+func tokenCommand(args []string) error {
+    usage := "usage: token create [-description text] [-role role]... [-ttl duration] | token list | token revoke <id>"
+    if len(args) == 0 {
+        return errors.New(usage)
+    }
+    flags := flag.NewFlagSet("token " + args[0], flag.ContinueOnError)
+    file := flags.String("file", os.Getenv("AUTH_TOKENS_FILE"), "token file, AUTH_TOKENS_FILE by default")
+    description := flags.String("description", "", "what the token is used for")
+    ttl := flags.Duration("ttl", 0, "time until the token expires, 0 never expires")
+    var roles []string
+    flags.Func("role", "role for authorization policies, may be repeated", func(role string) error {
+        roles = append(roles, role)
+        return nil
+    })
+    if err := flags.Parse(args[1:]); err != nil {
+        return err
+    }
+    if *file == "" {
+        return errors.New("-file or AUTH_TOKENS_FILE is required")
+    }
+    store, err := auth.OpenTokenStore(*file)
+    if err != nil {
+        return err
+    }
+
+    switch args[0] {
+    case "create":
+        bearer, token, err := store.Create(*description, roles, *ttl)
+        if err != nil {
+            return err
+        }
+        fmt.Fprintf(os.Stderr, "created token %s, it will not be shown again:\n", token.ID)
+        fmt.Println(bearer)
+    case "list":
+        tokens, err := store.List()
+        if err != nil {
+            return err
+        }
+        w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+        fmt.Fprintln(w, "ID\tCREATED\tEXPIRES\tROLES\tDESCRIPTION")
+        for _, t := range tokens {
+            expires := "never"
+            if t.Expires != nil {
+                expires = t.Expires.Format(time.RFC3339)
+                if t.Expired(time.Now()) {
+                    expires += " (expired)"
+                }
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.Created.Format(time.RFC3339), expires, strings.Join(t.Roles, ","), t.Description)
+        }
+        return w.Flush()
+    case "revoke":
+        if flags.NArg() != 1 {
+            return errors.New(usage)
+        }
+        if err := store.Revoke(flags.Arg(0)); err != nil {
+            return err
+        }
+        fmt.Fprintf(os.Stderr, "revoked token %s\n", flags.Arg(0))
+    default:
+        return errors.New(usage)
+    }
+    return nil
+}
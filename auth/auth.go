@@ -0,0 +1,26 @@
+package auth
+
+import (
+    "context"
+)
+
+// authenticated caller of a request
+type Identity struct {
+    Subject string      `json:"subject"`           // e.g. "token:4f1c2a9e0b7d3c55"
+    Method  string      `json:"method"`            // how the caller authenticated
+    Roles   []string    `json:"roles,omitempty"`
+}
+
+// context key for the identity
+type identityKey struct{}
+
+// returns a context carrying the identity
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+    return context.WithValue(ctx, identityKey{}, id)
+}
+
+// returns the identity of a request context, or nil if the caller is anonymous
+func FromContext(ctx context.Context) *Identity {
+    id, _ := ctx.Value(identityKey{}).(*Identity)
+    return id
+}
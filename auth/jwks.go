@@ -0,0 +1,285 @@
+package auth
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math/big"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// how often an unknown key id may trigger a refetch of a jwks url
+const jwksMinRefresh = time.Minute
+
+// largest jwks document that is read
+const jwksMaxSize = 1 << 20
+
+// json web key (rfc 7517), only the fields needed for signature keys
+type jwk struct {
+    Kty string  `json:"kty"`
+    Kid string  `json:"kid"`
+    Use string  `json:"use"`
+    Alg string  `json:"alg"`
+    N   string  `json:"n"`
+    E   string  `json:"e"`
+    Crv string  `json:"crv"`
+    X   string  `json:"x"`
+    Y   string  `json:"y"`
+}
+
+// public key from a jwks with the algorithm it is restricted to, if any
+type publicKey struct {
+    key crypto.PublicKey
+    alg string
+}
+
+// json web key set loaded from a file or url. files are reloaded when they
+// change, urls are cached for the ttl and refetched early for unknown key ids.
+// keys are loaded outside the lock, one load at a time, while verifications
+// keep using the cached keys.
+type JWKS struct {
+    source      string
+    ttl         time.Duration
+    client      *http.Client
+    mu          sync.Mutex
+    keys        map[string]publicKey
+    fetched     time.Time
+    modTime     time.Time
+    tried       time.Time       // time of the last load, successful or not
+    err         error           // error of the last load
+    loading     chan struct{}   // closed when the running load finishes, nil when none runs
+}
+
+// create a jwks from a file path or an http(s) url
+func NewJWKS(source string, ttl time.Duration) *JWKS {
+    return &JWKS{
+        source: source,
+        ttl:    ttl,
+        client: &http.Client{Timeout: 10 * time.Second},
+    }
+}
+
+func (j *JWKS) remote() bool {
+    return strings.HasPrefix(j.source, "https://") || strings.HasPrefix(j.source, "http://")
+}
+
+// returns the key with a key id, refreshing the set when needed. an empty kid
+// matches the only key of a single key set.
+func (j *JWKS) key(ctx context.Context, kid string) (publicKey, error) {
+    j.mu.Lock()
+    var done chan struct{}
+    if j.stale() {
+        done = j.load()
+    }
+    loaded := j.keys != nil
+    j.mu.Unlock()
+
+    // only the first load is waited for, later ones run in the background
+    if !loaded {
+        if err := j.wait(ctx, done); err != nil {
+            return publicKey{}, err
+        }
+    }
+
+    j.mu.Lock()
+    k, ok := j.lookup(kid)
+    rotated := !ok && j.remote() && time.Since(j.tried) > jwksMinRefresh
+    if rotated {
+        done = j.load()
+    }
+    j.mu.Unlock()
+    if rotated {
+        // the issuer may have rotated its keys
+        if err := j.wait(ctx, done); err != nil {
+            return publicKey{}, err
+        }
+        j.mu.Lock()
+        k, ok = j.lookup(kid)
+        j.mu.Unlock()
+    }
+    if !ok {
+        return publicKey{}, fmt.Errorf("unknown key id %q", kid)
+    }
+    return k, nil
+}
+
+// j.mu must be held
+func (j *JWKS) lookup(kid string) (publicKey, bool) {
+    if kid == "" && len(j.keys) == 1 {
+        for _, k := range j.keys {
+            return k, true
+        }
+    }
+    k, ok := j.keys[kid]
+    return k, ok
+}
+
+// returns whether the set should be reloaded. failed loads are retried at
+// most once a minute while cached keys are used. j.mu must be held.
+func (j *JWKS) stale() bool {
+    if j.keys == nil {
+        return true
+    }
+    if j.err != nil && time.Since(j.tried) < jwksMinRefresh {
+        return false
+    }
+    if j.remote() {
+        return time.Since(j.fetched) >= j.ttl
+    }
+    info, err := os.Stat(j.source)
+    return err != nil || !info.ModTime().Equal(j.modTime)
+}
+
+// start loading the set unless a load is running, returns a channel closed
+// when the load finishes. the load does not use a request context since its
+// result is shared. j.mu must be held.
+func (j *JWKS) load() chan struct{} {
+    if j.loading != nil {
+        return j.loading
+    }
+    done := make(chan struct{})
+    j.loading = done
+    go func() {
+        keys, modTime, err := j.read()
+        j.mu.Lock()
+        j.tried, j.err = time.Now(), err
+        if err == nil {
+            j.keys, j.fetched, j.modTime = keys, time.Now(), modTime
+        }
+        j.loading = nil
+        j.mu.Unlock()
+        close(done)
+    }()
+    return done
+}
+
+// wait for a load to finish and return its error
+func (j *JWKS) wait(ctx context.Context, done chan struct{}) error {
+    select {
+    case <-done:
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return j.err
+}
+
+// read and parse the set, returning the modification time of files
+func (j *JWKS) read() (map[string]publicKey, time.Time, error) {
+    var data []byte
+    var modTime time.Time
+    if j.remote() {
+        resp, err := j.client.Get(j.source)
+        if err != nil {
+            return nil, modTime, fmt.Errorf("error fetching jwks: %s", err)
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            return nil, modTime, fmt.Errorf("error fetching jwks: %s", resp.Status)
+        }
+        data, err = io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+        if err != nil {
+            return nil, modTime, fmt.Errorf("error fetching jwks: %s", err)
+        }
+    } else {
+        info, err := os.Stat(j.source)
+        if err != nil {
+            return nil, modTime, fmt.Errorf("error reading jwks file: %s", err)
+        }
+        data, err = os.ReadFile(j.source)
+        if err != nil {
+            return nil, modTime, fmt.Errorf("error reading jwks file: %s", err)
+        }
+        modTime = info.ModTime()
+    }
+    keys, err := parseJWKS(data)
+    return keys, modTime, err
+}
+
+// parse the signature keys of a jwks document, skipping unsupported keys
+func parseJWKS(data []byte) (map[string]publicKey, error) {
+    var set struct {
+        Keys []jwk `json:"keys"`
+    }
+    if err := json.Unmarshal(data, &set); err != nil {
+        return nil, fmt.Errorf("error unmarshalling jwks: %s", err)
+    }
+    keys := make(map[string]publicKey)
+    for _, k := range set.Keys {
+        if k.Use != "" && k.Use != "sig" {
+            continue
+        }
+        key, err := k.publicKey()
+        if err != nil {
+            return nil, fmt.Errorf("key %q: %s", k.Kid, err)
+        }
+        if key != nil {
+            keys[k.Kid] = publicKey{key: key, alg: k.Alg}
+        }
+    }
+    if len(keys) == 0 {
+        return nil, errors.New("jwks has no supported signature keys")
+    }
+    return keys, nil
+}
+
+// returns the public key, or nil for unsupported key types
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+    switch k.Kty {
+    case "RSA":
+        n, err := base64.RawURLEncoding.DecodeString(k.N)
+        if err != nil {
+            return nil, fmt.Errorf("invalid modulus: %s", err)
+        }
+        e, err := base64.RawURLEncoding.DecodeString(k.E)
+        if err != nil || len(e) > 4 {
+            return nil, errors.New("invalid exponent")
+        }
+        return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+    case "EC":
+        var curve elliptic.Curve
+        switch k.Crv {
+        case "P-256":
+            curve = elliptic.P256()
+        case "P-384":
+            curve = elliptic.P384()
+        case "P-521":
+            curve = elliptic.P521()
+        default:
+            return nil, nil
+        }
+        x, errX := base64.RawURLEncoding.DecodeString(k.X)
+        y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+        if errX != nil || errY != nil {
+            return nil, errors.New("invalid coordinates")
+        }
+        key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+        if !curve.IsOnCurve(key.X, key.Y) {
+            return nil, errors.New("point is not on the curve")
+        }
+        return key, nil
+    case "OKP":
+        if k.Crv != "Ed25519" {
+            return nil, nil
+        }
+        x, err := base64.RawURLEncoding.DecodeString(k.X)
+        if err != nil || len(x) != ed25519.PublicKeySize {
+            return nil, errors.New("invalid Ed25519 key")
+        }
+        return ed25519.PublicKey(x), nil
+    }
+    return nil, nil
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "strings"
+    "time"
+)
+
+// errors returned when verifying a jwt
+var (
+    ErrInvalidJWT = errors.New("invalid jwt")
+    ErrExpiredJWT = errors.New("jwt has expired")
+)
+
+// checks jwt bearer tokens against a jwks and maps their claims to an identity
+type JWTVerifier struct {
+    Keys        *JWKS
+    Issuer      string              // required iss claim, "" accepts any issuer
+    Audience    string              // required aud claim, "" accepts any audience
+    RolesClaim  string              // claim holding the caller's groups, "groups" by default
+    RoleMap     map[string][]string // maps claim values to roles, claim values are used as is when nil
+    Leeway      time.Duration       // allowed clock skew for exp and nbf
+}
+
+// hash for each supported signature algorithm
+var jwtHashes = map[string]crypto.Hash{
+    "RS256": crypto.SHA256,
+    "RS384": crypto.SHA384,
+    "RS512": crypto.SHA512,
+    "PS256": crypto.SHA256,
+    "PS384": crypto.SHA384,
+    "PS512": crypto.SHA512,
+    "ES256": crypto.SHA256,
+    "ES384": crypto.SHA384,
+    "ES512": crypto.SHA512,
+    "EdDSA": 0,
+}
+
+// curve size each ecdsa algorithm must use
+var jwtCurveBits = map[string]int{
+    "ES256": 256,
+    "ES384": 384,
+    "ES512": 521,
+}
+
+// returns true if a bearer token looks like a jwt rather than an api token
+func IsJWT(bearer string) bool {
+    return strings.Count(bearer, ".") == 2
+}
+
+// verify a compact jws jwt and return the caller identity
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*Identity, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, ErrInvalidJWT
+    }
+
+    // header
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err := decodeSegment(parts[0], &header); err != nil {
+        return nil, ErrInvalidJWT
+    }
+    hash, ok := jwtHashes[header.Alg]
+    if !ok {
+        return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidJWT, header.Alg)
+    }
+
+    // signature
+    key, err := v.Keys.key(ctx, header.Kid)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s", ErrInvalidJWT, err)
+    }
+    if key.alg != "" && key.alg != header.Alg {
+        return nil, fmt.Errorf("%w: key %q is not for %s", ErrInvalidJWT, header.Kid, header.Alg)
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, ErrInvalidJWT
+    }
+    if err := verifySignature(header.Alg, hash, key.key, []byte(parts[0] + "." + parts[1]), signature); err != nil {
+        return nil, fmt.Errorf("%w: %s", ErrInvalidJWT, err)
+    }
+
+    // claims
+    var claims map[string]any
+    if err := decodeSegment(parts[1], &claims); err != nil {
+        return nil, ErrInvalidJWT
+    }
+    now := time.Now()
+    exp, ok := claims["exp"].(float64)
+    if !ok {
+        return nil, fmt.Errorf("%w: missing exp claim", ErrInvalidJWT)
+    }
+    if now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+        return nil, ErrExpiredJWT
+    }
+    if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+        return nil, fmt.Errorf("%w: not valid yet", ErrInvalidJWT)
+    }
+    if v.Issuer != "" && claims["iss"] != v.Issuer {
+        return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidJWT)
+    }
+    if v.Audience != "" && !contains(stringList(claims["aud"]), v.Audience) {
+        return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidJWT)
+    }
+    sub, _ := claims["sub"].(string)
+    if sub == "" {
+        return nil, fmt.Errorf("%w: missing sub claim", ErrInvalidJWT)
+    }
+
+    return &Identity{Subject: "jwt:" + sub, Method: "jwt", Roles: v.roles(claims)}, nil
+}
+
+// map the roles claim to roles
+func (v *JWTVerifier) roles(claims map[string]any) []string {
+    claim := v.RolesClaim
+    if claim == "" {
+        claim = "groups"
+    }
+    values := stringList(claims[claim])
+    if v.RoleMap == nil {
+        return values
+    }
+    roles := make([]string, 0)
+    for _, value := range values {
+        for _, role := range v.RoleMap[value] {
+            if !contains(roles, role) {
+                roles = append(roles, role)
+            }
+        }
+    }
+    return roles
+}
+
+// returns a claim that is a string or a list of strings as a list
+func stringList(claim any) []string {
+    switch claim := claim.(type) {
+    case string:
+        return []string{claim}
+    case []any:
+        list := make([]string, 0, len(claim))
+        for _, item := range claim {
+            if s, ok := item.(string); ok {
+                list = append(list, s)
+            }
+        }
+        return list
+    }
+    return nil
+}
+
+// decode a base64url json segment
+func decodeSegment(segment string, v any) error {
+    data, err := base64.RawURLEncoding.DecodeString(segment)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+// verify a jws signature with the key type the algorithm requires
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed []byte, signature []byte) error {
+    var digest []byte
+    if hash != 0 {
+        h := hash.New()
+        h.Write(signed)
+        digest = h.Sum(nil)
+    }
+    switch key := key.(type) {
+    case *rsa.PublicKey:
+        switch alg[:2] {
+        case "RS":
+            return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+        case "PS":
+            return rsa.VerifyPSS(key, hash, digest, signature, nil)
+        }
+    case *ecdsa.PublicKey:
+        bits := key.Curve.Params().BitSize
+        size := (bits + 7) / 8
+        if alg[:2] != "ES" || jwtCurveBits[alg] != bits || len(signature) != 2 * size {
+            break
+        }
+        r := new(big.Int).SetBytes(signature[:size])
+        s := new(big.Int).SetBytes(signature[size:])
+        if !ecdsa.Verify(key, digest, r, s) {
+            return errors.New("signature does not match")
+        }
+        return nil
+    case ed25519.PublicKey:
+        if alg != "EdDSA" {
+            break
+        }
+        if !ed25519.Verify(key, signed, signature) {
+            return errors.New("signature does not match")
+        }
+        return nil
+    }
+    return fmt.Errorf("key type %T cannot verify %s", key, alg)
+}
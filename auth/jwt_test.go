@@ -0,0 +1,224 @@
+package auth
+
+import (
+    "context"
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// an ed25519 signing key with its key id
+type testKey struct {
+    kid     string
+    private ed25519.PrivateKey
+}
+
+func newTestKey(t *testing.T, kid string) testKey {
+    t.Helper()
+    _, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return testKey{kid: kid, private: private}
+}
+
+// returns a jwks document holding the public keys
+func jwksDocument(t *testing.T, keys ...testKey) []byte {
+    t.Helper()
+    set := struct {
+        Keys []jwk `json:"keys"`
+    }{}
+    for _, k := range keys {
+        x := base64.RawURLEncoding.EncodeToString(k.private.Public().(ed25519.PublicKey))
+        set.Keys = append(set.Keys, jwk{Kty: "OKP", Crv: "Ed25519", Kid: k.kid, Alg: "EdDSA", Use: "sig", X: x})
+    }
+    data, err := json.Marshal(set)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return data
+}
+
+// write a jwks file with a modification time that differs from the last write
+func writeJWKS(t *testing.T, file string, modTime time.Time, keys ...testKey) {
+    t.Helper()
+    if err := os.WriteFile(file, jwksDocument(t, keys...), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Chtimes(file, modTime, modTime); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// returns a signed jwt with claims
+func signJWT(t *testing.T, k testKey, claims map[string]any) string {
+    t.Helper()
+    header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "kid": k.kid})
+    payload, err := json.Marshal(claims)
+    if err != nil {
+        t.Fatal(err)
+    }
+    signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+    return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(k.private, []byte(signed)))
+}
+
+// returns valid claims, changed by the test cases
+func testClaims() map[string]any {
+    return map[string]any{
+        "iss":      "https://issuer.example.com",
+        "aud":      []string{"other", "dns-manager"},
+        "sub":      "alice",
+        "exp":      time.Now().Add(time.Hour).Unix(),
+        "groups":   []string{"dns-admins", "unmapped"},
+    }
+}
+
+func TestJWTVerifierVerify(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "jwks.json")
+    key := newTestKey(t, "k1")
+    writeJWKS(t, file, time.Now().Add(-time.Hour), key)
+    v := &JWTVerifier{
+        Keys:       NewJWKS(file, time.Hour),
+        Issuer:     "https://issuer.example.com",
+        Audience:   "dns-manager",
+        RoleMap:    map[string][]string{"dns-admins": {"admin", "writer"}},
+        Leeway:     time.Minute,
+    }
+
+    tests := []struct {
+        name    string
+        key     testKey
+        change  func(map[string]any)
+        err     error
+    }{
+        {name: "valid", key: key, change: func(map[string]any) {}},
+        {name: "single audience", key: key, change: func(c map[string]any) { c["aud"] = "dns-manager" }},
+        {name: "expired within leeway", key: key, change: func(c map[string]any) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }},
+        {name: "expired", key: key, change: func(c map[string]any) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, err: ErrExpiredJWT},
+        {name: "missing exp", key: key, change: func(c map[string]any) { delete(c, "exp") }, err: ErrInvalidJWT},
+        {name: "not valid yet", key: key, change: func(c map[string]any) { c["nbf"] = time.Now().Add(time.Hour).Unix() }, err: ErrInvalidJWT},
+        {name: "wrong issuer", key: key, change: func(c map[string]any) { c["iss"] = "https://evil.example.com" }, err: ErrInvalidJWT},
+        {name: "wrong audience", key: key, change: func(c map[string]any) { c["aud"] = "other" }, err: ErrInvalidJWT},
+        {name: "missing sub", key: key, change: func(c map[string]any) { delete(c, "sub") }, err: ErrInvalidJWT},
+        {name: "unknown key", key: newTestKey(t, "k2"), change: func(map[string]any) {}, err: ErrInvalidJWT},
+        {name: "wrong signature", key: testKey{kid: "k1", private: newTestKey(t, "").private}, change: func(map[string]any) {}, err: ErrInvalidJWT},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            claims := testClaims()
+            tt.change(claims)
+            id, err := v.Verify(context.Background(), signJWT(t, tt.key, claims))
+            if tt.err != nil {
+                if !errors.Is(err, tt.err) {
+                    t.Fatalf("got error %v, want %v", err, tt.err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if id.Subject != "jwt:alice" || id.Method != "jwt" || strings.Join(id.Roles, ",") != "admin,writer" {
+                t.Fatalf("got identity %+v", id)
+            }
+        })
+    }
+}
+
+func TestJWKSFileKeyRollover(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "jwks.json")
+    old, next := newTestKey(t, "old"), newTestKey(t, "new")
+    writeJWKS(t, file, time.Now().Add(-time.Hour), old)
+    v := &JWTVerifier{Keys: NewJWKS(file, time.Hour), Issuer: "https://issuer.example.com", Audience: "dns-manager"}
+    verify := func(k testKey) error {
+        _, err := v.Verify(context.Background(), signJWT(t, k, testClaims()))
+        return err
+    }
+    // file reloads run in the background, wait for the one a verification started
+    waitLoaded := func() {
+        v.Keys.mu.Lock()
+        done := v.Keys.loading
+        v.Keys.mu.Unlock()
+        if done != nil {
+            <-done
+        }
+    }
+
+    if err := verify(old); err != nil {
+        t.Fatalf("old key: %s", err)
+    }
+    if err := verify(next); !errors.Is(err, ErrInvalidJWT) {
+        t.Fatalf("new key before rollover: got %v", err)
+    }
+
+    // both keys are published while tokens signed with the old key are still valid
+    writeJWKS(t, file, time.Now().Add(-time.Minute), old, next)
+    verify(old)
+    waitLoaded()
+    if err := verify(next); err != nil {
+        t.Fatalf("new key after rollover: %s", err)
+    }
+    if err := verify(old); err != nil {
+        t.Fatalf("old key after rollover: %s", err)
+    }
+
+    // the old key is retired
+    writeJWKS(t, file, time.Now(), next)
+    verify(next)
+    waitLoaded()
+    if err := verify(old); !errors.Is(err, ErrInvalidJWT) {
+        t.Fatalf("old key after retirement: got %v", err)
+    }
+    if err := verify(next); err != nil {
+        t.Fatalf("new key after retirement: %s", err)
+    }
+}
+
+func TestJWKSRefreshDoesNotBlock(t *testing.T) {
+    key := newTestKey(t, "k1")
+    document := jwksDocument(t, key)
+    release, refreshing := make(chan struct{}), make(chan struct{})
+    var fetches atomic.Int32
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if fetches.Add(1) == 2 {
+            close(refreshing)
+            <-release
+        }
+        w.Write(document)
+    }))
+    defer server.Close()
+    defer close(release)
+
+    // a ttl of 0 makes every verification start a refresh
+    v := &JWTVerifier{Keys: NewJWKS(server.URL, 0), Issuer: "https://issuer.example.com", Audience: "dns-manager"}
+    token := signJWT(t, key, testClaims())
+    if _, err := v.Verify(context.Background(), token); err != nil {
+        t.Fatal(err)
+    }
+
+    // the second fetch hangs, verifications keep using the cached keys
+    if _, err := v.Verify(context.Background(), token); err != nil {
+        t.Fatal(err)
+    }
+    <-refreshing
+    for i := 0; i < 5; i++ {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        _, err := v.Verify(ctx, token)
+        cancel()
+        if err != nil {
+            t.Fatalf("verification %d during refresh: %s", i, err)
+        }
+    }
+    if n := fetches.Load(); n != 2 {
+        t.Fatalf("got %d fetches, want 2 as refreshes run one at a time", n)
+    }
+}
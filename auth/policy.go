@@ -0,0 +1,182 @@
+package auth
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// operations a policy can grant
+type Action string
+
+const (
+    ActionRead      Action = "read"
+    ActionCreate    Action = "create"
+    ActionDelete    Action = "delete"
+)
+
+// rule effects
+const (
+    EffectAllow = "allow"
+    EffectDeny  = "deny"
+)
+
+// policy rule, like a BIND update-policy grant or deny statement. empty
+// lists match anything; names and types only match requests for a record.
+type Rule struct {
+    Effect      string      `json:"effect"`
+    Subjects    []string    `json:"subjects,omitempty"`    // identity subjects, e.g. "token:4f1c2a9e0b7d3c55"
+    Roles       []string    `json:"roles,omitempty"`       // identity roles
+    Actions     []Action    `json:"actions,omitempty"`
+    Zones       []string    `json:"zones,omitempty"`       // "example.com.", "*.example.com." or "*"
+    Names       []string    `json:"names,omitempty"`       // "www.example.com.", "*.dev.example.com." or "*"
+    Types       []string    `json:"types,omitempty"`       // "A", "AAAA", ...
+    Comment     string      `json:"comment,omitempty"`
+}
+
+// ordered rules, the first matching rule decides and requests no rule
+// matches are denied
+type Policy struct {
+    Rules []Rule `json:"rules"`
+}
+
+// what a caller is trying to do
+type Request struct {
+    Identity    *Identity
+    Action      Action
+    Zone        string
+    Name        string  // record name, "" for zone wide requests such as transfers
+    Type        string  // record type, "" for zone wide requests
+}
+
+// outcome of evaluating a request, Rule is nil when no rule matched
+type Decision struct {
+    Allowed     bool
+    Rule        *Rule
+    Index       int
+}
+
+// load a json policy file
+func LoadPolicy(file string) (*Policy, error) {
+    data, err := os.ReadFile(file)
+    if err != nil {
+        return nil, fmt.Errorf("error reading policy file: %s", err)
+    }
+    var p Policy
+    if err := json.Unmarshal(data, &p); err != nil {
+        return nil, fmt.Errorf("error unmarshalling policy file: %s", err)
+    }
+    if err := p.Validate(); err != nil {
+        return nil, err
+    }
+    return &p, nil
+}
+
+// check rule effects and actions
+func (p *Policy) Validate() error {
+    for i, rule := range p.Rules {
+        if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+            return fmt.Errorf("rule %d: effect must be %q or %q, got %q", i, EffectAllow, EffectDeny, rule.Effect)
+        }
+        for _, action := range rule.Actions {
+            if action != ActionRead && action != ActionCreate && action != ActionDelete {
+                return fmt.Errorf("rule %d: unknown action %q, expected read, create or delete", i, action)
+            }
+        }
+    }
+    return nil
+}
+
+// returns the decision of the first rule matching the request
+func (p *Policy) Evaluate(req Request) Decision {
+    for i := range p.Rules {
+        if p.Rules[i].matches(req) {
+            return Decision{Allowed: p.Rules[i].Effect == EffectAllow, Rule: &p.Rules[i], Index: i}
+        }
+    }
+    return Decision{Allowed: false, Index: -1}
+}
+
+// returns true if every condition of the rule matches the request
+func (r *Rule) matches(req Request) bool {
+    if len(r.Subjects) > 0 || len(r.Roles) > 0 {
+        if req.Identity == nil {
+            return false
+        }
+        if !contains(r.Subjects, req.Identity.Subject) && !containsAny(r.Roles, req.Identity.Roles) {
+            return false
+        }
+    }
+    if len(r.Actions) > 0 && !contains(r.Actions, req.Action) {
+        return false
+    }
+    if len(r.Zones) > 0 && !matchesAnyName(r.Zones, req.Zone) {
+        return false
+    }
+    if len(r.Names) > 0 && (req.Name == "" || !matchesAnyName(r.Names, req.Name)) {
+        return false
+    }
+    if len(r.Types) > 0 {
+        if req.Type == "" {
+            return false
+        }
+        match := false
+        for _, t := range r.Types {
+            match = match || strings.EqualFold(t, req.Type)
+        }
+        if !match {
+            return false
+        }
+    }
+    return true
+}
+
+func contains[T comparable](list []T, v T) bool {
+    for _, item := range list {
+        if item == v {
+            return true
+        }
+    }
+    return false
+}
+
+func containsAny(list []string, values []string) bool {
+    for _, v := range values {
+        if contains(list, v) {
+            return true
+        }
+    }
+    return false
+}
+
+// returns true if name matches a pattern: "*" matches any name,
+// "*.example.com." any name below example.com., anything else the exact name
+func matchesAnyName(patterns []string, name string) bool {
+    name = canonical(name)
+    for _, pattern := range patterns {
+        if pattern == "*" {
+            return true
+        }
+        pattern = canonical(pattern)
+        if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+            if strings.HasSuffix(name, "." + suffix) {
+                return true
+            }
+            continue
+        }
+        if name == pattern {
+            return true
+        }
+    }
+    return false
+}
+
+// lower case name with a trailing dot
+func canonical(name string) string {
+    name = strings.ToLower(name)
+    if !strings.HasSuffix(name, ".") {
+        name += "."
+    }
+    return name
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestMatchesAnyName(t *testing.T) {
+    tests := []struct {
+        patterns    []string
+        name        string
+        match       bool
+    }{
+        {patterns: []string{"*"}, name: "anything.example.org.", match: true},
+        {patterns: []string{"example.com."}, name: "example.com.", match: true},
+        {patterns: []string{"example.com"}, name: "EXAMPLE.com.", match: true},
+        {patterns: []string{"example.com."}, name: "www.example.com."},
+        {patterns: []string{"*.example.com."}, name: "www.example.com.", match: true},
+        {patterns: []string{"*.example.com."}, name: "a.b.example.com.", match: true},
+        {patterns: []string{"*.Example.COM"}, name: "www.example.com", match: true},
+        {patterns: []string{"*.example.com."}, name: "example.com."},
+        {patterns: []string{"*.example.com."}, name: "badexample.com."},
+        {patterns: []string{"*.dev.example.com.", "www.example.com."}, name: "www.example.com.", match: true},
+        {patterns: []string{"*.dev.example.com.", "www.example.com."}, name: "api.example.com."},
+    }
+    for _, tt := range tests {
+        t.Run(strings.Join(tt.patterns, ",") + " " + tt.name, func(t *testing.T) {
+            if got := matchesAnyName(tt.patterns, tt.name); got != tt.match {
+                t.Fatalf("got %v, want %v", got, tt.match)
+            }
+        })
+    }
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+    p := &Policy{Rules: []Rule{
+        {Effect: EffectDeny, Zones: []string{"*"}, Names: []string{"*.prod.example.com."}, Actions: []Action{ActionDelete}},
+        {Effect: EffectDeny, Subjects: []string{"token:revoked"}},
+        {Effect: EffectAllow, Roles: []string{"admin"}},
+        {Effect: EffectAllow, Roles: []string{"writer"}, Zones: []string{"*.example.com."}, Names: []string{"*.dev.example.com."}, Types: []string{"a", "AAAA"}},
+        {Effect: EffectAllow, Subjects: []string{"token:ci"}, Actions: []Action{ActionRead}, Zones: []string{"example.com."}},
+    }}
+    admin := &Identity{Subject: "token:root", Roles: []string{"admin"}}
+    writer := &Identity{Subject: "token:dev", Roles: []string{"writer"}}
+    revoked := &Identity{Subject: "token:revoked", Roles: []string{"admin"}}
+    ci := &Identity{Subject: "token:ci"}
+
+    tests := []struct {
+        name    string
+        req     Request
+        allowed bool
+        index   int
+    }{
+        {name: "deny before a later allow", req: Request{Identity: admin, Action: ActionDelete, Zone: "prod.example.com.", Name: "db.prod.example.com.", Type: "A"}, index: 0},
+        {name: "deny does not match other actions", req: Request{Identity: admin, Action: ActionCreate, Zone: "prod.example.com.", Name: "db.prod.example.com.", Type: "A"}, allowed: true, index: 2},
+        {name: "denied subject keeps its roles from granting", req: Request{Identity: revoked, Action: ActionRead, Zone: "example.com."}, index: 1},
+        {name: "role allowed", req: Request{Identity: admin, Action: ActionRead, Zone: "example.com."}, allowed: true, index: 2},
+        {name: "name and type globs", req: Request{Identity: writer, Action: ActionCreate, Zone: "dev.example.com.", Name: "web.dev.example.com.", Type: "A"}, allowed: true, index: 3},
+        {name: "type outside the rule", req: Request{Identity: writer, Action: ActionCreate, Zone: "dev.example.com.", Name: "web.dev.example.com.", Type: "TXT"}, index: -1},
+        {name: "name outside the rule", req: Request{Identity: writer, Action: ActionCreate, Zone: "dev.example.com.", Name: "www.example.com.", Type: "A"}, index: -1},
+        {name: "zone glob does not match the apex", req: Request{Identity: writer, Action: ActionCreate, Zone: "example.com.", Name: "web.dev.example.com.", Type: "A"}, index: -1},
+        {name: "zone wide request skips rules with names", req: Request{Identity: writer, Action: ActionRead, Zone: "dev.example.com."}, index: -1},
+        {name: "subject with exact zone", req: Request{Identity: ci, Action: ActionRead, Zone: "Example.com"}, allowed: true, index: 4},
+        {name: "subject with another zone", req: Request{Identity: ci, Action: ActionRead, Zone: "dev.example.com."}, index: -1},
+        {name: "anonymous", req: Request{Action: ActionRead, Zone: "example.com."}, index: -1},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            d := p.Evaluate(tt.req)
+            if d.Allowed != tt.allowed || d.Index != tt.index {
+                t.Fatalf("got allowed %v by rule %d, want %v by rule %d", d.Allowed, d.Index, tt.allowed, tt.index)
+            }
+            if (d.Rule == nil) != (tt.index < 0) || d.Rule != nil && d.Rule != &p.Rules[tt.index] {
+                t.Fatalf("got rule %+v for index %d", d.Rule, tt.index)
+            }
+        })
+    }
+}
+
+func TestLoadPolicy(t *testing.T) {
+    tests := []struct {
+        name    string
+        data    string
+        err     string
+    }{
+        {name: "valid", data: `{"rules": [{"effect": "allow", "roles": ["admin"], "actions": ["read", "create", "delete"]}]}`},
+        {name: "unknown effect", data: `{"rules": [{"effect": "permit"}]}`, err: `rule 0: effect must be "allow" or "deny", got "permit"`},
+        {name: "unknown action", data: `{"rules": [{"effect": "allow"}, {"effect": "deny", "actions": ["update"]}]}`, err: `rule 1: unknown action "update"`},
+        {name: "invalid json", data: `{"rules": [`, err: "error unmarshalling policy file"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            file := filepath.Join(t.TempDir(), "policy.json")
+            if err := os.WriteFile(file, []byte(tt.data), 0600); err != nil {
+                t.Fatal(err)
+            }
+            p, err := LoadPolicy(file)
+            if tt.err == "" {
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if len(p.Rules) != 1 {
+                    t.Fatalf("got %d rules, want 1", len(p.Rules))
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.err) {
+                t.Fatalf("got error %v, want %q", err, tt.err)
+            }
+        })
+    }
+}
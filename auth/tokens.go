@@ -0,0 +1,242 @@
+package auth
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// prefix of every bearer token, followed by the token id and secret
+const tokenPrefix = "dnsm_"
+
+// errors returned when verifying a token
+var (
+    ErrInvalidToken = errors.New("invalid token")
+    ErrExpiredToken = errors.New("token has expired")
+)
+
+// stored bearer token, only a salted hash of the secret is kept
+type Token struct {
+    ID          string      `json:"id"`
+    Description string      `json:"description,omitempty"`
+    Roles       []string    `json:"roles,omitempty"`
+    Salt        string      `json:"salt"`
+    Hash        string      `json:"hash"`
+    Created     time.Time   `json:"created"`
+    Expires     *time.Time  `json:"expires,omitempty"`
+}
+
+// returns true if the token has expired at now
+func (t *Token) Expired(now time.Time) bool {
+    return t.Expires != nil && !now.Before(*t.Expires)
+}
+
+// tokens kept in a json file, reloaded when the file changes
+type TokenStore struct {
+    file    string
+    mu      sync.Mutex
+    tokens  map[string]*Token
+    modTime time.Time
+}
+
+// open a token store, the file is created on the first change if it does not exist
+func OpenTokenStore(file string) (*TokenStore, error) {
+    s := &TokenStore{file: file, tokens: make(map[string]*Token)}
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.load(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// reload tokens if the file changed since it was last read
+func (s *TokenStore) load() error {
+    info, err := os.Stat(s.file)
+    if errors.Is(err, os.ErrNotExist) {
+        s.tokens = make(map[string]*Token)
+        s.modTime = time.Time{}
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("error reading token file: %s", err)
+    }
+    if info.ModTime().Equal(s.modTime) {
+        return nil
+    }
+
+    data, err := os.ReadFile(s.file)
+    if err != nil {
+        return fmt.Errorf("error reading token file: %s", err)
+    }
+    var tokens []*Token
+    if err := json.Unmarshal(data, &tokens); err != nil {
+        return fmt.Errorf("error unmarshalling token file: %s", err)
+    }
+    s.tokens = make(map[string]*Token, len(tokens))
+    for _, t := range tokens {
+        s.tokens[t.ID] = t
+    }
+    s.modTime = info.ModTime()
+    return nil
+}
+
+// write tokens to a temporary file and move it into place
+func (s *TokenStore) save() error {
+    data, err := json.MarshalIndent(s.list(), "", "    ")
+    if err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(s.file), ".tokens-*")
+    if err != nil {
+        return fmt.Errorf("error writing token file: %s", err)
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(append(data, '\n')); err != nil {
+        tmp.Close()
+        return fmt.Errorf("error writing token file: %s", err)
+    }
+    if err := tmp.Close(); err != nil {
+        return fmt.Errorf("error writing token file: %s", err)
+    }
+    if err := os.Rename(tmp.Name(), s.file); err != nil {
+        return fmt.Errorf("error writing token file: %s", err)
+    }
+    if info, err := os.Stat(s.file); err == nil {
+        s.modTime = info.ModTime()
+    }
+    return nil
+}
+
+// tokens ordered by creation time
+func (s *TokenStore) list() []*Token {
+    tokens := make([]*Token, 0, len(s.tokens))
+    for _, t := range s.tokens {
+        tokens = append(tokens, t)
+    }
+    sort.Slice(tokens, func(i, j int) bool {
+        return tokens[i].Created.Before(tokens[j].Created)
+    })
+    return tokens
+}
+
+// returns every stored token
+func (s *TokenStore) List() ([]*Token, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.load(); err != nil {
+        return nil, err
+    }
+    return s.list(), nil
+}
+
+// create and store a token with roles for authorization policies, returning
+// the bearer token which is not stored and cannot be shown again. a zero ttl
+// never expires.
+func (s *TokenStore) Create(description string, roles []string, ttl time.Duration) (string, *Token, error) {
+    id := make([]byte, 8)
+    secret := make([]byte, 32)
+    salt := make([]byte, 16)
+    for _, b := range [][]byte{id, secret, salt} {
+        if _, err := rand.Read(b); err != nil {
+            return "", nil, fmt.Errorf("error generating token: %s", err)
+        }
+    }
+    secretString := base64.RawURLEncoding.EncodeToString(secret)
+    t := &Token{
+        ID:             hex.EncodeToString(id),
+        Description:    description,
+        Roles:          roles,
+        Salt:           base64.StdEncoding.EncodeToString(salt),
+        Hash:           base64.StdEncoding.EncodeToString(hashSecret(salt, secretString)),
+        Created:        time.Now().UTC().Truncate(time.Second),
+    }
+    if ttl > 0 {
+        expires := t.Created.Add(ttl)
+        t.Expires = &expires
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.load(); err != nil {
+        return "", nil, err
+    }
+    s.tokens[t.ID] = t
+    if err := s.save(); err != nil {
+        delete(s.tokens, t.ID)
+        return "", nil, err
+    }
+    return tokenPrefix + t.ID + "_" + secretString, t, nil
+}
+
+// remove a token
+func (s *TokenStore) Revoke(id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.load(); err != nil {
+        return err
+    }
+    t, ok := s.tokens[id]
+    if !ok {
+        return fmt.Errorf("token %s not found", id)
+    }
+    delete(s.tokens, id)
+    if err := s.save(); err != nil {
+        s.tokens[id] = t
+        return err
+    }
+    return nil
+}
+
+// check a bearer token and return the stored token it matches
+func (s *TokenStore) Verify(bearer string) (*Token, error) {
+    id, secret, ok := strings.Cut(strings.TrimPrefix(bearer, tokenPrefix), "_")
+    if !ok || !strings.HasPrefix(bearer, tokenPrefix) {
+        return nil, ErrInvalidToken
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.load(); err != nil {
+        return nil, err
+    }
+    t, ok := s.tokens[id]
+    if !ok {
+        return nil, ErrInvalidToken
+    }
+    salt, err := base64.StdEncoding.DecodeString(t.Salt)
+    if err != nil {
+        return nil, ErrInvalidToken
+    }
+    hash, err := base64.StdEncoding.DecodeString(t.Hash)
+    if err != nil {
+        return nil, ErrInvalidToken
+    }
+    if subtle.ConstantTimeCompare(hashSecret(salt, secret), hash) != 1 {
+        return nil, ErrInvalidToken
+    }
+    if t.Expired(time.Now()) {
+        return nil, ErrExpiredToken
+    }
+    return t, nil
+}
+
+// salted sha-256 of a token secret. secrets are 256 random bits, so a slow
+// password hash would add nothing.
+func hashSecret(salt []byte, secret string) []byte {
+    h := sha256.New()
+    h.Write(salt)
+    h.Write([]byte(secret))
+    return h.Sum(nil)
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+    "bytes"
+    "encoding/base64"
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// opens a token store in a temporary directory
+func newTokenStore(t *testing.T) *TokenStore {
+    t.Helper()
+    s, err := OpenTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return s
+}
+
+func TestTokenExpired(t *testing.T) {
+    now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+    before, after := now.Add(-time.Second), now.Add(time.Second)
+    tests := []struct {
+        name    string
+        expires *time.Time
+        expired bool
+    }{
+        {name: "never expires"},
+        {name: "expires later", expires: &after},
+        {name: "expires now", expires: &now, expired: true},
+        {name: "expired before", expires: &before, expired: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            token := &Token{Expires: tt.expires}
+            if got := token.Expired(now); got != tt.expired {
+                t.Fatalf("got expired %v, want %v", got, tt.expired)
+            }
+        })
+    }
+}
+
+func TestTokenHash(t *testing.T) {
+    s := newTokenStore(t)
+    bearer, token, err := s.Create("ci", []string{"writer"}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    secret, ok := strings.CutPrefix(bearer, tokenPrefix + token.ID + "_")
+    if !ok {
+        t.Fatalf("got bearer token %q for id %s", bearer, token.ID)
+    }
+
+    // only the salted hash of the secret is stored
+    salt, _ := base64.StdEncoding.DecodeString(token.Salt)
+    hash, _ := base64.StdEncoding.DecodeString(token.Hash)
+    if len(salt) != 16 || !bytes.Equal(hash, hashSecret(salt, secret)) {
+        t.Fatalf("got salt %x and hash %x, want the salted sha-256 of the secret", salt, hash)
+    }
+    data, err := os.ReadFile(s.file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Contains(data, []byte(secret)) {
+        t.Fatal("token file holds the secret")
+    }
+
+    // the same secret hashes differently with another salt
+    if bytes.Equal(hashSecret([]byte("other salt"), secret), hash) {
+        t.Fatal("hash does not depend on the salt")
+    }
+}
+
+func TestTokenVerify(t *testing.T) {
+    s := newTokenStore(t)
+    bearer, token, err := s.Create("ci", []string{"writer"}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    expiredBearer, _, err := s.Create("old", nil, time.Nanosecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    id, secret, _ := strings.Cut(strings.TrimPrefix(bearer, tokenPrefix), "_")
+
+    tests := []struct {
+        name    string
+        bearer  string
+        err     error
+    }{
+        {name: "valid", bearer: bearer},
+        {name: "expired", bearer: expiredBearer, err: ErrExpiredToken},
+        {name: "wrong secret", bearer: tokenPrefix + id + "_" + strings.Repeat("A", len(secret)), err: ErrInvalidToken},
+        {name: "unknown id", bearer: tokenPrefix + "0000000000000000_" + secret, err: ErrInvalidToken},
+        {name: "missing prefix", bearer: id + "_" + secret, err: ErrInvalidToken},
+        {name: "missing separator", bearer: tokenPrefix + id + secret, err: ErrInvalidToken},
+        {name: "empty", bearer: "", err: ErrInvalidToken},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := s.Verify(tt.bearer)
+            if !errors.Is(err, tt.err) {
+                t.Fatalf("got error %v, want %v", err, tt.err)
+            }
+            if tt.err == nil && (got.ID != token.ID || strings.Join(got.Roles, ",") != "writer") {
+                t.Fatalf("got token %+v, want %+v", got, token)
+            }
+        })
+    }
+}
+
+func TestTokenRevoke(t *testing.T) {
+    s := newTokenStore(t)
+    bearer, token, err := s.Create("ci", nil, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    kept, _, err := s.Create("other", nil, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // a second store on the same file sees tokens created and revoked by the first
+    other, err := OpenTokenStore(s.file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := other.Verify(bearer); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Revoke(token.ID); err != nil {
+        t.Fatal(err)
+    }
+    for _, store := range []*TokenStore{s, other} {
+        if _, err := store.Verify(bearer); !errors.Is(err, ErrInvalidToken) {
+            t.Fatalf("got error %v for a revoked token, want %v", err, ErrInvalidToken)
+        }
+        if _, err := store.Verify(kept); err != nil {
+            t.Fatalf("other token stopped verifying: %s", err)
+        }
+    }
+    tokens, err := other.List()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(tokens) != 1 || tokens[0].Description != "other" {
+        t.Fatalf("got tokens %+v, want only the other token", tokens)
+    }
+
+    if err := s.Revoke(token.ID); err == nil {
+        t.Fatal("revoking an unknown token succeeded")
+    }
+}
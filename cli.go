@@ -0,0 +1,578 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "os"
+    "os/signal"
+    "sort"
+    "strings"
+    "text/tabwriter"
+    "golang.org/x/net/dns/dnsmessage"
+    "github.com/samchelini/dns-manager/dns"
+    "github.com/samchelini/dns-manager/jsend"
+)
+
+const usage = `usage: dns-manager <command> [flags] [args]
+
+commands:
+  serve [-config file]                          run the api server, the default
+  get [-json] <zone> [name [type]]              print the records of a zone
+  add [-ttl 3600] [-append] <zone> <name> <type> <data>
+                                                add a record, replacing its rrset unless -append
+  delete <zone> <name> <type>                   delete an rrset
+  export [-o file] <zone>                       write the records of a zone as json
+  import [-dry-run] <zone> <file>               change a zone to match an exported file
+  diff <zone> <file>                            compare a zone with an exported file
+  keygen -name <name> [-algorithm alg] [-format json|bind|knot|powerdns|all]
+                                                generate a tsig key
+  token create|list|revoke                      manage api bearer tokens
+
+get, add, delete, export, import and diff talk to the dns servers directly
+with the upstreams and keys of the config file (-config, CONFIG_FILE by
+default) and env vars. -server queries one server for every zone instead.
+names may be relative to the zone, "@" is the zone itself. types are A, NS
+or PTR for changes, any type for get.
+`
+
+// returned by diff when the zone and file differ, so the exit status is 1
+var errZoneDiffers = errors.New("zone differs from file")
+
+// runs the command in os.Args, serving the api when there is none
+func runCommand() error {
+    command, args := "serve", []string{}
+    if len(os.Args) > 1 {
+        command, args = os.Args[1], os.Args[2:]
+    }
+    commands := map[string]func([]string) error{
+        "serve":    serveCommand,
+        "get":      getCommand,
+        "add":      addCommand,
+        "delete":   deleteCommand,
+        "export":   exportCommand,
+        "import":   importCommand,
+        "diff":     diffCommand,
+        "keygen":   keygen,
+        "token":    tokenCommand,
+    }
+    switch command {
+    case "help", "-h", "-help", "--help":
+        fmt.Print(usage)
+        return nil
+    }
+    run, ok := commands[command]
+    if !ok {
+        fmt.Fprint(os.Stderr, usage)
+        return fmt.Errorf("unknown command %q", command)
+    }
+    if err := run(args); err != nil {
+        if command == "serve" || errors.Is(err, errZoneDiffers) {
+            return err
+        }
+        return fmt.Errorf("%s: %s", command, err)
+    }
+    return nil
+}
+
+// flags shared by the commands that talk to dns servers
+type dnsFlags struct {
+    *flag.FlagSet
+    config  *string
+    server  *string
+}
+
+func newDNSFlags(name string) dnsFlags {
+    flags := flag.NewFlagSet(name, flag.ContinueOnError)
+    return dnsFlags{
+        FlagSet:    flags,
+        config:     flags.String("config", os.Getenv("CONFIG_FILE"), "config file, CONFIG_FILE by default"),
+        server:     flags.String("server", "", "query this server for every zone instead of the configured upstreams"),
+    }
+}
+
+// parse the flags and check the number of args, then set up the dns client
+// and upstreams from the config file and env vars
+func (f dnsFlags) setup(args []string, minArgs int, maxArgs int) error {
+    if err := f.Parse(args); err != nil {
+        return err
+    }
+    if f.NArg() < minArgs || f.NArg() > maxArgs {
+        return errors.New("wrong number of arguments, see dns-manager help")
+    }
+    if *f.config != "" {
+        config, err := loadConfig(*f.config)
+        if err != nil {
+            return fmt.Errorf("error loading config: %s", err)
+        }
+        applyConfigEnv(config.Env())
+    }
+    if *f.server != "" {
+        os.Setenv("DNS_SERVER", *f.server)
+        os.Unsetenv("DNS_ZONE_SERVERS")
+    }
+
+    // only warnings and errors, as text, unless LOG_LEVEL or LOG_FORMAT say otherwise
+    if _, ok := os.LookupEnv("LOG_LEVEL"); !ok {
+        os.Setenv("LOG_LEVEL", "warn")
+    }
+    if _, ok := os.LookupEnv("LOG_FORMAT"); !ok {
+        os.Setenv("LOG_FORMAT", "text")
+    }
+    if err := setupLogging(); err != nil {
+        return err
+    }
+    if err := parseDNSClient(); err != nil {
+        return err
+    }
+    s := &settings{}
+    if err := parseUpstreams(s); err != nil {
+        return err
+    }
+    live.Store(s)
+    return nil
+}
+
+// returns a context cancelled on interrupt
+func commandContext() (context.Context, context.CancelFunc) {
+    return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// returns a jsend failure as an error
+func jsendError(jerr *jsend.Response) error {
+    if jerr.Message != nil {
+        return errors.New(*jerr.Message)
+    }
+    return fmt.Errorf("request failed with status %d", jerr.HttpCode)
+}
+
+// returns a zone name with a trailing dot
+func qualifyZone(zone string) string {
+    return strings.TrimSuffix(zone, ".") + "."
+}
+
+// returns a name relative to zone as a fully qualified name
+func qualifyName(name string, zone string) string {
+    switch {
+    case name == "@":
+        return zone
+    case strings.HasSuffix(name, "."):
+        return name
+    default:
+        return name + "." + zone
+    }
+}
+
+// returns the record type used by dns.Record, e.g. "TypeA" for "a"
+func recordType(t string) string {
+    return "Type" + strings.ToUpper(strings.TrimPrefix(t, "Type"))
+}
+
+// returns whether updates can add records of a type
+func updatable(t string) bool {
+    for _, u := range dns.UpdateTypes {
+        if u == t {
+            return true
+        }
+    }
+    return false
+}
+
+// returns the data key of the records updates can add
+func dataKey(t string) string {
+    switch t {
+    case "TypeA":
+        return "address"
+    case "TypeNS":
+        return "ns"
+    default:
+        return "ptr"
+    }
+}
+
+// check that a record is in the zone and its data can be sent in an update
+func checkRecord(rec *dns.Record, zone string) error {
+    name := strings.ToLower(rec.Name)
+    if _, err := dnsmessage.NewName(rec.Name); err != nil || !strings.HasSuffix(name, ".") {
+        return fmt.Errorf("%s is not a fully qualified name", rec.Name)
+    }
+    if name != strings.ToLower(zone) && !strings.HasSuffix(name, "." + strings.ToLower(zone)) {
+        return fmt.Errorf("%s is not in zone %s", rec.Name, zone)
+    }
+    if !updatable(rec.Type) {
+        return fmt.Errorf("%s records cannot be updated, supported types are A, NS and PTR", strings.TrimPrefix(rec.Type, "Type"))
+    }
+    data := fmt.Sprint(rec.Data[dataKey(rec.Type)])
+    if rec.Type == "TypeA" {
+        if ip := net.ParseIP(data); ip == nil || ip.To4() == nil {
+            return fmt.Errorf("%s is not an IPv4 address", data)
+        }
+        return nil
+    }
+    if _, err := dnsmessage.NewName(data); err != nil || !strings.HasSuffix(data, ".") {
+        return fmt.Errorf("%s is not a fully qualified name", data)
+    }
+    return nil
+}
+
+// returns the data of a record in zone file format
+func recordData(rec dns.Record) string {
+    switch rec.Type {
+    case "TypeSOA":
+        d := rec.Data
+        return fmt.Sprintf("%v %v %v %v %v %v %v", d["ns"], d["mBox"], d["serial"], d["refresh"], d["retry"], d["expire"], d["minTtl"])
+    case "TypeA", "TypeNS", "TypePTR":
+        return fmt.Sprint(rec.Data[dataKey(rec.Type)])
+    default:
+        if len(rec.Data) == 0 {
+            return "-"
+        }
+        data, _ := json.Marshal(rec.Data)
+        return string(data)
+    }
+}
+
+// returns a record as a zone file line
+func recordLine(rec dns.Record) string {
+    return fmt.Sprintf("%s\t%d\tIN\t%s\t%s", rec.Name, rec.TTL, strings.TrimPrefix(rec.Type, "Type"), recordData(rec))
+}
+
+// returns the rrset of a record, its name in lowercase and type
+func rrsetKey(rec dns.Record) string {
+    return strings.ToLower(rec.Name) + " " + rec.Type
+}
+
+// returns a key identifying a record by name, type, ttl and data
+func recordKey(rec dns.Record) string {
+    data, _ := json.Marshal(rec.Data)
+    return fmt.Sprintf("%s %d %s", rrsetKey(rec), rec.TTL, data)
+}
+
+// read records written by export
+func readRecords(file string) ([]dns.Record, error) {
+    data, err := os.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    var records []dns.Record
+    if err := json.Unmarshal(data, &records); err != nil {
+        return nil, fmt.Errorf("error parsing %s: %s", file, err)
+    }
+    return records, nil
+}
+
+// returns records without the soa, whose serial the server manages
+func withoutSOA(records []dns.Record) []dns.Record {
+    filtered := make([]dns.Record, 0, len(records))
+    seen := make(map[string]bool)
+    for _, rec := range records {
+        // zone transfers end with the soa again
+        if rec.Type == "TypeSOA" || seen[recordKey(rec)] {
+            continue
+        }
+        seen[recordKey(rec)] = true
+        filtered = append(filtered, rec)
+    }
+    return filtered
+}
+
+// run the api server
+func serveCommand(args []string) error {
+    flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+    config := flags.String("config", "", "config file, CONFIG_FILE by default")
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+    if *config != "" {
+        os.Setenv("CONFIG_FILE", *config)
+    }
+    return runServer()
+}
+
+// print the records of a zone, optionally only those of a name and type
+func getCommand(args []string) error {
+    flags := newDNSFlags("get")
+    asJSON := flags.Bool("json", false, "print records as json")
+    if err := flags.setup(args, 1, 3); err != nil {
+        return err
+    }
+    defer dnsClient.Close()
+    zone := qualifyZone(flags.Arg(0))
+    ctx, cancel := commandContext()
+    defer cancel()
+
+    records, jerr := zoneRecords(ctx, zone)
+    if jerr != nil {
+        return jsendError(jerr)
+    }
+    records = records[:len(records) - min(1, len(records))]     // the closing soa
+    if flags.NArg() > 1 {
+        name := strings.ToLower(qualifyName(flags.Arg(1), zone))
+        filtered := make([]dns.Record, 0)
+        for _, rec := range records {
+            if strings.ToLower(rec.Name) == name && (flags.NArg() < 3 || rec.Type == recordType(flags.Arg(2))) {
+                filtered = append(filtered, rec)
+            }
+        }
+        records = filtered
+    }
+
+    if *asJSON {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "    ")
+        return enc.Encode(records)
+    }
+    w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+    for _, rec := range records {
+        fmt.Fprintln(w, recordLine(rec))
+    }
+    return w.Flush()
+}
+
+// add a record, replacing its rrset unless -append is set
+func addCommand(args []string) error {
+    flags := newDNSFlags("add")
+    ttl := flags.Uint("ttl", 3600, "record ttl in seconds")
+    appendRecord := flags.Bool("append", false, "add to the rrset instead of replacing it")
+    if err := flags.setup(args, 4, 4); err != nil {
+        return err
+    }
+    if err := parseKeys(); err != nil {
+        return err
+    }
+    defer dnsClient.Close()
+    zone := qualifyZone(flags.Arg(0))
+    rec := dns.Record{
+        Name:   qualifyName(flags.Arg(1), zone),
+        Type:   recordType(flags.Arg(2)),
+        Class:  "ClassINET",
+        TTL:    uint32(*ttl),
+    }
+    rec.Data = map[string]interface{}{dataKey(rec.Type): flags.Arg(3)}
+    op := dns.OpAdd
+    if *appendRecord {
+        op = dns.OpAppend
+    }
+    return update(zone, op, rec)
+}
+
+// delete an rrset
+func deleteCommand(args []string) error {
+    flags := newDNSFlags("delete")
+    if err := flags.setup(args, 3, 3); err != nil {
+        return err
+    }
+    if err := parseKeys(); err != nil {
+        return err
+    }
+    defer dnsClient.Close()
+    zone := qualifyZone(flags.Arg(0))
+    rec := dns.Record{Name: qualifyName(flags.Arg(1), zone), Type: recordType(flags.Arg(2)), Class: "ClassINET"}
+
+    // other types would delete every record of the name
+    if !updatable(rec.Type) {
+        return fmt.Errorf("%s records cannot be deleted, supported types are A, NS and PTR", strings.TrimPrefix(rec.Type, "Type"))
+    }
+    return update(zone, dns.OpDelete, rec)
+}
+
+// check records and send them in one update
+func update(zone string, op dns.Op, records ...dns.Record) error {
+    update := make([]*dns.Record, len(records))
+    for i := range records {
+        if op != dns.OpDelete {
+            if err := checkRecord(&records[i], zone); err != nil {
+                return err
+            }
+        }
+        update[i] = &records[i]
+    }
+    ctx, cancel := commandContext()
+    defer cancel()
+    upstreams, jerr := upstreamsFor(ctx, zone)
+    if jerr != nil {
+        return jsendError(jerr)
+    }
+    jerr, _, err := sendUpdate(ctx, zone, op, update, upstreams)
+    if err != nil {
+        return err
+    }
+    if jerr != nil {
+        return jsendError(jerr)
+    }
+    return nil
+}
+
+// write the records of a zone as json, the format of import, diff and the api
+func exportCommand(args []string) error {
+    flags := newDNSFlags("export")
+    output := flags.String("o", "", "output file, stdout by default")
+    if err := flags.setup(args, 1, 1); err != nil {
+        return err
+    }
+    defer dnsClient.Close()
+    ctx, cancel := commandContext()
+    defer cancel()
+
+    records, jerr := zoneRecords(ctx, qualifyZone(flags.Arg(0)))
+    if jerr != nil {
+        return jsendError(jerr)
+    }
+    records = withoutSOA(records)
+    var w io.Writer = os.Stdout
+    if *output != "" {
+        f, err := os.Create(*output)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        w = f
+    }
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "    ")
+    return enc.Encode(records)
+}
+
+// returns the records only in a and only in b, ignoring the soa
+func compareRecords(a []dns.Record, b []dns.Record) ([]dns.Record, []dns.Record) {
+    a, b = withoutSOA(a), withoutSOA(b)
+    inA, inB := make(map[string]bool), make(map[string]bool)
+    for _, rec := range a {
+        inA[recordKey(rec)] = true
+    }
+    for _, rec := range b {
+        inB[recordKey(rec)] = true
+    }
+    var onlyA, onlyB []dns.Record
+    for _, rec := range a {
+        if !inB[recordKey(rec)] {
+            onlyA = append(onlyA, rec)
+        }
+    }
+    for _, rec := range b {
+        if !inA[recordKey(rec)] {
+            onlyB = append(onlyB, rec)
+        }
+    }
+    return onlyA, onlyB
+}
+
+// print the records only in the zone with "-" and only in the file with "+"
+func diffCommand(args []string) error {
+    flags := newDNSFlags("diff")
+    if err := flags.setup(args, 2, 2); err != nil {
+        return err
+    }
+    defer dnsClient.Close()
+    zone := qualifyZone(flags.Arg(0))
+    want, err := readRecords(flags.Arg(1))
+    if err != nil {
+        return err
+    }
+    ctx, cancel := commandContext()
+    defer cancel()
+    have, jerr := zoneRecords(ctx, zone)
+    if jerr != nil {
+        return jsendError(jerr)
+    }
+
+    removed, added := compareRecords(have, want)
+    lines := make([]string, 0, len(removed) + len(added))
+    for _, rec := range removed {
+        lines = append(lines, "- " + recordLine(rec))
+    }
+    for _, rec := range added {
+        lines = append(lines, "+ " + recordLine(rec))
+    }
+    sort.SliceStable(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+    for _, line := range lines {
+        fmt.Println(line)
+    }
+    if len(lines) > 0 {
+        return errZoneDiffers
+    }
+    return nil
+}
+
+// change a zone to match an exported file. rrsets of types updates support
+// are replaced or deleted, the zone apex ns and other types are only reported.
+func importCommand(args []string) error {
+    flags := newDNSFlags("import")
+    dryRun := flags.Bool("dry-run", false, "print the changes without making them")
+    if err := flags.setup(args, 2, 2); err != nil {
+        return err
+    }
+    if !*dryRun {
+        if err := parseKeys(); err != nil {
+            return err
+        }
+    }
+    defer dnsClient.Close()
+    zone := qualifyZone(flags.Arg(0))
+    want, err := readRecords(flags.Arg(1))
+    if err != nil {
+        return err
+    }
+    ctx, cancel := commandContext()
+    defer cancel()
+    have, jerr := zoneRecords(ctx, zone)
+    if jerr != nil {
+        return jsendError(jerr)
+    }
+
+    // group the differing records into rrsets
+    removed, added := compareRecords(have, want)
+    changed := make(map[string]bool)
+    for _, rec := range append(removed, added...) {
+        if !updatable(rec.Type) || (rec.Type == "TypeNS" && strings.EqualFold(rec.Name, zone)) {
+            slog.Warn("skipping record, it cannot be changed by import", "record", recordLine(rec))
+            continue
+        }
+        changed[rrsetKey(rec)] = true
+    }
+    rrsets := make(map[string][]dns.Record)
+    for _, rec := range withoutSOA(want) {
+        if changed[rrsetKey(rec)] {
+            if err := checkRecord(&rec, zone); err != nil {
+                return err
+            }
+            rrsets[rrsetKey(rec)] = append(rrsets[rrsetKey(rec)], rec)
+        }
+    }
+    keys := make([]string, 0, len(changed))
+    for key := range changed {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    // replace each rrset, or delete it when the file has none, with one
+    // update so resolvers never see part of an rrset
+    for _, key := range keys {
+        records := rrsets[key]
+        if len(records) == 0 {
+            name, t, _ := strings.Cut(key, " ")
+            rec := dns.Record{Name: name, Type: t, Class: "ClassINET"}
+            fmt.Printf("delete %s %s\n", name, strings.TrimPrefix(t, "Type"))
+            if !*dryRun {
+                if err := update(zone, dns.OpDelete, rec); err != nil {
+                    return err
+                }
+            }
+            continue
+        }
+        for _, rec := range records {
+            fmt.Printf("replace %s\n", recordLine(rec))
+        }
+        if !*dryRun {
+            if err := update(zone, dns.OpAdd, records...); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,717 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "log/slog"
+    "os"
+    "os/signal"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+    "github.com/samchelini/dns-manager/dns"
+    "github.com/samchelini/dns-manager/ratelimit"
+)
+
+// config file, every setting maps to an env var which overrides it
+type Config struct {
+    Listen      ListenConfig            `json:"listen"`
+    Upstreams   UpstreamsConfig         `json:"upstreams"`
+    Zones       map[string]ZoneConfig   `json:"zones"`             // by zone name, "*" sets the quota of every other zone
+    Keys        KeysConfig              `json:"keys"`
+    Auth        AuthConfig              `json:"auth"`
+    Limits      LimitsConfig            `json:"limits"`
+    Caching     CachingConfig           `json:"caching"`
+    Logging     LoggingConfig           `json:"logging"`
+}
+
+// http listener
+type ListenConfig struct {
+    Port                *int            `json:"port"`
+    TLS                 ListenTLSConfig `json:"tls"`
+    ReadHeaderTimeout   string          `json:"readHeaderTimeout"`
+    ReadTimeout         string          `json:"readTimeout"`
+    WriteTimeout        string          `json:"writeTimeout"`
+    IdleTimeout         string          `json:"idleTimeout"`
+    ShutdownTimeout     string          `json:"shutdownTimeout"`
+    MaxBodyBytes        int64           `json:"maxBodyBytes"`
+    MaxHeaderBytes      int             `json:"maxHeaderBytes"`
+}
+
+// https and client certificates
+type ListenTLSConfig struct {
+    CertFile        string              `json:"certFile"`
+    KeyFile         string              `json:"keyFile"`
+    MinVersion      string              `json:"minVersion"`
+    ClientCAFile    string              `json:"clientCaFile"`
+    ClientAuth      string              `json:"clientAuth"`
+    ClientRoleMap   map[string][]string `json:"clientRoleMap"`
+}
+
+// dns servers and the client used to reach them
+type UpstreamsConfig struct {
+    Servers         []string            `json:"servers"`
+    Resolver        string              `json:"resolver"`
+    DialTimeout     string              `json:"dialTimeout"`
+    ReadTimeout     string              `json:"readTimeout"`
+    Timeout         string              `json:"timeout"`
+    IdleTimeout     string              `json:"idleTimeout"`
+    MaxConns        *int                `json:"maxConns"`
+    TLS             UpstreamTLSConfig   `json:"tls"`
+    DoHMethod       string              `json:"dohMethod"`
+    EDNS            EDNSConfig          `json:"edns"`
+    ReadyTimeout    string              `json:"readyTimeout"`
+}
+
+// dns over tls, https and quic
+type UpstreamTLSConfig struct {
+    CAFile      string      `json:"caFile"`
+    CertFile    string      `json:"certFile"`
+    KeyFile     string      `json:"keyFile"`
+    SPKIPins    []string    `json:"spkiPins"`
+}
+
+// edns options sent with queries
+type EDNSConfig struct {
+    Enabled     *bool   `json:"enabled"`
+    UDPSize     *int    `json:"udpSize"`
+    Padding     *int    `json:"padding"`
+    DNSSECOK    *bool   `json:"dnssecOk"`
+    Cookie      *bool   `json:"cookie"`
+}
+
+// settings of one zone
+type ZoneConfig struct {
+    Servers             []string    `json:"servers"`
+    DailyChangeQuota    *int        `json:"dailyChangeQuota"`
+}
+
+// update signing keys
+type KeysConfig struct {
+    TSIGFile            string  `json:"tsigFile"`
+    TSIGReloadInterval  string  `json:"tsigReloadInterval"`
+    Sig0KeyFile         string  `json:"sig0KeyFile"`
+    Sig0KeyName         string  `json:"sig0KeyName"`
+}
+
+// api authentication and authorization
+type AuthConfig struct {
+    TokensFile  string      `json:"tokensFile"`
+    PolicyFile  string      `json:"policyFile"`
+    JWT         JWTConfig   `json:"jwt"`
+}
+
+// oidc jwts
+type JWTConfig struct {
+    JWKS        string              `json:"jwks"`
+    Issuer      string              `json:"issuer"`
+    Audience    string              `json:"audience"`
+    RolesClaim  string              `json:"rolesClaim"`
+    RoleMap     map[string][]string `json:"roleMap"`
+}
+
+// per caller rate limits
+type LimitsConfig struct {
+    Reads   string  `json:"reads"`
+    Writes  string  `json:"writes"`
+}
+
+// how long fetched and computed results are reused
+type CachingConfig struct {
+    JWKSTTL     string  `json:"jwksTtl"`
+    ReadyTTL    string  `json:"readyTtl"`
+}
+
+// log level and format
+type LoggingConfig struct {
+    Level   string  `json:"level"`
+    Format  string  `json:"format"`
+}
+
+// env vars that take effect on reload, changes to the rest need a restart
+var reloadableEnv = map[string]bool{
+    "LOG_LEVEL":                true,
+    "LOG_FORMAT":               true,
+    "DNS_SERVER":               true,
+    "DNS_RESOLVER":             true,
+    "DNS_ZONE_SERVERS":         true,
+    "READY_ZONES":              true,
+    "METRIC_ZONES":             true,
+    "AUTH_TOKENS_FILE":         true,
+    "AUTH_POLICY_FILE":         true,
+    "AUTH_JWT_JWKS":            true,
+    "AUTH_JWT_ISSUER":          true,
+    "AUTH_JWT_AUDIENCE":        true,
+    "AUTH_JWT_ROLES_CLAIM":     true,
+    "AUTH_JWT_ROLE_MAP":        true,
+    "AUTH_JWT_JWKS_TTL":        true,
+    "RATE_LIMIT_READS":         true,
+    "RATE_LIMIT_WRITES":        true,
+    "ZONE_DAILY_CHANGE_QUOTA":  true,
+}
+
+// load a config file, rejecting unknown fields and invalid values
+func loadConfig(file string) (*Config, error) {
+    data, err := os.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    var config Config
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&config); err != nil {
+        return nil, decodeError(file, data, dec.InputOffset(), err)
+    }
+    if dec.More() {
+        line, col := position(data, dec.InputOffset())
+        return nil, fmt.Errorf("%s:%d:%d: unexpected data after the config object", file, line, col)
+    }
+    if err := config.Validate(); err != nil {
+        return nil, fmt.Errorf("%s: %w", file, err)
+    }
+    return &config, nil
+}
+
+// describe a decoding error by its position and, for unknown fields and
+// values of the wrong type, by its path in the config
+func decodeError(file string, data []byte, offset int64, err error) error {
+    message := strings.TrimPrefix(err.Error(), "json: ")
+    var syntaxErr *json.SyntaxError
+    var typeErr *json.UnmarshalTypeError
+    switch {
+    case errors.As(err, &syntaxErr):
+        offset = syntaxErr.Offset
+    case errors.Is(err, io.ErrUnexpectedEOF):
+        offset = int64(len(data))
+    case errors.As(err, &typeErr):
+        w := &configWalker{data: data, stop: typeErr.Offset}
+        if w.walk(); w.found {
+            offset, message = w.offset, fmt.Sprintf("%s: must be %s, got %s", w.path, jsonKind(typeErr.Type), typeErr.Value)
+        }
+    case strings.HasPrefix(message, "unknown field "):
+        w := &configWalker{data: data, stop: -1}
+        if w.walk(); w.found {
+            offset, message = w.offset, fmt.Sprintf("%s: unknown field", w.path)
+        }
+    }
+    line, col := position(data, offset)
+    return fmt.Errorf("%s:%d:%d: %s", file, line, col, message)
+}
+
+// walks a config file alongside the Config type to find the path of the
+// first unknown field, or of the innermost value holding the offset stop.
+// paths are written like Validate writes them, e.g. zones["example.com."].servers[0]
+type configWalker struct {
+    data    []byte
+    dec     *json.Decoder
+    stop    int64   // offset of the value to find, -1 to find an unknown field
+    found   bool
+    path    string
+    offset  int64   // offset of the value or unknown field found
+}
+
+var anyType = reflect.TypeOf((*any)(nil)).Elem()
+
+// walk the whole config
+func (w *configWalker) walk() {
+    w.dec = json.NewDecoder(bytes.NewReader(w.data))
+    w.value(reflect.TypeOf(Config{}), "")
+    if w.found && w.path == "" {
+        w.path = "config"
+    }
+}
+
+// read the next value of type t at path
+func (w *configWalker) value(t reflect.Type, path string) error {
+    for t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    start := w.dec.InputOffset()
+    token, err := w.dec.Token()
+    if err != nil {
+        return err
+    }
+    switch token {
+    case json.Delim('{'):
+        for w.dec.More() && !w.found {
+            token, err := w.dec.Token()
+            if err != nil {
+                return err
+            }
+            key := token.(string)
+            child, childPath := anyType, fmt.Sprintf("%s[%q]", path, key)
+            switch t.Kind() {
+            case reflect.Struct:
+                childPath = strings.TrimPrefix(path + "." + key, ".")
+                field, ok := jsonField(t, key)
+                if !ok && w.stop < 0 {
+                    keyEnd := w.dec.InputOffset()
+                    w.found, w.path, w.offset = true, childPath, int64(bytes.LastIndexByte(w.data[:keyEnd - 1], '"'))
+                    return nil
+                }
+                if ok {
+                    child = field.Type
+                }
+            case reflect.Map:
+                child = t.Elem()
+            }
+            if err := w.value(child, childPath); err != nil {
+                return err
+            }
+        }
+    case json.Delim('['):
+        for i := 0; w.dec.More() && !w.found; i++ {
+            child := anyType
+            if t.Kind() == reflect.Slice {
+                child = t.Elem()
+            }
+            if err := w.value(child, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+                return err
+            }
+        }
+    }
+    if w.found {
+        return nil
+    }
+
+    // read the closing delimiter, then check whether the value holds stop
+    if _, ok := token.(json.Delim); ok {
+        if _, err := w.dec.Token(); err != nil {
+            return err
+        }
+    }
+    if start < w.stop && w.stop <= w.dec.InputOffset() {
+        for start < w.stop && bytes.IndexByte([]byte(" \t\r\n:,"), w.data[start]) >= 0 {
+            start++
+        }
+        w.found, w.path, w.offset = true, path, start
+    }
+    return nil
+}
+
+// returns the struct field decoded from key, matched like encoding/json
+// matches it: the exact name first, then without regard to case
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+    var folded *reflect.StructField
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+        if name == key {
+            return field, true
+        }
+        if folded == nil && strings.EqualFold(name, key) {
+            folded = &field
+        }
+    }
+    if folded != nil {
+        return *folded, true
+    }
+    return reflect.StructField{}, false
+}
+
+// returns the json kind of value a go type is decoded from
+func jsonKind(t reflect.Type) string {
+    for t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    switch t.Kind() {
+    case reflect.Bool:
+        return "a boolean"
+    case reflect.String:
+        return "a string"
+    case reflect.Slice, reflect.Array:
+        return "an array"
+    case reflect.Struct, reflect.Map:
+        return "an object"
+    case reflect.Float32, reflect.Float64:
+        return "a number"
+    }
+    return "an integer"
+}
+
+// returns the line and column of an offset in data
+func position(data []byte, offset int64) (int, int) {
+    offset = min(offset, int64(len(data)))
+    before := data[:offset]
+    line := bytes.Count(before, []byte("\n")) + 1
+    return line, int(offset) - bytes.LastIndexByte(before, '\n')
+}
+
+// check every value, returning all problems by their path in the file
+func (c *Config) Validate() error {
+    var problems []string
+    invalid := func(path string, format string, args ...any) {
+        problems = append(problems, path + ": " + fmt.Sprintf(format, args...))
+    }
+    durations := map[string]string{
+        "listen.readHeaderTimeout":    c.Listen.ReadHeaderTimeout,
+        "listen.readTimeout":          c.Listen.ReadTimeout,
+        "listen.writeTimeout":         c.Listen.WriteTimeout,
+        "listen.idleTimeout":          c.Listen.IdleTimeout,
+        "listen.shutdownTimeout":      c.Listen.ShutdownTimeout,
+        "upstreams.dialTimeout":       c.Upstreams.DialTimeout,
+        "upstreams.readTimeout":       c.Upstreams.ReadTimeout,
+        "upstreams.timeout":           c.Upstreams.Timeout,
+        "upstreams.idleTimeout":       c.Upstreams.IdleTimeout,
+        "upstreams.readyTimeout":      c.Upstreams.ReadyTimeout,
+        "keys.tsigReloadInterval":     c.Keys.TSIGReloadInterval,
+        "caching.jwksTtl":             c.Caching.JWKSTTL,
+        "caching.readyTtl":            c.Caching.ReadyTTL,
+    }
+    for path, value := range durations {
+        if value == "" {
+            continue
+        }
+        if d, err := time.ParseDuration(value); err != nil || d < 0 {
+            invalid(path, "must be a duration such as \"30s\" or \"5m\", got %q", value)
+        }
+    }
+
+    // listener
+    if c.Listen.Port != nil && (*c.Listen.Port < 1 || *c.Listen.Port > 65535) {
+        invalid("listen.port", "must be between 1 and 65535, got %d", *c.Listen.Port)
+    }
+    if c.Listen.MaxBodyBytes < 0 {
+        invalid("listen.maxBodyBytes", "must be positive, got %d", c.Listen.MaxBodyBytes)
+    }
+    if c.Listen.MaxHeaderBytes < 0 {
+        invalid("listen.maxHeaderBytes", "must be positive, got %d", c.Listen.MaxHeaderBytes)
+    }
+    listenTLS := c.Listen.TLS
+    if (listenTLS.CertFile == "") != (listenTLS.KeyFile == "") {
+        invalid("listen.tls", "certFile and keyFile must be set together")
+    }
+    if _, ok := tlsVersions[listenTLS.MinVersion]; listenTLS.MinVersion != "" && !ok {
+        invalid("listen.tls.minVersion", "must be \"1.2\" or \"1.3\", got %q", listenTLS.MinVersion)
+    }
+    if listenTLS.ClientAuth != "" && listenTLS.ClientAuth != "require" && listenTLS.ClientAuth != "optional" {
+        invalid("listen.tls.clientAuth", "must be \"require\" or \"optional\", got %q", listenTLS.ClientAuth)
+    }
+    if listenTLS.ClientAuth != "" && listenTLS.ClientCAFile == "" {
+        invalid("listen.tls.clientAuth", "requires clientCaFile")
+    }
+    if len(listenTLS.ClientRoleMap) > 0 && listenTLS.ClientCAFile == "" {
+        invalid("listen.tls.clientRoleMap", "requires clientCaFile")
+    }
+    for unit, roles := range listenTLS.ClientRoleMap {
+        if strings.TrimSpace(unit) == "" || strings.ContainsAny(unit, "=;,") || len(roles) == 0 {
+            invalid(fmt.Sprintf("listen.tls.clientRoleMap[%q]", unit), "must map an organizational unit to one or more roles")
+        }
+    }
+    if (listenTLS.ClientCAFile != "" || listenTLS.MinVersion != "") && listenTLS.CertFile == "" {
+        invalid("listen.tls", "certFile and keyFile are required with other tls settings")
+    }
+
+    // upstreams
+    u := c.Upstreams
+    for i, server := range u.Servers {
+        if strings.TrimSpace(server) == "" {
+            invalid(fmt.Sprintf("upstreams.servers[%d]", i), "must not be empty")
+        }
+    }
+    if u.MaxConns != nil && *u.MaxConns < 0 {
+        invalid("upstreams.maxConns", "must not be negative, got %d", *u.MaxConns)
+    }
+    if m := strings.ToUpper(u.DoHMethod); m != "" && m != "GET" && m != "POST" {
+        invalid("upstreams.dohMethod", "must be \"GET\" or \"POST\", got %q", u.DoHMethod)
+    }
+    if (u.TLS.CertFile == "") != (u.TLS.KeyFile == "") {
+        invalid("upstreams.tls", "certFile and keyFile must be set together")
+    }
+    if u.EDNS.UDPSize != nil && (*u.EDNS.UDPSize < 512 || *u.EDNS.UDPSize > 65535) {
+        invalid("upstreams.edns.udpSize", "must be between 512 and 65535, got %d", *u.EDNS.UDPSize)
+    }
+    if u.EDNS.Padding != nil && *u.EDNS.Padding < 0 {
+        invalid("upstreams.edns.padding", "must not be negative, got %d", *u.EDNS.Padding)
+    }
+
+    // zones
+    for zone, z := range c.Zones {
+        path := fmt.Sprintf("zones[%q]", zone)
+        if strings.TrimSpace(zone) == "" || strings.ContainsAny(zone, "=;,") {
+            invalid(path, "is not a zone name")
+        }
+        if zone == "*" && len(z.Servers) > 0 {
+            invalid(path + ".servers", "can only be set for a named zone, use upstreams.servers for every zone")
+        }
+        for i, server := range z.Servers {
+            if strings.TrimSpace(server) == "" || strings.ContainsAny(server, ";,") {
+                invalid(fmt.Sprintf("%s.servers[%d]", path, i), "is not a server address, got %q", server)
+            }
+        }
+        if z.DailyChangeQuota != nil && *z.DailyChangeQuota < 0 {
+            invalid(path + ".dailyChangeQuota", "must not be negative, got %d", *z.DailyChangeQuota)
+        }
+    }
+
+    // keys
+    if c.Keys.TSIGFile != "" && c.Keys.Sig0KeyFile != "" {
+        invalid("keys", "set tsigFile or sig0KeyFile, not both")
+    }
+    if (c.Keys.Sig0KeyFile == "") != (c.Keys.Sig0KeyName == "") {
+        invalid("keys", "sig0KeyFile and sig0KeyName must be set together")
+    }
+    if c.Keys.Sig0KeyFile != "" {
+        for i, server := range u.Servers {
+            if dns.IsQUIC(server) {
+                invalid(fmt.Sprintf("upstreams.servers[%d]", i), "cannot be a quic:// server with sig0KeyFile, quic sends message id 0 which sig(0) signs")
+            }
+        }
+        for zone, z := range c.Zones {
+            for i, server := range z.Servers {
+                if dns.IsQUIC(server) {
+                    invalid(fmt.Sprintf("zones[%q].servers[%d]", zone, i), "cannot be a quic:// server with sig0KeyFile, quic sends message id 0 which sig(0) signs")
+                }
+            }
+        }
+    }
+
+    // auth
+    jwt := c.Auth.JWT
+    if jwt.JWKS != "" && (jwt.Issuer == "" || jwt.Audience == "") {
+        invalid("auth.jwt", "issuer and audience are required with jwks")
+    }
+    if jwt.JWKS == "" && (jwt.Issuer != "" || jwt.Audience != "" || jwt.RolesClaim != "" || len(jwt.RoleMap) > 0) {
+        invalid("auth.jwt.jwks", "is required with other jwt settings")
+    }
+    for group, roles := range jwt.RoleMap {
+        if strings.TrimSpace(group) == "" || strings.ContainsAny(group, "=;,") || len(roles) == 0 {
+            invalid(fmt.Sprintf("auth.jwt.roleMap[%q]", group), "must map a group to one or more roles")
+        }
+    }
+
+    // limits
+    if c.Limits.Reads != "" {
+        if _, err := ratelimit.ParseLimit(c.Limits.Reads); err != nil {
+            invalid("limits.reads", "%s", err)
+        }
+    }
+    if c.Limits.Writes != "" {
+        if _, err := ratelimit.ParseLimit(c.Limits.Writes); err != nil {
+            invalid("limits.writes", "%s", err)
+        }
+    }
+
+    // logging
+    var level slog.Level
+    if c.Logging.Level != "" && level.UnmarshalText([]byte(c.Logging.Level)) != nil {
+        invalid("logging.level", "must be \"debug\", \"info\", \"warn\" or \"error\", got %q", c.Logging.Level)
+    }
+    if f := c.Logging.Format; f != "" && f != "json" && f != "text" {
+        invalid("logging.format", "must be \"json\" or \"text\", got %q", f)
+    }
+
+    // sorted so the same file always gives the same message
+    if len(problems) == 0 {
+        return nil
+    }
+    sort.Strings(problems)
+    return errors.New(strings.Join(problems, "; "))
+}
+
+// returns the env vars the config sets
+func (c *Config) Env() map[string]string {
+    env := make(map[string]string)
+    set := func(name string, value string) {
+        if value != "" {
+            env[name] = value
+        }
+    }
+    setInt := func(name string, value *int) {
+        if value != nil {
+            env[name] = strconv.Itoa(*value)
+        }
+    }
+    setBool := func(name string, value *bool) {
+        if value != nil {
+            env[name] = strconv.FormatBool(*value)
+        }
+    }
+
+    // listener
+    setInt("PORT", c.Listen.Port)
+    set("TLS_CERT_FILE", c.Listen.TLS.CertFile)
+    set("TLS_KEY_FILE", c.Listen.TLS.KeyFile)
+    set("TLS_MIN_VERSION", c.Listen.TLS.MinVersion)
+    set("TLS_CLIENT_CA_FILE", c.Listen.TLS.ClientCAFile)
+    set("TLS_CLIENT_AUTH", c.Listen.TLS.ClientAuth)
+    set("TLS_CLIENT_ROLE_MAP", formatRoleMap(c.Listen.TLS.ClientRoleMap))
+    set("HTTP_READ_HEADER_TIMEOUT", c.Listen.ReadHeaderTimeout)
+    set("HTTP_READ_TIMEOUT", c.Listen.ReadTimeout)
+    set("HTTP_WRITE_TIMEOUT", c.Listen.WriteTimeout)
+    set("HTTP_IDLE_TIMEOUT", c.Listen.IdleTimeout)
+    set("SHUTDOWN_TIMEOUT", c.Listen.ShutdownTimeout)
+    if c.Listen.MaxBodyBytes != 0 {
+        set("HTTP_MAX_BODY_BYTES", strconv.FormatInt(c.Listen.MaxBodyBytes, 10))
+    }
+    if c.Listen.MaxHeaderBytes != 0 {
+        set("HTTP_MAX_HEADER_BYTES", strconv.Itoa(c.Listen.MaxHeaderBytes))
+    }
+
+    // upstreams
+    u := c.Upstreams
+    set("DNS_SERVER", strings.Join(u.Servers, ","))
+    set("DNS_RESOLVER", u.Resolver)
+    set("DNS_DIAL_TIMEOUT", u.DialTimeout)
+    set("DNS_READ_TIMEOUT", u.ReadTimeout)
+    set("DNS_TIMEOUT", u.Timeout)
+    set("DNS_IDLE_TIMEOUT", u.IdleTimeout)
+    setInt("DNS_MAX_CONNS", u.MaxConns)
+    set("DNS_TLS_CA_FILE", u.TLS.CAFile)
+    set("DNS_TLS_CERT_FILE", u.TLS.CertFile)
+    set("DNS_TLS_KEY_FILE", u.TLS.KeyFile)
+    set("DNS_TLS_SPKI_PINS", strings.Join(u.TLS.SPKIPins, ","))
+    set("DNS_DOH_METHOD", u.DoHMethod)
+    setBool("DNS_EDNS", u.EDNS.Enabled)
+    setInt("DNS_EDNS_UDP_SIZE", u.EDNS.UDPSize)
+    setInt("DNS_EDNS_PADDING", u.EDNS.Padding)
+    setBool("DNS_EDNS_DNSSEC_OK", u.EDNS.DNSSECOK)
+    setBool("DNS_EDNS_COOKIE", u.EDNS.Cookie)
+    set("READY_TIMEOUT", u.ReadyTimeout)
+
+    // zones, sorted so reloads only see real changes
+    zones := make([]string, 0, len(c.Zones))
+    for zone := range c.Zones {
+        zones = append(zones, zone)
+    }
+    sort.Strings(zones)
+    var servers, quotas, ready []string
+    for _, zone := range zones {
+        z := c.Zones[zone]
+        if len(z.Servers) > 0 {
+            servers = append(servers, zone + "=" + strings.Join(z.Servers, ","))
+        }
+        if z.DailyChangeQuota != nil {
+            quotas = append(quotas, zone + "=" + strconv.Itoa(*z.DailyChangeQuota))
+        }
+        if zone != "*" {
+            ready = append(ready, zone)
+        }
+    }
+    set("DNS_ZONE_SERVERS", strings.Join(servers, ";"))
+    set("ZONE_DAILY_CHANGE_QUOTA", strings.Join(quotas, ";"))
+    set("READY_ZONES", strings.Join(ready, ","))
+    set("METRIC_ZONES", strings.Join(ready, ","))
+
+    // keys
+    set("TSIG_FILE", c.Keys.TSIGFile)
+    set("TSIG_RELOAD_INTERVAL", c.Keys.TSIGReloadInterval)
+    set("SIG0_KEY_FILE", c.Keys.Sig0KeyFile)
+    set("SIG0_KEY_NAME", c.Keys.Sig0KeyName)
+
+    // auth
+    set("AUTH_TOKENS_FILE", c.Auth.TokensFile)
+    set("AUTH_POLICY_FILE", c.Auth.PolicyFile)
+    set("AUTH_JWT_JWKS", c.Auth.JWT.JWKS)
+    set("AUTH_JWT_ISSUER", c.Auth.JWT.Issuer)
+    set("AUTH_JWT_AUDIENCE", c.Auth.JWT.Audience)
+    set("AUTH_JWT_ROLES_CLAIM", c.Auth.JWT.RolesClaim)
+    set("AUTH_JWT_ROLE_MAP", formatRoleMap(c.Auth.JWT.RoleMap))
+
+    // limits, caching and logging
+    set("RATE_LIMIT_READS", c.Limits.Reads)
+    set("RATE_LIMIT_WRITES", c.Limits.Writes)
+    set("AUTH_JWT_JWKS_TTL", c.Caching.JWKSTTL)
+    set("READY_CACHE_TTL", c.Caching.ReadyTTL)
+    set("LOG_LEVEL", c.Logging.Level)
+    set("LOG_FORMAT", c.Logging.Format)
+    return env
+}
+
+// format role mappings in the "group=role,role;group=role" env format,
+// sorted so reloads only see real changes
+func formatRoleMap(roleMap map[string][]string) string {
+    groups := make([]string, 0, len(roleMap))
+    for group := range roleMap {
+        groups = append(groups, group)
+    }
+    sort.Strings(groups)
+    entries := make([]string, len(groups))
+    for i, group := range groups {
+        entries[i] = group + "=" + strings.Join(roleMap[group], ",")
+    }
+    return strings.Join(entries, ";")
+}
+
+// env vars set from the config file, every other env var overrides the file
+var configEnv = make(map[string]string)
+
+// set the config env vars, leaving env vars from the environment alone and
+// clearing config env vars the new config no longer sets
+func applyConfigEnv(env map[string]string) {
+    applied := make(map[string]string)
+    for name, value := range env {
+        if _, fromConfig := configEnv[name]; !fromConfig {
+            if _, set := os.LookupEnv(name); set {
+                continue
+            }
+        }
+        os.Setenv(name, value)
+        applied[name] = value
+    }
+    for name := range configEnv {
+        if _, ok := applied[name]; !ok {
+            os.Unsetenv(name)
+        }
+    }
+    configEnv = applied
+}
+
+// reload the config file on SIGHUP
+func watchConfigFile(file string) {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    for range hup {
+        if err := reloadConfig(file); err != nil {
+            log.Printf("error reloading config, keeping the current settings: %s", err)
+        }
+    }
+}
+
+// reload the config file and replace the reloadable settings. if the new
+// config is invalid the current env vars and settings are kept. requests in
+// flight finish with the settings they started with.
+func reloadConfig(file string) error {
+    config, err := loadConfig(file)
+    if err != nil {
+        return err
+    }
+    previous := configEnv
+    before := make(map[string]string)
+    for name := range config.Env() {
+        before[name] = os.Getenv(name)
+    }
+    for name := range previous {
+        before[name] = os.Getenv(name)
+    }
+
+    applyConfigEnv(config.Env())
+    if err := setupLogging(); err == nil {
+        var s *settings
+        s, err = parseSettings(current())
+        if err == nil {
+            live.Store(s)
+            dns.SetMetricZones(metricZones())
+        }
+    }
+    if err != nil {
+        applyConfigEnv(previous)
+        setupLogging()
+        return err
+    }
+
+    for name, value := range before {
+        if os.Getenv(name) != value && !reloadableEnv[name] {
+            log.Printf("%s changed in %s, restart to apply it", name, file)
+        }
+    }
+    log.Printf("reloaded config from %s", file)
+    return nil
+}
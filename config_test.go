@@ -0,0 +1,96 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestLoadConfigStrict(t *testing.T) {
+    tests := []struct {
+        name    string
+        data    string
+        err     string
+    }{
+        {name: "valid", data: `{"listen": {"port": 8443}, "upstreams": {"servers": ["192.0.2.1:53"]}, "zones": {"example.com.": {"dailyChangeQuota": 10}}}`},
+        {name: "unknown top level field", data: `{"listn": {}}`, err: "config.json:1:2: listn: unknown field"},
+        {name: "unknown nested field", data: "{\n  \"listen\": {\n    \"tls\": {\"certfile\": \"a\", \"cert\": \"b\"}\n  }\n}", err: "config.json:3:30: listen.tls.cert: unknown field"},
+        {name: "unknown field in a map value", data: `{"zones": {"example.com.": {"quota": 5}}}`, err: `config.json:1:29: zones["example.com."].quota: unknown field`},
+        {name: "string for an integer", data: `{"listen": {"port": "8443"}}`, err: "config.json:1:21: listen.port: must be an integer, got string"},
+        {name: "fraction for an integer", data: `{"zones": {"example.com.": {"dailyChangeQuota": 1.5}}}`, err: `config.json:1:49: zones["example.com."].dailyChangeQuota: must be an integer, got number 1.5`},
+        {name: "number in a string list", data: `{"upstreams": {"servers": ["192.0.2.1:53", 53]}}`, err: "config.json:1:44: upstreams.servers[1]: must be a string, got number"},
+        {name: "string for an object", data: `{"auth": {"jwt": "https://example.com"}}`, err: "config.json:1:18: auth.jwt: must be an object, got string"},
+        {name: "string for a boolean", data: `{"upstreams": {"edns": {"cookie": "yes"}}}`, err: "config.json:1:35: upstreams.edns.cookie: must be a boolean, got string"},
+        {name: "array for the config", data: `[]`, err: "config.json:1:1: config: must be an object, got array"},
+        {name: "trailing data", data: `{} {}`, err: "config.json:1:4: unexpected data after the config object"},
+        {name: "truncated", data: `{"listen": {`, err: "config.json:1:13: unexpected EOF"},
+        {name: "port zero", data: `{"listen": {"port": 0}}`, err: "config.json: listen.port: must be between 1 and 65535, got 0"},
+        {name: "port too large", data: `{"listen": {"port": 65536}}`, err: "config.json: listen.port: must be between 1 and 65535, got 65536"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            file := filepath.Join(t.TempDir(), "config.json")
+            if err := os.WriteFile(file, []byte(tt.data), 0600); err != nil {
+                t.Fatal(err)
+            }
+            _, err := loadConfig(file)
+            if tt.err == "" {
+                if err != nil {
+                    t.Fatal(err)
+                }
+                return
+            }
+            if err == nil {
+                t.Fatalf("got no error, want %q", tt.err)
+            }
+            if got := strings.TrimPrefix(err.Error(), filepath.Dir(file) + string(filepath.Separator)); !strings.HasPrefix(got, tt.err) {
+                t.Fatalf("got error %q, want %q", got, tt.err)
+            }
+        })
+    }
+}
+
+func TestParseSettingsKeepsJWTVerifier(t *testing.T) {
+    t.Setenv("DNS_SERVER", "192.0.2.1:53")
+    t.Setenv("AUTH_JWT_JWKS", filepath.Join(t.TempDir(), "jwks.json"))
+    t.Setenv("AUTH_JWT_ISSUER", "https://issuer.example.com")
+    t.Setenv("AUTH_JWT_AUDIENCE", "dns-manager")
+
+    first, err := parseSettings(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if first.jwtVerifier == nil {
+        t.Fatal("got no jwt verifier")
+    }
+
+    // an unchanged reload keeps the verifier and its cached keys
+    second, err := parseSettings(first)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if second.jwtVerifier != first.jwtVerifier {
+        t.Fatal("unchanged jwt settings built a new verifier")
+    }
+
+    // any changed jwt setting builds a new one
+    t.Setenv("AUTH_JWT_ROLE_MAP", "ops=admin")
+    third, err := parseSettings(second)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if third.jwtVerifier == second.jwtVerifier || third.jwtVerifier.RoleMap["ops"][0] != "admin" {
+        t.Fatalf("changed jwt settings kept the verifier %+v", third.jwtVerifier)
+    }
+
+    // and removing them drops it
+    os.Unsetenv("AUTH_JWT_JWKS")
+    fourth, err := parseSettings(third)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if fourth.jwtVerifier != nil {
+        t.Fatal("jwt verifier kept after AUTH_JWT_JWKS was removed")
+    }
+}
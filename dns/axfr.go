@@ -1,12 +1,13 @@
 package dns
 
 import (
+    "context"
     "log"
     "encoding/binary"
     "golang.org/x/net/dns/dnsmessage"
 )
 
-func NewAxfrQuery(domain string) ([]byte, error) {
+func NewAxfrQuery(ctx context.Context, domain string) ([]byte, error) {
     buf := make([]byte, 0)
     b := dnsmessage.NewBuilder(buf, dnsmessage.Header{
         ID: binary.BigEndian.Uint16(generateId()), 
@@ -28,7 +29,7 @@ func NewAxfrQuery(domain string) ([]byte, error) {
         },
     )
     if err != nil {
-        log.Printf("error adding question: %s", err)
+        logger().WarnContext(ctx, "error adding question", "zone", domain, "error", err)
         return nil, err
     }
 
@@ -1,14 +1,15 @@
 package dns
 
 import (
-    "log"
+    "context"
     "encoding/binary"
     "golang.org/x/net/dns/dnsmessage"
     "github.com/samchelini/dns-manager/jsend"
     "net/http"
 )
 
-func NewAxfrQueryV2(domain string) ([]byte, *jsend.Response) {
+// build a zone transfer query, with an opt record unless edns is nil
+func NewAxfrQueryV2(ctx context.Context, domain string, edns *EDNS) ([]byte, *jsend.Response) {
     buf := make([]byte, 0)
     b := dnsmessage.NewBuilder(buf, dnsmessage.Header{
         ID: binary.BigEndian.Uint16(generateId()), 
@@ -19,7 +20,7 @@ func NewAxfrQueryV2(domain string) ([]byte, *jsend.Response) {
 
     err := b.StartQuestions()
     if err != nil {
-        log.Printf("error starting questions: %s", err)
+        logger().ErrorContext(ctx, "error starting questions", "error", err)
         return nil, jsend.Error(domain, err.Error(), nil, http.StatusInternalServerError)
     }
 
@@ -31,13 +32,18 @@ func NewAxfrQueryV2(domain string) ([]byte, *jsend.Response) {
         },
     )
     if err != nil {
-        log.Printf("error adding question: %s", err)
+        logger().WarnContext(ctx, "error adding question", "zone", domain, "error", err)
         return nil, jsend.Fail(domain, err.Error(), nil, http.StatusBadRequest)
     }
 
     query, err := b.Finish()
     if err != nil {
-        log.Printf("error building message: %s", err)
+        logger().ErrorContext(ctx, "error building message", "error", err)
+        return nil, jsend.Error(domain, err.Error(), nil, http.StatusInternalServerError)
+    }
+    query, err = appendOPT(query, edns)
+    if err != nil {
+        logger().ErrorContext(ctx, "error adding opt record", "error", err)
         return nil, jsend.Error(domain, err.Error(), nil, http.StatusInternalServerError)
     }
 
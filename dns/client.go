@@ -0,0 +1,221 @@
+package dns
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "errors"
+    "io"
+    "golang.org/x/net/dns/dnsmessage"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// dns client sending queries to nameservers over tcp, over tls for
+// tls:// nameservers, over https for https:// nameservers, or over quic
+// for quic:// nameservers
+type Client struct {
+    DialTimeout time.Duration   // time allowed to establish a connection
+    ReadTimeout time.Duration   // time allowed to wait for each message
+    Timeout     time.Duration   // time allowed for a whole exchange or transfer, across retries
+    Retry       RetryPolicy     // how queries are retried across upstreams
+    MaxConns    int             // pooled connections per upstream, 0 disables pooling
+    IdleTimeout time.Duration   // time before an unused pooled connection is closed
+    TLSConfig   *tls.Config     // config for tls://, https:// and quic:// nameservers, see NewTLSConfig
+    DoHMethod   string          // http method for https:// lookups, POST (default) or GET
+    EDNS        *EDNS           // edns settings for queries built by the client, nil disables edns
+
+    httpOnce    sync.Once
+    httpClient  *http.Client
+    doqMu       sync.Mutex
+    doqConns    map[string]*doqDial
+
+    poolsMu     sync.Mutex
+    pools       map[string]*connPool
+
+    newTransport func(address string) transport    // replaces the transport for an address in tests
+}
+
+// client used by the package level functions
+var DefaultClient = &Client{
+    DialTimeout:    5 * time.Second,
+    ReadTimeout:    10 * time.Second,
+    Timeout:        60 * time.Second,
+    Retry:          DefaultRetryPolicy,
+    MaxConns:       4,
+    IdleTimeout:    10 * time.Second,
+    EDNS:           DefaultEDNS,
+}
+
+// error from a dns exchange, recording whether the query may have reached the server
+type exchangeError struct {
+    server  string
+    sent    bool
+    err     error
+}
+
+func (e *exchangeError) Error() string {
+    return e.err.Error()
+}
+
+func (e *exchangeError) Unwrap() error {
+    return e.err
+}
+
+// send a query to nameserver and return the answer, within the client timeout
+func (c *Client) exchange(ctx context.Context, query []byte, nameserver string) ([]byte, error) {
+    ctx, cancel := c.withTimeout(ctx)
+    defer cancel()
+    answer, err := c.transport(nameserver).exchange(ctx, c.withOptions(query, nameserver))
+    if err != nil {
+        return nil, err
+    }
+    c.keepServerCookie(nameserver, answer)
+    return answer, nil
+}
+
+// returns a context ending after the client timeout, which covers a whole
+// query or transfer including its retries
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+    if c.Timeout > 0 {
+        return context.WithTimeout(ctx, c.Timeout)
+    }
+    return ctx, func() {}
+}
+
+// dial a dedicated connection to nameserver, write query, and read one answer
+// or, for a zone transfer, every answer until the closing SOA record.
+// the connection is closed when the context is done or the exchange ends.
+func (c *Client) roundTrip(ctx context.Context, query []byte, nameserver string, xfr bool) ([][]byte, error) {
+
+    // dial
+    logger().DebugContext(ctx, "sending query", "server", nameserver)
+    conn, err := c.dial(ctx, nameserver)
+    if err != nil {
+        logger().WarnContext(ctx, "error creating connection", "server", nameserver, "error", err)
+        return nil, &exchangeError{server: nameserver, sent: false, err: err}
+    }
+    defer conn.Close()
+
+    // unblock reads and writes as soon as the context is done
+    stop := context.AfterFunc(ctx, func() {
+        conn.SetDeadline(time.Unix(1, 0))
+    })
+    defer stop()
+
+    // send query
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetWriteDeadline(deadline)
+    }
+    err = writeMessage(ctx, conn, query)
+    if err != nil {
+        logger().WarnContext(ctx, "error sending query", "server", nameserver, "error", err)
+        return nil, &exchangeError{server: nameserver, sent: true, err: contextError(ctx, err)}
+    }
+
+    // receive answers
+    answers := make([][]byte, 0, 1)
+    soaCount := 0
+    for {
+        conn.SetReadDeadline(c.readDeadline(ctx))
+        answer, err := readMessage(conn)
+        if err != nil {
+            logger().WarnContext(ctx, "error reading answer", "server", nameserver, "error", err)
+            return nil, &exchangeError{server: nameserver, sent: true, err: contextError(ctx, err)}
+        }
+        logger().DebugContext(ctx, "received message", "server", nameserver, "length", len(answer), "wire", wire(answer))
+        answers = append(answers, answer)
+        if !xfr {
+            return answers, nil
+        }
+
+        // a transfer ends with a second SOA record, or early on error
+        count, err := countSOA(answer)
+        if err != nil {
+            return nil, &exchangeError{server: nameserver, sent: true, err: err}
+        }
+        soaCount += count
+        if soaCount >= 2 || answer[3] & 0xf != 0 {
+            logger().DebugContext(ctx, "transfer complete", "server", nameserver, "messages", len(answers))
+            return answers, nil
+        }
+    }
+}
+
+// returns the deadline for reading the next message, the read timeout
+// from now without passing the context deadline
+func (c *Client) readDeadline(ctx context.Context) time.Time {
+    var deadline time.Time
+    if c.ReadTimeout > 0 {
+        deadline = time.Now().Add(c.ReadTimeout)
+    }
+    if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+        deadline = ctxDeadline
+    }
+    return deadline
+}
+
+// returns the context error when the context ended the exchange
+func contextError(ctx context.Context, err error) error {
+    if ctxErr := ctx.Err(); ctxErr != nil {
+        return ctxErr
+    }
+    return err
+}
+
+// write a length prefixed message
+func writeMessage(ctx context.Context, w io.Writer, msg []byte) error {
+    length := make([]byte, 2)
+    binary.BigEndian.PutUint16(length, uint16(len(msg)))
+    msg = append(length, msg...)
+    logger().DebugContext(ctx, "sending message", "length", len(msg) - 2, "wire", wire(msg))
+    _, err := w.Write(msg)
+    return err
+}
+
+// read a length prefixed message
+func readMessage(r io.Reader) ([]byte, error) {
+    lengthBytes := make([]byte, 2)
+    _, err := io.ReadFull(r, lengthBytes)
+    if err != nil {
+        return nil, err
+    }
+    length := binary.BigEndian.Uint16(lengthBytes)
+    msg := make([]byte, length)
+    _, err = io.ReadFull(r, msg)
+    if err != nil {
+        return nil, err
+    }
+    if length < 12 {
+        return nil, errors.New("answer is shorter than a dns header")
+    }
+    return msg, nil
+}
+
+// count the SOA records in the answer section of a message
+func countSOA(msg []byte) (int, error) {
+    var p dnsmessage.Parser
+    if _, err := p.Start(msg); err != nil {
+        return 0, err
+    }
+    if err := p.SkipAllQuestions(); err != nil {
+        return 0, err
+    }
+    count := 0
+    for {
+        h, err := p.AnswerHeader()
+        if err == dnsmessage.ErrSectionDone {
+            return count, nil
+        }
+        if err != nil {
+            return 0, err
+        }
+        if h.Type == dnsmessage.TypeSOA {
+            count++
+        }
+        if err := p.SkipAnswer(); err != nil {
+            return 0, err
+        }
+    }
+}
@@ -0,0 +1,106 @@
+package dns
+
+import (
+    "context"
+    "net"
+    "golang.org/x/net/dns/dnsmessage"
+    "github.com/samchelini/dns-manager/jsend"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// port updates and transfers are sent to on a discovered primary
+const PrimaryPort = "53"
+
+// cached primary nameserver for a zone
+type primaryEntry struct {
+    nameserver  string
+    expires     time.Time
+}
+
+// discovered primaries, keyed by zone
+var (
+    primaryCache    = make(map[string]primaryEntry)
+    primaryCacheMu  sync.Mutex
+)
+
+// find the primary nameserver for a zone the same way nsupdate does:
+// query the SOA through the resolver, take the MNAME, and resolve its address.
+// results are cached per zone for the lowest ttl seen along the way.
+func (c *Client) DiscoverPrimary(ctx context.Context, zone string, resolver string) (string, *jsend.Response) {
+    primaryCacheMu.Lock()
+    entry, ok := primaryCache[zone]
+    primaryCacheMu.Unlock()
+    if ok && time.Now().Before(entry.expires) {
+        return entry.nameserver, nil
+    }
+
+    // get the mname from the zone soa
+    logger().InfoContext(ctx, "discovering primary", "zone", zone, "resolver", resolver)
+    msg, jerr := c.Lookup(ctx, zone, dnsmessage.TypeSOA, resolver)
+    if jerr != nil {
+        return "", jerr
+    }
+    var mname string
+    var ttl uint32
+    for _, rr := range append(msg.Answers, msg.Authorities...) {
+        if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+            mname = soa.NS.String()
+            ttl = rr.Header.TTL
+            break
+        }
+    }
+    if mname == "" {
+        logger().WarnContext(ctx, "no SOA record found", "zone", zone)
+        return "", jsend.Fail(zone, "no SOA record found for zone", nil, http.StatusNotFound)
+    }
+    logger().DebugContext(ctx, "found primary", "zone", zone, "primary", mname)
+
+    // resolve the mname, preferring ipv4. a failed A lookup still tries
+    // AAAA, so ipv6 only primaries are found.
+    var addr net.IP
+    var lookupErr *jsend.Response
+    for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+        msg, jerr = c.Lookup(ctx, mname, t, resolver)
+        if jerr != nil {
+            logger().WarnContext(ctx, "error resolving primary", "zone", zone, "primary", mname, "type", t, "status", jerr.HttpCode)
+            lookupErr = jerr
+            continue
+        }
+    answers:
+        for _, rr := range msg.Answers {
+            switch body := rr.Body.(type) {
+            case *dnsmessage.AResource:
+                addr = net.IP(body.A[:])
+            case *dnsmessage.AAAAResource:
+                addr = net.IP(body.AAAA[:])
+            default:
+                continue
+            }
+            ttl = min(ttl, rr.Header.TTL)
+            break answers
+        }
+        if addr != nil {
+            break
+        }
+    }
+    if addr == nil && lookupErr != nil {
+        return "", lookupErr
+    }
+    if addr == nil {
+        logger().WarnContext(ctx, "no address found for primary", "zone", zone, "primary", mname)
+        return "", jsend.Error(mname, "no address found for primary nameserver", nil, http.StatusBadGateway)
+    }
+
+    // cache and return the primary
+    nameserver := net.JoinHostPort(addr.String(), PrimaryPort)
+    logger().InfoContext(ctx, "using primary", "zone", zone, "server", nameserver, "ttl", ttl)
+    primaryCacheMu.Lock()
+    primaryCache[zone] = primaryEntry{
+        nameserver: nameserver,
+        expires:    time.Now().Add(time.Duration(ttl) * time.Second),
+    }
+    primaryCacheMu.Unlock()
+    return nameserver, nil
+}
@@ -1,12 +1,14 @@
 package dns
 
 import (
+    "context"
+    "fmt"
+    "net/http"
+    "github.com/samchelini/dns-manager/jsend"
     "log"
     "net"
     "crypto/rand"
-    "encoding/binary"
     "golang.org/x/net/dns/dnsmessage"
-    "time"
 )
 
 type Record struct {
@@ -27,60 +29,39 @@ func generateId() []byte {
     return id
 }
 
-// send query to nameserver and return answer
-func SendQuery(query []byte, nameserver string) []byte {
-    length := make([]byte, 2)
-    binary.BigEndian.PutUint16(length, uint16(len(query)))
-
-    log.Printf("length: % x", length)
-    query = append(length, query...)
-    log.Printf("query: % x ", query)
-
-    // send request
-    log.Println("sending request...")
-    conn, err := net.DialTimeout("tcp", nameserver, 5 * time.Second)
-    if err != nil {
-        log.Fatalf("error creating connection: %s", err)
-    }
-    _, err = conn.Write(query)
-
-    // receive answer
-    answerLenBytes := make([]byte, 2)
-    conn.Read(answerLenBytes)
-    answerLen := binary.BigEndian.Uint16(answerLenBytes)
-    log.Printf("answerLenBytes: % x ", answerLenBytes)
-    log.Printf("answerLen: %d", answerLen)
-    answer := make([]byte, answerLen)
-    conn.Read(answer)
-    log.Printf("answer: % x ", answer)
-    log.Printf("length: % d", len(answer))
-
-    return answer
-}
-
 // get all records from answer
-func GetAllRecords(answer []byte) []Record {
-    // parse answer
-    log.Println("starting parser...")
+func GetAllRecords(ctx context.Context, answer []byte) ([]Record, *jsend.Response) {
     var p dnsmessage.Parser
     if _, err := p.Start(answer); err != nil {
-        log.Fatal(err)
+        return nil, invalidAnswer(ctx, "error parsing header", err)
+    }
+    if err := p.SkipAllQuestions(); err != nil {
+        return nil, invalidAnswer(ctx, "error skipping questions", err)
     }
-    err := p.SkipAllQuestions()
+    records, err := answerRecords(&p)
     if err != nil {
-        log.Fatalf("error skipping questions: %s", err)
+        return nil, invalidAnswer(ctx, "error parsing answer", err)
     }
+    return records, nil
+}
 
-    log.Println("parsing answers...")
+// returns the bad gateway response for an answer that cannot be parsed
+func invalidAnswer(ctx context.Context, msg string, err error) *jsend.Response {
+    logger().WarnContext(ctx, msg, "error", err)
+    return jsend.Error(nil, fmt.Sprintf("invalid answer from upstream: %s", err), nil, http.StatusBadGateway)
+}
+
+// parse the records of the answer section
+func answerRecords(p *dnsmessage.Parser) ([]Record, error) {
     var records []Record
     for {
-		h, err := p.AnswerHeader()
-		if err == dnsmessage.ErrSectionDone {
-			break
-		}
-		if err != nil {
-			log.Fatalf("error parsing answer: %s", err)
-		}
+        h, err := p.AnswerHeader()
+        if err == dnsmessage.ErrSectionDone {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
 
         rec := Record {
             Name: h.Name.String(),
@@ -89,19 +70,18 @@ func GetAllRecords(answer []byte) []Record {
             TTL: h.TTL,
             Data: make(map[string]interface{}),
         }
-        
-		switch h.Type {
-		case dnsmessage.TypeA:
-			r, err := p.AResource()
-			if err != nil {
-				log.Fatalf("error parsing A Record: %s", err)
-			}
-			rec.Data["address"] = net.IP(r.A[:]).To4()
-            records = append(records, rec)
+
+        switch h.Type {
+        case dnsmessage.TypeA:
+            r, err := p.AResource()
+            if err != nil {
+                return nil, fmt.Errorf("error parsing A Record: %s", err)
+            }
+            rec.Data["address"] = net.IP(r.A[:]).To4()
         case dnsmessage.TypeSOA:
             r, err := p.SOAResource()
             if err != nil {
-                log.Fatalf("error parsing SOA Record: %s", err)
+                return nil, fmt.Errorf("error parsing SOA Record: %s", err)
             }
             rec.Data["ns"] = r.NS.String()
             rec.Data["mBox"] = r.MBox.String()
@@ -110,26 +90,24 @@ func GetAllRecords(answer []byte) []Record {
             rec.Data["retry"] = r.Retry
             rec.Data["expire"] = r.Expire
             rec.Data["minTtl"] = r.MinTTL
-            records = append(records, rec)
         case dnsmessage.TypeNS:
             r, err := p.NSResource()
             if err != nil {
-                log.Fatalf("error parsing NS Record: %s", err)
+                return nil, fmt.Errorf("error parsing NS Record: %s", err)
             }
             rec.Data["ns"] = r.NS.String()
-            records = append(records, rec)
         case dnsmessage.TypePTR:
             r, err := p.PTRResource()
             if err != nil {
-                log.Fatalf("error parsing PTR Record: %s", err)
+                return nil, fmt.Errorf("error parsing PTR Record: %s", err)
             }
             rec.Data["ptr"] = r.PTR.String()
-            records = append(records, rec)
         default:
-            records = append(records, rec)
-            p.SkipAnswer()
-		}
-	}
-
-    return records
+            if err := p.SkipAnswer(); err != nil {
+                return nil, err
+            }
+        }
+        records = append(records, rec)
+    }
+    return records, nil
 }
@@ -0,0 +1,61 @@
+package dns
+
+import (
+    "context"
+    "net"
+    "net/http"
+    "testing"
+    "golang.org/x/net/dns/dnsmessage"
+    "github.com/samchelini/dns-manager/jsend"
+)
+
+// returns an answer holding an A record for host.example.com.
+func testAnswer(t *testing.T) []byte {
+    t.Helper()
+    b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+    b.StartQuestions()
+    b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("host.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+    b.StartAnswers()
+    b.AResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("host.example.com."), Class: dnsmessage.ClassINET, TTL: 300}, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+    answer, err := b.Finish()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return answer
+}
+
+func TestGetAllRecordsMalformed(t *testing.T) {
+    answer := testAnswer(t)
+    tests := []struct {
+        name    string
+        answer  []byte
+        records int
+    }{
+        {name: "valid", answer: answer, records: 1},
+        {name: "short header", answer: answer[:5]},
+        {name: "truncated question", answer: answer[:20]},
+        {name: "truncated record", answer: answer[:len(answer) - 2]},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for name, getAll := range map[string]func(context.Context, []byte) ([]Record, *jsend.Response){
+                "v1": GetAllRecords,
+                "v2": GetAllRecordsV2,
+            } {
+                records, jerr := getAll(context.Background(), tt.answer)
+                if tt.records > 0 {
+                    if jerr != nil {
+                        t.Fatalf("%s: %s", name, *jerr.Message)
+                    }
+                    if len(records) != tt.records || records[0].Data["address"].(net.IP).String() != "192.0.2.1" {
+                        t.Fatalf("%s: got records %+v", name, records)
+                    }
+                    continue
+                }
+                if jerr == nil || jerr.HttpCode != http.StatusBadGateway {
+                    t.Fatalf("%s: got %+v, want a bad gateway error", name, jerr)
+                }
+            }
+        })
+    }
+}
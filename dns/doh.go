@@ -0,0 +1,108 @@
+package dns
+
+import (
+    "bytes"
+    "context"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net"
+    "net/http"
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+// upstream address prefix and media type for dns over https (rfc 8484)
+const (
+    dohScheme       = "https://"
+    dohMediaType    = "application/dns-message"
+)
+
+// dns over https to a url template without variables, such as https://dns.example.com/dns-query
+type dohTransport struct {
+    client  *Client
+    url     string
+}
+
+// returns the http client for dns over https, built once from the client settings
+func (c *Client) doh() *http.Client {
+    c.httpOnce.Do(func() {
+        c.httpClient = &http.Client{
+            Transport: &http.Transport{
+                DialContext:            (&net.Dialer{Timeout: c.DialTimeout}).DialContext,
+                TLSClientConfig:        c.TLSConfig,
+                TLSHandshakeTimeout:    c.DialTimeout,
+                ResponseHeaderTimeout:  c.ReadTimeout,
+                MaxIdleConnsPerHost:    max(c.MaxConns, 1),
+                IdleConnTimeout:        c.IdleTimeout,
+                ForceAttemptHTTP2:      true,
+            },
+        }
+    })
+    return c.httpClient
+}
+
+// send a query with GET or POST as configured. updates are always sent with POST,
+// since GET requests may be repeated or cached along the way.
+func (t *dohTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+    c := t.client
+
+    // build request
+    var req *http.Request
+    var err error
+    update := dnsmessage.OpCode(query[2] >> 3 & 0xf) == opCodeUpdate
+    if c.DoHMethod == http.MethodGet && !update {
+        url := t.url + "?dns=" + base64.RawURLEncoding.EncodeToString(query)
+        req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    } else {
+        req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(query))
+        if req != nil {
+            req.Header.Set("Content-Type", dohMediaType)
+        }
+    }
+    if err != nil {
+        return nil, &exchangeError{server: t.url, sent: false, err: err}
+    }
+    req.Header.Set("Accept", dohMediaType)
+    logger().DebugContext(ctx, "sending query over https", "method", req.Method, "url", t.url, "wire", wire(query))
+
+    // send request, errors while connecting mean the query was never sent
+    resp, err := c.doh().Do(req)
+    if err != nil {
+        logger().WarnContext(ctx, "error sending query", "url", t.url, "error", err)
+        var opErr *net.OpError
+        sent := !(errors.As(err, &opErr) && opErr.Op == "dial")
+        return nil, &exchangeError{server: t.url, sent: sent, err: contextError(ctx, err)}
+    }
+    defer resp.Body.Close()
+
+    // read answer
+    if resp.StatusCode != http.StatusOK {
+        err = fmt.Errorf("unexpected http status: %s", resp.Status)
+        return nil, &exchangeError{server: t.url, sent: true, err: err}
+    }
+    if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != dohMediaType {
+        err = fmt.Errorf("unexpected content type: %q", resp.Header.Get("Content-Type"))
+        return nil, &exchangeError{server: t.url, sent: true, err: err}
+    }
+    answer, err := io.ReadAll(io.LimitReader(resp.Body, 0xffff + 1))
+    if err != nil {
+        return nil, &exchangeError{server: t.url, sent: true, err: contextError(ctx, err)}
+    }
+    if len(answer) > 0xffff || len(answer) < 12 {
+        err = fmt.Errorf("invalid answer length: %d", len(answer))
+        return nil, &exchangeError{server: t.url, sent: true, err: err}
+    }
+    logger().DebugContext(ctx, "received message", "length", len(answer), "wire", wire(answer))
+    return answer, nil
+}
+
+// an http response carries a single message, so the whole zone must fit in one answer
+func (t *dohTransport) transfer(ctx context.Context, query []byte) ([][]byte, error) {
+    answer, err := t.exchange(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    return [][]byte{answer}, nil
+}
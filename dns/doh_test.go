@@ -0,0 +1,192 @@
+package dns
+
+import (
+    "bytes"
+    "context"
+    "encoding/base64"
+    "errors"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+// a request received by the test dns over https server
+type dohRequest struct {
+    method      string
+    contentType string
+    accept      string
+    query       []byte
+}
+
+// starts a dns over https server that records each request and answers with
+// the result of answer, or echoes the query as a response when answer is nil
+func newDoHServer(t *testing.T, answer func(query []byte, w http.ResponseWriter)) (*httptest.Server, *Client, chan dohRequest) {
+    t.Helper()
+    requests := make(chan dohRequest, 10)
+    server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/dns-query" {
+            http.NotFound(w, r)
+            return
+        }
+        req := dohRequest{method: r.Method, contentType: r.Header.Get("Content-Type"), accept: r.Header.Get("Accept")}
+        var err error
+        if r.Method == http.MethodGet {
+            req.query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+        } else {
+            req.query, err = io.ReadAll(r.Body)
+        }
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        requests <- req
+        if answer != nil {
+            answer(req.query, w)
+            return
+        }
+        response := append([]byte{}, req.query...)
+        response[2] |= 0x80
+        w.Header().Set("Content-Type", dohMediaType)
+        w.Write(response)
+    }))
+    t.Cleanup(server.Close)
+    client := &Client{TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}
+    return server, client, requests
+}
+
+// returns a lookup query, changed into an update when update is set
+func testQuery(t *testing.T, update bool) []byte {
+    t.Helper()
+    query, jerr := NewLookupQuery(context.Background(), "example.com.", dnsmessage.TypeSOA, nil)
+    if jerr != nil {
+        t.Fatal(*jerr.Message)
+    }
+    if update {
+        query[2] = byte(opCodeUpdate) << 3
+    }
+    return query
+}
+
+func TestDoHExchange(t *testing.T) {
+    tests := []struct {
+        name        string
+        method      string
+        update      bool
+        wantMethod  string
+    }{
+        {name: "post by default", method: "", wantMethod: http.MethodPost},
+        {name: "post", method: http.MethodPost, wantMethod: http.MethodPost},
+        {name: "get", method: http.MethodGet, wantMethod: http.MethodGet},
+        {name: "update with get is posted", method: http.MethodGet, update: true, wantMethod: http.MethodPost},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            server, client, requests := newDoHServer(t, nil)
+            client.DoHMethod = tt.method
+            query := testQuery(t, tt.update)
+
+            answer, err := client.exchange(context.Background(), query, server.URL + "/dns-query")
+            if err != nil {
+                t.Fatal(err)
+            }
+            req := <-requests
+            if req.method != tt.wantMethod {
+                t.Errorf("got method %s, want %s", req.method, tt.wantMethod)
+            }
+            if req.accept != dohMediaType {
+                t.Errorf("got accept %q, want %q", req.accept, dohMediaType)
+            }
+            if tt.wantMethod == http.MethodPost && req.contentType != dohMediaType {
+                t.Errorf("got content type %q, want %q", req.contentType, dohMediaType)
+            }
+            if !bytes.Equal(req.query, query) {
+                t.Errorf("server received %x, want %x", req.query, query)
+            }
+            if !bytes.Equal(answer[3:], query[3:]) || answer[2] & 0x80 == 0 {
+                t.Errorf("got answer %x for query %x", answer, query)
+            }
+        })
+    }
+}
+
+func TestDoHErrors(t *testing.T) {
+    tests := []struct {
+        name    string
+        answer  func(query []byte, w http.ResponseWriter)
+        err     string
+    }{
+        {
+            name:   "server error",
+            answer: func(query []byte, w http.ResponseWriter) { http.Error(w, "busy", http.StatusServiceUnavailable) },
+            err:    "unexpected http status: 503 Service Unavailable",
+        },
+        {
+            name:   "wrong content type",
+            answer: func(query []byte, w http.ResponseWriter) {
+                w.Header().Set("Content-Type", "text/html")
+                w.Write(query)
+            },
+            err:    "unexpected content type",
+        },
+        {
+            name:   "short answer",
+            answer: func(query []byte, w http.ResponseWriter) {
+                w.Header().Set("Content-Type", dohMediaType)
+                w.Write(query[:11])
+            },
+            err:    "invalid answer length: 11",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            server, client, _ := newDoHServer(t, tt.answer)
+            _, err := client.exchange(context.Background(), testQuery(t, false), server.URL + "/dns-query")
+            if err == nil || !strings.Contains(err.Error(), tt.err) {
+                t.Fatalf("got error %v, want %q", err, tt.err)
+            }
+
+            // the server received the query, so it must not be retried elsewhere
+            var exErr *exchangeError
+            if !errors.As(err, &exErr) || !exErr.sent {
+                t.Fatalf("got error %#v, want a sent exchangeError", err)
+            }
+        })
+    }
+}
+
+func TestDoHTransferLimit(t *testing.T) {
+    tests := []struct {
+        name    string
+        size    int
+        err     string
+    }{
+        {name: "largest message", size: 0xffff},
+        {name: "too large", size: 0xffff + 1, err: "invalid answer length: 65536"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            server, client, _ := newDoHServer(t, func(query []byte, w http.ResponseWriter) {
+                answer := make([]byte, tt.size)
+                copy(answer, query)
+                w.Header().Set("Content-Type", dohMediaType)
+                w.Write(answer)
+            })
+            answers, err := client.transport(server.URL + "/dns-query").transfer(context.Background(), testQuery(t, false))
+            if tt.err != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.err) {
+                    t.Fatalf("got error %v, want %q", err, tt.err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(answers) != 1 || len(answers[0]) != tt.size {
+                t.Fatalf("got %d answers, want one of %d bytes", len(answers), tt.size)
+            }
+        })
+    }
+}
@@ -0,0 +1,204 @@
+package dns
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "strings"
+    "github.com/quic-go/quic-go"
+)
+
+// upstream address prefix, alpn and port for dns over quic (rfc 9250)
+const (
+    doqScheme   = "quic://"
+    doqALPN     = "doq"
+    doqPort     = "853"
+)
+
+// returns whether an upstream address uses dns over quic. quic queries are
+// sent with message id 0, which breaks sig(0) signatures as they cover the id.
+func IsQUIC(address string) bool {
+    return strings.HasPrefix(address, doqScheme)
+}
+
+// doq error codes sent when closing connections and cancelling streams
+const (
+    doqNoError          quic.ApplicationErrorCode = 0x0
+    doqStreamNoError    quic.StreamErrorCode = 0x0
+    doqRequestCancelled quic.StreamErrorCode = 0x3
+)
+
+// dns over quic, one query per stream on a shared connection
+type doqTransport struct {
+    client  *Client
+    address string
+}
+
+// a quic connection to one upstream, dialed by the first query that needs it
+// while later queries wait on done
+type doqDial struct {
+    done    chan struct{}
+    conn    quic.Connection
+    err     error
+}
+
+// returns an open quic connection to address, dialing a new one when needed.
+// doqMu is only held to look up the dial, so a slow upstream does not stall
+// queries to other upstreams.
+func (c *Client) doqConn(ctx context.Context, address string) (quic.Connection, error) {
+    c.doqMu.Lock()
+    d, ok := c.doqConns[address]
+    if ok {
+        select {
+        case <-d.done:
+            // dial again when the last dial failed or the connection closed
+            ok = d.err == nil && d.conn.Context().Err() == nil
+        default:
+        }
+    }
+    if !ok {
+        d = &doqDial{done: make(chan struct{})}
+        if c.doqConns == nil {
+            c.doqConns = make(map[string]*doqDial)
+        }
+        c.doqConns[address] = d
+        c.doqMu.Unlock()
+        d.conn, d.err = c.dialQUIC(ctx, address)
+
+        // close the connection when the client was closed while dialing
+        c.doqMu.Lock()
+        if d.err == nil && c.doqConns[address] != d {
+            d.conn.CloseWithError(doqNoError, "")
+            d.conn, d.err = nil, errConnClosed
+        }
+        c.doqMu.Unlock()
+        close(d.done)
+        return d.conn, d.err
+    }
+    c.doqMu.Unlock()
+
+    select {
+    case <-d.done:
+        return d.conn, d.err
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// dial a quic connection to address
+func (c *Client) dialQUIC(ctx context.Context, address string) (quic.Connection, error) {
+    // default to the dns over quic port
+    host := address
+    if _, _, err := net.SplitHostPort(host); err != nil {
+        host = net.JoinHostPort(strings.Trim(host, "[]"), doqPort)
+    }
+    serverName, _, _ := net.SplitHostPort(host)
+
+    // dial
+    logger().DebugContext(ctx, "dialing over quic", "server", host)
+    tlsConfig := &tls.Config{}
+    if c.TLSConfig != nil {
+        tlsConfig = c.TLSConfig.Clone()
+    }
+    tlsConfig.NextProtos = []string{doqALPN}
+    if tlsConfig.ServerName == "" {
+        tlsConfig.ServerName = serverName
+    }
+    if c.DialTimeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, c.DialTimeout)
+        defer cancel()
+    }
+    return quic.DialAddr(ctx, host, tlsConfig, &quic.Config{
+        HandshakeIdleTimeout:   c.DialTimeout,
+        MaxIdleTimeout:         c.IdleTimeout,
+    })
+}
+
+// send a query on a new stream and return the answer
+func (t *doqTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+    answers, err := t.roundTrip(ctx, query, false)
+    if err != nil {
+        return nil, err
+    }
+    return answers[0], nil
+}
+
+// send a zone transfer query on a new stream and return every answer
+// message, which the server sends on the same stream
+func (t *doqTransport) transfer(ctx context.Context, query []byte) ([][]byte, error) {
+    return t.roundTrip(ctx, query, true)
+}
+
+// open a stream, write query, and read answers until the server closes the stream
+func (t *doqTransport) roundTrip(ctx context.Context, query []byte, xfr bool) ([][]byte, error) {
+    c := t.client
+
+    // open a stream, errors here mean the query was never sent
+    conn, err := c.doqConn(ctx, t.address)
+    if err != nil {
+        logger().WarnContext(ctx, "error creating connection", "server", t.address, "error", err)
+        return nil, &exchangeError{server: t.address, sent: false, err: contextError(ctx, err)}
+    }
+    stream, err := conn.OpenStreamSync(ctx)
+    if err != nil {
+        logger().WarnContext(ctx, "error opening stream", "server", t.address, "error", err)
+
+        // the connection is only broken when the query was not cancelled,
+        // other queries may still be using it
+        if ctx.Err() == nil {
+            conn.CloseWithError(doqNoError, "")
+        }
+        return nil, &exchangeError{server: t.address, sent: false, err: contextError(ctx, err)}
+    }
+
+    // cancel the stream as soon as the context is done
+    stop := context.AfterFunc(ctx, func() {
+        stream.CancelRead(doqRequestCancelled)
+        stream.CancelWrite(doqRequestCancelled)
+    })
+    defer stop()
+
+    // the message id must be 0 over quic, the original id is restored in the answers
+    id := binary.BigEndian.Uint16(query)
+    query = append([]byte{0, 0}, query[2:]...)
+
+    // send query and close the sending side of the stream
+    if deadline, ok := ctx.Deadline(); ok {
+        stream.SetWriteDeadline(deadline)
+    }
+    err = writeMessage(ctx, stream, query)
+    if err == nil {
+        err = stream.Close()
+    }
+    if err != nil {
+        logger().WarnContext(ctx, "error sending query", "server", t.address, "error", err)
+        return nil, &exchangeError{server: t.address, sent: true, err: contextError(ctx, err)}
+    }
+
+    // receive answers
+    answers := make([][]byte, 0, 1)
+    for {
+        stream.SetReadDeadline(c.readDeadline(ctx))
+        answer, err := readMessage(stream)
+        if errors.Is(err, io.EOF) && len(answers) > 0 {
+            logger().DebugContext(ctx, "stream complete", "server", t.address, "messages", len(answers))
+            return answers, nil
+        }
+        if err != nil {
+            logger().WarnContext(ctx, "error reading answer", "server", t.address, "error", err)
+            stream.CancelRead(doqRequestCancelled)
+            return nil, &exchangeError{server: t.address, sent: true, err: contextError(ctx, err)}
+        }
+        binary.BigEndian.PutUint16(answer, id)
+        logger().DebugContext(ctx, "received message", "server", t.address, "length", len(answer), "wire", wire(answer))
+        answers = append(answers, answer)
+        if !xfr {
+            stream.CancelRead(doqStreamNoError)
+            return answers, nil
+        }
+    }
+}
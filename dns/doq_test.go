@@ -0,0 +1,181 @@
+package dns
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/quic-go/quic-go"
+)
+
+// a query received by the test dns over quic server
+type doqQuery struct {
+    stream  quic.StreamID
+    length  uint16  // length prefix of the query
+    query   []byte
+    rest    []byte  // anything sent after the query on the stream
+}
+
+// a local dns over quic server answering each stream with the messages
+// returned by answer
+type doqServer struct {
+    address     string
+    accepted    atomic.Int32
+    mu          sync.Mutex
+    queries     []doqQuery
+}
+
+// starts a dns over quic server and returns it with a client trusting its certificate
+func newDoQServer(t *testing.T, answer func(query []byte) [][]byte) (*doqServer, *Client) {
+    t.Helper()
+
+    // borrow the certificate and roots of an https test server
+    https := httptest.NewTLSServer(http.NotFoundHandler())
+    cert := https.TLS.Certificates[0]
+    clientConfig := https.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+    https.Close()
+
+    ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{doqALPN}}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    s := &doqServer{address: ln.Addr().String()}
+    go func() {
+        for {
+            conn, err := ln.Accept(context.Background())
+            if err != nil {
+                return
+            }
+            s.accepted.Add(1)
+            go func() {
+                for {
+                    stream, err := conn.AcceptStream(context.Background())
+                    if err != nil {
+                        return
+                    }
+                    go s.serve(stream, answer)
+                }
+            }()
+        }
+    }()
+
+    client := &Client{DialTimeout: time.Second, ReadTimeout: 5 * time.Second, TLSConfig: clientConfig}
+    t.Cleanup(client.Close)
+    return s, client
+}
+
+// read one length prefixed query, record it, and write the answers on the same stream
+func (s *doqServer) serve(stream quic.Stream, answer func(query []byte) [][]byte) {
+    defer stream.Close()
+    var length [2]byte
+    if _, err := io.ReadFull(stream, length[:]); err != nil {
+        return
+    }
+    q := doqQuery{stream: stream.StreamID(), length: binary.BigEndian.Uint16(length[:])}
+    q.query = make([]byte, q.length)
+    if _, err := io.ReadFull(stream, q.query); err != nil {
+        return
+    }
+    q.rest, _ = io.ReadAll(stream)
+    s.mu.Lock()
+    s.queries = append(s.queries, q)
+    s.mu.Unlock()
+
+    for _, msg := range answer(q.query) {
+        stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg))))
+        stream.Write(msg)
+    }
+}
+
+// returns the queries received so far
+func (s *doqServer) received() []doqQuery {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]doqQuery{}, s.queries...)
+}
+
+func TestDoQExchange(t *testing.T) {
+    server, c := newDoQServer(t, func(query []byte) [][]byte {
+        return [][]byte{answerTo(query)}
+    })
+
+    query := queryWithID(t, 0x1234)
+    for i := 0; i < 2; i++ {
+        answer, err := c.transport(doqScheme + server.address).exchange(context.Background(), query)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if id := binary.BigEndian.Uint16(answer); id != 0x1234 {
+            t.Fatalf("got answer with id %#x, want the query id restored", id)
+        }
+        if !bytes.Equal(answer[2:], answerTo(query)[2:]) {
+            t.Fatalf("got answer %x", answer)
+        }
+    }
+    if binary.BigEndian.Uint16(query) != 0x1234 {
+        t.Fatal("query passed in was changed")
+    }
+
+    queries := server.received()
+    if len(queries) != 2 {
+        t.Fatalf("got %d queries, want 2", len(queries))
+    }
+    for _, q := range queries {
+        if int(q.length) != len(query) {
+            t.Errorf("got length prefix %d, want %d", q.length, len(query))
+        }
+        if id := binary.BigEndian.Uint16(q.query); id != 0 {
+            t.Errorf("got query id %#x, want 0", id)
+        }
+        if !bytes.Equal(q.query[2:], query[2:]) {
+            t.Errorf("got query %x, want %x", q.query, query)
+        }
+        if len(q.rest) != 0 {
+            t.Errorf("got %d bytes after the query, want the stream closed", len(q.rest))
+        }
+    }
+    if queries[0].stream == queries[1].stream {
+        t.Fatal("two queries were sent on the same stream")
+    }
+    if n := server.accepted.Load(); n != 1 {
+        t.Fatalf("got %d connections, want the queries on 1", n)
+    }
+}
+
+func TestDoQTransfer(t *testing.T) {
+    server, c := newDoQServer(t, func(query []byte) [][]byte {
+        return [][]byte{answerTo(query), answerTo(query), answerTo(query)}
+    })
+
+    for i := 0; i < 2; i++ {
+        answers, err := c.transport(doqScheme + server.address).transfer(context.Background(), queryWithID(t, 0xbeef))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(answers) != 3 {
+            t.Fatalf("got %d messages, want every message until the stream closed", len(answers))
+        }
+        for _, answer := range answers {
+            if id := binary.BigEndian.Uint16(answer); id != 0xbeef {
+                t.Fatalf("got message with id %#x, want the query id restored", id)
+            }
+        }
+    }
+
+    // each transfer gets its own stream on the shared connection
+    queries := server.received()
+    if len(queries) != 2 || queries[0].stream == queries[1].stream {
+        t.Fatalf("got queries %+v, want 2 on separate streams", queries)
+    }
+    if n := server.accepted.Load(); n != 1 {
+        t.Fatalf("got %d connections, want 1", n)
+    }
+}
@@ -1,14 +1,14 @@
 package dns
 
 import (
+    "context"
     "log"
     "encoding/binary"
+    "fmt"
     "golang.org/x/net/dns/dnsmessage"
     "net"
     "strings"
     "time"
-    "crypto/hmac"
-    "crypto/sha256"
     "encoding/base64"
 )
 
@@ -17,8 +17,16 @@ type Op uint8
 const (
     OpAdd       Op = 0
     OpDelete    Op = 1
+    OpCheck     Op = 2  // changes nothing, answered with YXRRSET if the signature is accepted
+    OpAppend    Op = 3  // adds the record without replacing the rrset
 )
 
+// class of "rrset does not exist" prerequisites (rfc 2136 2.4.3)
+const classNONE dnsmessage.Class = 254
+
+// record type of tsig records
+const typeTSIG dnsmessage.Type = 250
+
 // tsig object
 type TSIG struct {
     Name        string  `json:"name"`
@@ -27,8 +35,63 @@ type TSIG struct {
 }
 
 
-// build an dynamic dns update query with tsig
-func NewUpdateQuery(zone string, op Op, record *Record, tsig *TSIG) ([]byte, error) {
+// build an dynamic dns update query with tsig. every record is changed in
+// the one update, which the server applies all together or not at all.
+func NewUpdateQuery(ctx context.Context, zone string, op Op, records []*Record, tsig *TSIG) ([]byte, error) {
+    b, id, err := newUpdateBuilder(ctx, zone, op, records)
+    if err != nil {
+        return nil, err
+    }
+
+    // pass copy of the builder, 
+    // since mac is generated based on the message before tsig record is added
+    mac := GenerateMac(b, tsig)
+    
+    // start additional section (for tsig record)
+    err = b.StartAdditionals()
+    if err != nil {
+        log.Fatalf("error starting additionals: %s", err)
+    }
+
+    // construct and add tsig record
+    tsigHeader := dnsmessage.ResourceHeader {
+        Name:   dnsmessage.MustNewName(tsig.Name),
+        Type:   typeTSIG,
+        Class:  dnsmessage.ClassANY,
+        TTL:    0,
+    }
+    tsigResource := newTsigResource(tsig, mac, id)
+    err = b.UnknownResource(tsigHeader, tsigResource)
+    if err != nil {
+        logger().ErrorContext(ctx, "error adding tsig record", "key", tsig.Name, "error", err)
+        return nil, fmt.Errorf("error adding tsig record: %s", err)
+    }
+
+    // finish building and return query
+    query, err := b.Finish()
+    if err != nil {
+        log.Fatalf("error building message: %s", err)
+    }
+    return query, err
+}
+
+// build an dynamic dns update query signed with sig(0)
+func NewUpdateQuerySig0(ctx context.Context, zone string, op Op, records []*Record, key *Sig0Key) ([]byte, error) {
+    b, _, err := newUpdateBuilder(ctx, zone, op, records)
+    if err != nil {
+        return nil, err
+    }
+    msg, err := b.Finish()
+    if err != nil {
+        logger().ErrorContext(ctx, "error building message", "error", err)
+        return nil, err
+    }
+    return key.Sign(msg)
+}
+
+// build the zone and update sections of an update query, returning the
+// builder and message id for signing
+func newUpdateBuilder(ctx context.Context, zone string, op Op, records []*Record) (dnsmessage.Builder, []byte, error) {
     buf := make([]byte, 0)
     id := generateId()
 
@@ -52,8 +115,27 @@ func NewUpdateQuery(zone string, op Op, record *Record, tsig *TSIG) ([]byte, err
         },
     )
     if err != nil {
-        log.Printf("error adding zone: %s", err)
-        return nil, err
+        logger().WarnContext(ctx, "error adding zone", "zone", zone, "error", err)
+        return b, nil, err
+    }
+
+    // a check only has a prerequisite that the zone has no soa, which is
+    // never met, so the server verifies the signature and answers YXRRSET
+    // without changing anything
+    if op == OpCheck {
+        err = b.StartAnswers()
+        if err != nil {
+            log.Fatalf("error starting prerequisites: %s", err)
+        }
+        err = b.UnknownResource(dnsmessage.ResourceHeader{
+            Name:   dnsmessage.MustNewName(zone),
+            Type:   dnsmessage.TypeSOA,
+            Class:  classNONE,
+        }, dnsmessage.UnknownResource{Type: dnsmessage.TypeSOA})
+        if err != nil {
+            logger().WarnContext(ctx, "error adding prerequisite", "zone", zone, "error", err)
+        }
+        return b, id, err
     }
 
     // start update section (same as authority section)
@@ -62,109 +144,127 @@ func NewUpdateQuery(zone string, op Op, record *Record, tsig *TSIG) ([]byte, err
         log.Fatalf("error starting updates: %s", err)
     }
 
-    // add records depending on the type of operation
-    switch op {
-    case OpDelete:
-        deleteRecord(&b, record)
-    case OpAdd:
-        deleteRecord(&b, record)
-        addRecord(&b, record)
-    }
-
-    // pass copy of the builder, 
-    // since mac is generated based on the message before tsig record is added
-    mac := GenerateMac(b, tsig)
-    
-    // start additional section (for tsig record)
-    err = b.StartAdditionals()
-    if err != nil {
-        log.Fatalf("error starting additionals: %s", err)
+    // add records depending on the type of operation. adds delete every
+    // rrset they replace first, so records of the same rrset are all kept.
+    if op == OpDelete || op == OpAdd {
+        deleted := make(map[string]bool)
+        for _, record := range records {
+            rrset := strings.ToLower(record.Name) + " " + record.Type
+            if err == nil && !deleted[rrset] {
+                deleted[rrset] = true
+                err = deleteRecord(&b, record)
+            }
+        }
     }
-
-    // construct and add tsig record
-    tsigHeader := dnsmessage.ResourceHeader {
-        Name:   dnsmessage.MustNewName(tsig.Name),
-        Type:   250, // tsig type
-        Class:  dnsmessage.ClassANY,
-        TTL:    0,
+    if op == OpAdd || op == OpAppend {
+        for _, record := range records {
+            if err == nil {
+                err = addRecord(&b, record)
+            }
+        }
     }
-    tsigResource := newTsigResource(tsig, mac, id)
-    b.UnknownResource(tsigHeader, tsigResource)
-
-    // finish building and return query
-    query, err := b.Finish()
     if err != nil {
-        log.Fatalf("error building message: %s", err)
+        logger().WarnContext(ctx, "error adding record", "zone", zone, "error", err)
+        return b, nil, err
     }
-    return query, err
+
+    return b, id, nil
 }
 
 // adds a record to the builder question section
-func addRecord(builder *dnsmessage.Builder, record *Record) {
+func addRecord(builder *dnsmessage.Builder, record *Record) error {
+    t, err := typeFromString(record.Type)
+    if err != nil {
+        return err
+    }
+    name, err := dnsmessage.NewName(record.Name)
+    if err != nil {
+        return fmt.Errorf("invalid name %q: %s", record.Name, err)
+    }
+    resourceHeader := dnsmessage.ResourceHeader {
+        Name: name,
+        Type: t,
+        Class: dnsmessage.ClassINET,
+        TTL: record.TTL,
+    }
     switch record.Type {
     case "TypeA":
         // convert address to [4]byte
-        addr := [4]byte(net.ParseIP(record.Data["address"].(string)).To4())
-        aResource := dnsmessage.AResource{A: addr}
-        resourceHeader := dnsmessage.ResourceHeader {
-            Name: dnsmessage.MustNewName(record.Name),
-            Type: dnsmessage.TypeA,
-            Class: dnsmessage.ClassINET,
-            TTL: record.TTL,
+        ip := net.ParseIP(fmt.Sprint(record.Data["address"])).To4()
+        if ip == nil {
+            return fmt.Errorf("invalid address %q", fmt.Sprint(record.Data["address"]))
+        }
+        return builder.AResource(resourceHeader, dnsmessage.AResource{A: [4]byte(ip)})
+    case "TypeNS":
+        ns, err := dnsmessage.NewName(fmt.Sprint(record.Data["ns"]))
+        if err != nil {
+            return fmt.Errorf("invalid ns %q: %s", fmt.Sprint(record.Data["ns"]), err)
         }
-        builder.AResource(resourceHeader, aResource)
+        return builder.NSResource(resourceHeader, dnsmessage.NSResource{NS: ns})
+    default:
+        ptr, err := dnsmessage.NewName(fmt.Sprint(record.Data["ptr"]))
+        if err != nil {
+            return fmt.Errorf("invalid ptr %q: %s", fmt.Sprint(record.Data["ptr"]), err)
+        }
+        return builder.PTRResource(resourceHeader, dnsmessage.PTRResource{PTR: ptr})
     }
-    
 }
 
+// record types that can be added by updates
+var UpdateTypes = []string{"TypeA", "TypeNS", "TypePTR"}
+
 // adds a delete record to the builder question section (class=any and ttl=0)
-func deleteRecord(builder *dnsmessage.Builder, record *Record) {
-    t := typeFromString(record.Type)
+func deleteRecord(builder *dnsmessage.Builder, record *Record) error {
+    t, err := typeFromString(record.Type)
+    if err != nil {
+        return err
+    }
+    name, err := dnsmessage.NewName(record.Name)
+    if err != nil {
+        return fmt.Errorf("invalid name %q: %s", record.Name, err)
+    }
     resourceHeader := dnsmessage.ResourceHeader {
-        Name: dnsmessage.MustNewName(record.Name),
+        Name: name,
         Type: t,
         Class: dnsmessage.ClassANY,
         TTL: 0,
     }
     resource := dnsmessage.UnknownResource{Type: t}
-    builder.UnknownResource(resourceHeader, resource)
+    return builder.UnknownResource(resourceHeader, resource)
 }
 
-// returns a dnsmessage.Type for a string
-func typeFromString(t string) (dnsmessage.Type) {
+// returns the dnsmessage.Type of an update type. other types are an error,
+// deleting them would send TypeALL and delete every rrset of the name.
+func typeFromString(t string) (dnsmessage.Type, error) {
     switch t {
     case "TypeA":
-        return dnsmessage.TypeA
+        return dnsmessage.TypeA, nil
+    case "TypeNS":
+        return dnsmessage.TypeNS, nil
+    case "TypePTR":
+        return dnsmessage.TypePTR, nil
     default:
-        return dnsmessage.TypeALL
+        return 0, fmt.Errorf("unsupported record type %q, updates support %s", t, strings.Join(UpdateTypes, ", "))
     }
 }
 
 // constructs and returns the tsig record data
 func newTsigResource(tsig *TSIG, mac []byte, id []byte) (dnsmessage.UnknownResource) {
-    tsigResource := dnsmessage.UnknownResource{Type: 250}
+    tsigResource := dnsmessage.UnknownResource{Type: typeTSIG}
     data := make([]byte, 0)
 
     // append algorithm name
-    tsigName := strings.Split(tsig.Algorithm, ".")
-    for _, label := range tsigName {
-        data = append(data, byte(len(label)))
-        data = append(data, label...)
-    }
+    data = append(data, nameToWire(canonicalName(tsig.Algorithm))...)
 
     // append time signed
     time := time.Now().Unix()    
-    log.Printf("time: %d", time)
     timeSigned := make([]byte, 8, 8)
     binary.BigEndian.PutUint64(timeSigned, uint64(time))
-    log.Printf("timeSigned: % x", timeSigned)
     data = append(data, timeSigned[2:]...)
 
     // append fudge
     fudge := uint16(300)
-    log.Printf("fudge: % x", fudge)
     data = binary.BigEndian.AppendUint16(data, fudge)
-    log.Printf("TSIG data: % x", data)
 
     // append mac length and sum
     data = binary.BigEndian.AppendUint16(data, uint16(len(mac)))
@@ -178,7 +278,6 @@ func newTsigResource(tsig *TSIG, mac []byte, id []byte) (dnsmessage.UnknownResou
 
     // append other len
     data = binary.BigEndian.AppendUint16(data, uint16(0))
-    log.Printf("TSIG data: % x", data)
 
     // set the tsig data and return the tsig resource
     tsigResource.Data = data
@@ -192,7 +291,7 @@ func GenerateMac(builder dnsmessage.Builder, tsig *TSIG) []byte {
     msg = append(msg, nameToWire(dnsmessage.MustNewName(tsig.Name).String())...) // name
     msg = binary.BigEndian.AppendUint16(msg, uint16(255)) // class
     msg = binary.BigEndian.AppendUint32(msg, uint32(0)) // ttl
-    msg = append(msg, nameToWire(dnsmessage.MustNewName(tsig.Algorithm).String())...) // algorithm name
+    msg = append(msg, nameToWire(canonicalName(tsig.Algorithm))...) // algorithm name
 
     // time signed
     time := time.Now().Unix()
@@ -203,16 +302,9 @@ func GenerateMac(builder dnsmessage.Builder, tsig *TSIG) []byte {
     msg = binary.BigEndian.AppendUint16(msg, uint16(300)) // fudge
     msg = binary.BigEndian.AppendUint16(msg, uint16(0)) // error
     msg = binary.BigEndian.AppendUint16(msg, uint16(0)) // other len
-    log.Printf("tsig digest: % x", msg)
 
     key, _ := base64.StdEncoding.DecodeString(tsig.Secret)
-    log.Printf("key: % x", key)
-    mac := hmac.New(sha256.New, key)
-    mac.Write(msg)
-	tsigMac := mac.Sum(nil)
-    log.Printf("mac: % x", tsigMac)
-
-    return tsigMac
+    return tsig.mac(key, msg)
 }
 
 // convert domain name to wire format
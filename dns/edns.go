@@ -0,0 +1,291 @@
+package dns
+
+import (
+    "log"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "golang.org/x/net/dns/dnsmessage"
+    "slices"
+    "strings"
+    "sync"
+)
+
+// edns option codes
+const (
+    ednsOptionCookie    = 10    // rfc 7873
+    ednsOptionPadding   = 12    // rfc 7830
+    ednsOptionEDE       = 15    // rfc 8914
+)
+
+// edns(0) settings for outgoing queries (rfc 6891). the cookie and padding
+// options depend on the upstream, so they are added when a query is sent.
+type EDNS struct {
+    UDPSize     int     // advertised udp payload size
+    DNSSECOK    bool    // set the DO bit to request dnssec records
+    Cookie      bool    // send a client cookie and echo the server cookie (rfc 7873)
+    Padding     int     // pad queries over tls, https and quic to a multiple of this many bytes (rfc 8467), 0 disables
+}
+
+// default edns settings: the dns flag day 2020 payload size and a client cookie
+var DefaultEDNS = &EDNS{
+    UDPSize:    1232,
+    Cookie:     true,
+}
+
+// secret client cookies are derived from, so each upstream gets its own
+// cookie (rfc 7873 6)
+var cookieSecret = func() []byte {
+    secret := make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+        log.Fatalf("error generating cookie secret: %s", err)
+    }
+    return secret
+}()
+
+// last server cookie received from each upstream, echoed in later queries
+var (
+    serverCookies   = make(map[string][]byte)
+    serverCookiesMu sync.Mutex
+)
+
+// returns the client cookie for an upstream
+func clientCookie(server string) []byte {
+    mac := hmac.New(sha256.New, cookieSecret)
+    mac.Write([]byte(server))
+    return mac.Sum(nil)[:8]
+}
+
+// keep the server cookie of an answer to a query carrying our client cookie
+func (c *Client) keepServerCookie(server string, answer []byte) {
+    if c.EDNS == nil || !c.EDNS.Cookie {
+        return
+    }
+    e, err := ParseEDNS(answer)
+    if err != nil || e == nil || len(e.ServerCookie) < 8 || len(e.ServerCookie) > 32 {
+        return
+    }
+    if !hmac.Equal(e.ClientCookie, clientCookie(server)) {
+        return
+    }
+    serverCookiesMu.Lock()
+    defer serverCookiesMu.Unlock()
+    serverCookies[server] = slices.Clone(e.ServerCookie)
+}
+
+// names of extended dns error info codes (rfc 8914)
+var extendedErrorNames = map[uint16]string{
+    0:  "Other Error",
+    1:  "Unsupported DNSKEY Algorithm",
+    2:  "Unsupported DS Digest Type",
+    3:  "Stale Answer",
+    4:  "Forged Answer",
+    5:  "DNSSEC Indeterminate",
+    6:  "DNSSEC Bogus",
+    7:  "Signature Expired",
+    8:  "Signature Not Yet Valid",
+    9:  "DNSKEY Missing",
+    10: "RRSIGs Missing",
+    11: "No Zone Key Bit Set",
+    12: "NSEC Missing",
+    13: "Cached Error",
+    14: "Not Ready",
+    15: "Blocked",
+    16: "Censored",
+    17: "Filtered",
+    18: "Prohibited",
+    19: "Stale NXDomain Answer",
+    20: "Not Authoritative",
+    21: "Not Supported",
+    22: "No Reachable Authority",
+    23: "Network Error",
+    24: "Invalid Data",
+}
+
+// extended dns error from an answer (rfc 8914)
+type ExtendedError struct {
+    Code    uint16  `json:"code"`
+    Name    string  `json:"name"`
+    Text    string  `json:"text,omitempty"`
+}
+
+func (e ExtendedError) String() string {
+    if e.Text == "" {
+        return fmt.Sprintf("%d (%s)", e.Code, e.Name)
+    }
+    return fmt.Sprintf("%d (%s): %s", e.Code, e.Name, e.Text)
+}
+
+// edns data from the opt record of an answer
+type EDNSAnswer struct {
+    ExtendedRCode   uint8           // upper 8 bits of the rcode
+    UDPSize         int
+    DNSSECOK        bool
+    ClientCookie    []byte
+    ServerCookie    []byte
+    ExtendedErrors  []ExtendedError
+}
+
+// append an opt record without options to a finished query, the options
+// for an upstream are added by withOptions when the query is sent
+func appendOPT(query []byte, e *EDNS) ([]byte, error) {
+    if e == nil {
+        return query, nil
+    }
+    if len(query) < 12 {
+        return nil, errors.New("query is shorter than a dns header")
+    }
+
+    // opt record: root name, type, udp payload size, extended rcode and flags
+    ttl := uint32(0)
+    if e.DNSSECOK {
+        ttl |= 0x8000
+    }
+    opt := []byte{0}
+    opt = binary.BigEndian.AppendUint16(opt, uint16(dnsmessage.TypeOPT))
+    opt = binary.BigEndian.AppendUint16(opt, uint16(max(e.UDPSize, 512)))
+    opt = binary.BigEndian.AppendUint32(opt, ttl)
+    opt = binary.BigEndian.AppendUint16(opt, 0)
+
+    // add record and bump the additional count
+    msg := append(append(make([]byte, 0, len(query) + len(opt)), query...), opt...)
+    binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:]) + 1)
+    return msg, nil
+}
+
+// returns the query with the cookie and padding options for server added to
+// its opt record. queries without an empty opt record as their last record,
+// such as signed updates, are returned unchanged.
+func (c *Client) withOptions(query []byte, server string) []byte {
+    e := c.EDNS
+    if e == nil || !e.Cookie && e.Padding <= 0 || !endsWithOPT(query) {
+        return query
+    }
+
+    options := make([]byte, 0)
+    if e.Cookie {
+        serverCookiesMu.Lock()
+        cookie := append(clientCookie(server), serverCookies[server]...)
+        serverCookiesMu.Unlock()
+        options = binary.BigEndian.AppendUint16(options, ednsOptionCookie)
+        options = binary.BigEndian.AppendUint16(options, uint16(len(cookie)))
+        options = append(options, cookie...)
+    }
+
+    // padding only hides the query length from observers of encrypted
+    // transports, plain tcp is padded for nothing
+    if e.Padding > 0 && encrypted(server) {
+        length := len(query) + len(options) + 4
+        padding := (e.Padding - length % e.Padding) % e.Padding
+        options = binary.BigEndian.AppendUint16(options, ednsOptionPadding)
+        options = binary.BigEndian.AppendUint16(options, uint16(padding))
+        options = append(options, make([]byte, padding)...)
+    }
+
+    // replace the empty rdata length with the options
+    msg := make([]byte, 0, len(query) + len(options))
+    msg = append(msg, query[:len(query) - 2]...)
+    msg = binary.BigEndian.AppendUint16(msg, uint16(len(options)))
+    return append(msg, options...)
+}
+
+// reports whether the last record of a query is an opt record without
+// options, as added by appendOPT
+func endsWithOPT(query []byte) bool {
+    var p dnsmessage.Parser
+    if _, err := p.Start(query); err != nil {
+        return false
+    }
+    if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+        return false
+    }
+    var last dnsmessage.ResourceHeader
+    for {
+        rh, err := p.AdditionalHeader()
+        if err == dnsmessage.ErrSectionDone {
+            break
+        }
+        if err != nil {
+            return false
+        }
+        last = rh
+        if err := p.SkipAdditional(); err != nil {
+            return false
+        }
+    }
+    return last.Type == dnsmessage.TypeOPT && last.Name.String() == "." && last.Length == 0 && len(query) >= 11 && query[len(query) - 11] == 0
+}
+
+// reports whether queries to server are encrypted
+func encrypted(server string) bool {
+    return strings.HasPrefix(server, tlsScheme) || strings.HasPrefix(server, dohScheme) || strings.HasPrefix(server, doqScheme)
+}
+
+// parse the opt record of an answer, returns nil if the answer has none
+func ParseEDNS(answer []byte) (*EDNSAnswer, error) {
+    var p dnsmessage.Parser
+    if _, err := p.Start(answer); err != nil {
+        return nil, err
+    }
+    if err := p.SkipAllQuestions(); err != nil {
+        return nil, err
+    }
+    if err := p.SkipAllAnswers(); err != nil {
+        return nil, err
+    }
+    if err := p.SkipAllAuthorities(); err != nil {
+        return nil, err
+    }
+    for {
+        h, err := p.AdditionalHeader()
+        if err == dnsmessage.ErrSectionDone {
+            return nil, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        if h.Type != dnsmessage.TypeOPT {
+            if err := p.SkipAdditional(); err != nil {
+                return nil, err
+            }
+            continue
+        }
+
+        opt, err := p.OPTResource()
+        if err != nil {
+            return nil, err
+        }
+        e := &EDNSAnswer{
+            ExtendedRCode:  uint8(h.TTL >> 24),
+            UDPSize:        int(h.Class),
+            DNSSECOK:       h.DNSSECAllowed(),
+        }
+        for _, option := range opt.Options {
+            switch option.Code {
+            case ednsOptionCookie:
+                if len(option.Data) >= 8 {
+                    e.ClientCookie = option.Data[:8]
+                    e.ServerCookie = option.Data[8:]
+                }
+            case ednsOptionEDE:
+                if len(option.Data) < 2 {
+                    continue
+                }
+                code := binary.BigEndian.Uint16(option.Data)
+                name, ok := extendedErrorNames[code]
+                if !ok {
+                    name = "Unknown"
+                }
+                e.ExtendedErrors = append(e.ExtendedErrors, ExtendedError{
+                    Code:   code,
+                    Name:   name,
+                    Text:   strings.TrimRight(string(option.Data[2:]), "\x00"),
+                })
+            }
+        }
+        return e, nil
+    }
+}
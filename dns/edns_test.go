@@ -0,0 +1,135 @@
+package dns
+
+import (
+    "bytes"
+    "context"
+    "testing"
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+// returns the options of the opt record of a message
+func optOptions(t *testing.T, msg []byte) map[uint16][]byte {
+    t.Helper()
+    var m dnsmessage.Message
+    if err := m.Unpack(msg); err != nil {
+        t.Fatal(err)
+    }
+    for _, rr := range m.Additionals {
+        if opt, ok := rr.Body.(*dnsmessage.OPTResource); ok {
+            options := make(map[uint16][]byte)
+            for _, option := range opt.Options {
+                options[option.Code] = option.Data
+            }
+            return options
+        }
+    }
+    t.Fatal("message has no opt record")
+    return nil
+}
+
+// returns an answer carrying cookie in its opt record
+func cookieAnswer(t *testing.T, cookie []byte) []byte {
+    t.Helper()
+    b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+    b.StartAdditionals()
+    var opt dnsmessage.ResourceHeader
+    opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+    b.OPTResource(opt, dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: ednsOptionCookie, Data: cookie}}})
+    answer, err := b.Finish()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return answer
+}
+
+func TestClientCookiePerServer(t *testing.T) {
+    a, b := clientCookie("192.0.2.1:53"), clientCookie("192.0.2.2:53")
+    if len(a) != 8 || len(b) != 8 {
+        t.Fatalf("got cookies of %d and %d bytes, want 8", len(a), len(b))
+    }
+    if bytes.Equal(a, b) {
+        t.Fatal("two servers got the same client cookie")
+    }
+    if !bytes.Equal(a, clientCookie("192.0.2.1:53")) {
+        t.Fatal("client cookie changed for the same server")
+    }
+}
+
+func TestWithOptionsPadding(t *testing.T) {
+    tests := []struct {
+        server  string
+        padded  bool
+    }{
+        {server: "192.0.2.1:53"},
+        {server: "tls://192.0.2.1", padded: true},
+        {server: "https://dns.example.com/dns-query", padded: true},
+        {server: "quic://192.0.2.1", padded: true},
+    }
+    c := &Client{EDNS: &EDNS{UDPSize: 1232, Cookie: true, Padding: 128}}
+    query, jerr := NewLookupQuery(context.Background(), "example.com.", dnsmessage.TypeSOA, c.EDNS)
+    if jerr != nil {
+        t.Fatal(*jerr.Message)
+    }
+    for _, tt := range tests {
+        t.Run(tt.server, func(t *testing.T) {
+            sent := c.withOptions(query, tt.server)
+            options := optOptions(t, sent)
+            if !bytes.Equal(options[ednsOptionCookie], clientCookie(tt.server)) {
+                t.Errorf("got cookie %x, want %x", options[ednsOptionCookie], clientCookie(tt.server))
+            }
+            _, padded := options[ednsOptionPadding]
+            if padded != tt.padded {
+                t.Errorf("got padding %v, want %v", padded, tt.padded)
+            }
+            if tt.padded && len(sent) % 128 != 0 {
+                t.Errorf("got padded length %d, want a multiple of 128", len(sent))
+            }
+        })
+    }
+
+    // the built query itself is left unchanged for the next upstream
+    if options := optOptions(t, query); len(options) != 0 {
+        t.Fatalf("query was changed to carry options %v", options)
+    }
+}
+
+func TestServerCookieEcho(t *testing.T) {
+    server := "192.0.2.53:53"
+    t.Cleanup(func() {
+        serverCookiesMu.Lock()
+        delete(serverCookies, server)
+        serverCookiesMu.Unlock()
+    })
+    c := &Client{EDNS: &EDNS{UDPSize: 1232, Cookie: true}}
+    query, jerr := NewLookupQuery(context.Background(), "example.com.", dnsmessage.TypeSOA, c.EDNS)
+    if jerr != nil {
+        t.Fatal(*jerr.Message)
+    }
+    serverCookie := []byte("0123456789abcdef")
+
+    // a server cookie answering another client cookie is ignored
+    c.keepServerCookie(server, cookieAnswer(t, append(clientCookie("192.0.2.1:53"), serverCookie...)))
+    if got := optOptions(t, c.withOptions(query, server))[ednsOptionCookie]; !bytes.Equal(got, clientCookie(server)) {
+        t.Fatalf("got cookie %x after a mismatched answer, want only the client cookie", got)
+    }
+
+    // the server cookie is echoed after an answer to our client cookie
+    c.keepServerCookie(server, cookieAnswer(t, append(clientCookie(server), serverCookie...)))
+    want := append(clientCookie(server), serverCookie...)
+    if got := optOptions(t, c.withOptions(query, server))[ednsOptionCookie]; !bytes.Equal(got, want) {
+        t.Fatalf("got cookie %x, want %x", got, want)
+    }
+}
+
+func TestWithOptionsSignedUpdate(t *testing.T) {
+    c := &Client{EDNS: &EDNS{UDPSize: 1232, Cookie: true, Padding: 128}}
+    key := &TSIG{Name: "key.", Algorithm: "hmac-sha256.", Secret: "c2VjcmV0"}
+    record := &Record{Name: "host.example.com.", Type: "TypeA", TTL: 300, Data: map[string]any{"address": "192.0.2.1"}}
+    query, err := NewUpdateQuery(context.Background(), "example.com.", OpAdd, []*Record{record}, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if sent := c.withOptions(query, "tls://192.0.2.1"); !bytes.Equal(sent, query) {
+        t.Fatal("signed update was changed")
+    }
+}
@@ -0,0 +1,165 @@
+package dns
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// tsig keys for signing updates. the first key of a zone is the primary
+// signing key, the rest are older keys the server may still accept while a
+// rotation is in progress.
+type TSIGKeySet struct {
+    Default []TSIG              `json:"default"`   // keys for zones without their own
+    Zones   map[string][]TSIG   `json:"zones"`     // keys by zone name
+}
+
+// the key used for the last successful update on a zone
+type TSIGKeyUse struct {
+    Name        string      `json:"name"`
+    Algorithm   string      `json:"algorithm"`
+    Primary     bool        `json:"primary"`   // false when an older key was accepted
+    Time        time.Time   `json:"time"`
+}
+
+// load tsig keys from a file, either a single key object or a key set
+func LoadTSIGKeys(file string) (*TSIGKeySet, error) {
+    data, err := os.ReadFile(file)
+    if err != nil {
+        return nil, fmt.Errorf("error reading key file: %s", err)
+    }
+
+    // a single key applies to every zone
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(data, &fields); err != nil {
+        return nil, fmt.Errorf("error unmarshalling key file: %s", err)
+    }
+    set := &TSIGKeySet{}
+    if _, ok := fields["secret"]; ok {
+        var key TSIG
+        if err := json.Unmarshal(data, &key); err != nil {
+            return nil, fmt.Errorf("error unmarshalling key file: %s", err)
+        }
+        set.Default = []TSIG{key}
+    } else if err := json.Unmarshal(data, set); err != nil {
+        return nil, fmt.Errorf("error unmarshalling key file: %s", err)
+    }
+
+    // zone, key and algorithm names are used in canonical form
+    zones := make(map[string][]TSIG, len(set.Zones))
+    for zone, keys := range set.Zones {
+        zones[canonicalName(strings.ToLower(zone))] = canonicalKeys(keys)
+    }
+    set.Zones = zones
+    set.Default = canonicalKeys(set.Default)
+
+    if err := set.Validate(); err != nil {
+        return nil, err
+    }
+    return set, nil
+}
+
+// returns the keys with lowercase key and algorithm names ending in a dot,
+// the form they are signed with
+func canonicalKeys(keys []TSIG) []TSIG {
+    for i := range keys {
+        keys[i].Name = canonicalName(strings.ToLower(keys[i].Name))
+        keys[i].Algorithm = canonicalName(strings.ToLower(keys[i].Algorithm))
+    }
+    return keys
+}
+
+// check every key in the set, and that each zone has a primary key
+func (s *TSIGKeySet) Validate() error {
+    if len(s.Default) == 0 && len(s.Zones) == 0 {
+        return errors.New("no keys found")
+    }
+    for _, key := range s.Default {
+        if err := key.Validate(); err != nil {
+            return fmt.Errorf("default keys: %s", err)
+        }
+    }
+    for zone, keys := range s.Zones {
+        if len(keys) == 0 {
+            return fmt.Errorf("zone %s has no keys", zone)
+        }
+        for _, key := range keys {
+            if err := key.Validate(); err != nil {
+                return fmt.Errorf("zone %s: %s", zone, err)
+            }
+        }
+    }
+    return nil
+}
+
+// tsig key set that can be replaced while updates are signed with it
+type TSIGKeyring struct {
+    mu          sync.RWMutex
+    keys        *TSIGKeySet
+    lastUsed    map[string]TSIGKeyUse
+}
+
+// create a keyring from a key set
+func NewTSIGKeyring(keys *TSIGKeySet) *TSIGKeyring {
+    return &TSIGKeyring{
+        keys:       keys,
+        lastUsed:   make(map[string]TSIGKeyUse),
+    }
+}
+
+// replace the keys, updates already being signed finish with the old keys
+func (k *TSIGKeyring) Set(keys *TSIGKeySet) {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    k.keys = keys
+}
+
+// returns the keys for a zone, primary first
+func (k *TSIGKeyring) Keys(zone string) []TSIG {
+    k.mu.RLock()
+    defer k.mu.RUnlock()
+    if keys, ok := k.keys.Zones[canonicalName(strings.ToLower(zone))]; ok {
+        return keys
+    }
+    return k.keys.Default
+}
+
+// returns the zones that have their own keys
+func (k *TSIGKeyring) Zones() []string {
+    k.mu.RLock()
+    defer k.mu.RUnlock()
+    zones := make([]string, 0, len(k.keys.Zones))
+    for zone := range k.keys.Zones {
+        zones = append(zones, zone)
+    }
+    sort.Strings(zones)
+    return zones
+}
+
+// record a key as used for a successful update on a zone
+func (k *TSIGKeyring) MarkUsed(zone string, key TSIG, primary bool) {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    k.lastUsed[canonicalName(strings.ToLower(zone))] = TSIGKeyUse{
+        Name:       key.Name,
+        Algorithm:  key.Algorithm,
+        Primary:    primary,
+        Time:       time.Now(),
+    }
+}
+
+// returns the key used for the last successful update on each zone
+func (k *TSIGKeyring) LastUsed() map[string]TSIGKeyUse {
+    k.mu.RLock()
+    defer k.mu.RUnlock()
+    lastUsed := make(map[string]TSIGKeyUse, len(k.lastUsed))
+    for zone, use := range k.lastUsed {
+        lastUsed[zone] = use
+    }
+    return lastUsed
+}
@@ -0,0 +1,110 @@
+package dns
+
+import (
+    "bytes"
+    "context"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+func TestLoadTSIGKeysCanonical(t *testing.T) {
+    tests := []struct {
+        name    string
+        file    string
+        zone    string
+    }{
+        {
+            name:   "single key",
+            file:   `{"name": "Update-Key", "algorithm": "HMAC-SHA256", "secret": "c2VjcmV0"}`,
+            zone:   "example.com.",
+        },
+        {
+            name:   "key set",
+            file:   `{"zones": {"Example.com": [{"name": "update-key", "algorithm": "hmac-sha256", "secret": "c2VjcmV0"}]}}`,
+            zone:   "example.com.",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            file := filepath.Join(t.TempDir(), "tsig.json")
+            if err := os.WriteFile(file, []byte(tt.file), 0600); err != nil {
+                t.Fatal(err)
+            }
+            set, err := LoadTSIGKeys(file)
+            if err != nil {
+                t.Fatal(err)
+            }
+            keys := NewTSIGKeyring(set).Keys(tt.zone)
+            if len(keys) != 1 {
+                t.Fatalf("got %d keys for %s, want 1", len(keys), tt.zone)
+            }
+            key := keys[0]
+            if key.Name != "update-key." || key.Algorithm != "hmac-sha256." {
+                t.Fatalf("got key %s with algorithm %s, want update-key. and hmac-sha256.", key.Name, key.Algorithm)
+            }
+            if err := key.Validate(); err != nil {
+                t.Fatal(err)
+            }
+
+            // the update is signed with the loaded key
+            record := &Record{Name: "host.example.com.", Type: "TypeA", TTL: 300, Data: map[string]any{"address": "192.0.2.1"}}
+            query, err := NewUpdateQuery(context.Background(), tt.zone, OpAdd, []*Record{record}, &key)
+            if err != nil {
+                t.Fatal(err)
+            }
+            var p dnsmessage.Parser
+            if _, err := p.Start(query); err != nil {
+                t.Fatal(err)
+            }
+            p.SkipAllQuestions()
+            p.SkipAllAnswers()
+            p.SkipAllAuthorities()
+            additionals, err := p.AllAdditionals()
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(additionals) != 1 || additionals[0].Header.Type != typeTSIG || additionals[0].Header.Name.String() != "update-key." {
+                t.Fatalf("got additionals %+v, want one tsig record", additionals)
+            }
+            data := additionals[0].Body.(*dnsmessage.UnknownResource).Data
+            if !bytes.HasPrefix(data, nameToWire("hmac-sha256.")) {
+                t.Fatalf("got tsig data %x, want the algorithm name first", data)
+            }
+        })
+    }
+}
+
+func TestTSIGValidate(t *testing.T) {
+    tests := []struct {
+        name    string
+        key     TSIG
+        err     string
+    }{
+        {name: "valid", key: TSIG{Name: "key.", Algorithm: "hmac-sha256.", Secret: "c2VjcmV0"}},
+        {name: "name without dot", key: TSIG{Name: "key", Algorithm: "hmac-sha256.", Secret: "c2VjcmV0"}, err: "invalid key name"},
+        {name: "uppercase name", key: TSIG{Name: "Key.", Algorithm: "hmac-sha256.", Secret: "c2VjcmV0"}, err: "invalid key name"},
+        {name: "root name", key: TSIG{Name: ".", Algorithm: "hmac-sha256.", Secret: "c2VjcmV0"}, err: "invalid key name"},
+        {name: "algorithm without dot", key: TSIG{Name: "key.", Algorithm: "hmac-sha256", Secret: "c2VjcmV0"}, err: "unsupported algorithm"},
+        {name: "uppercase algorithm", key: TSIG{Name: "key.", Algorithm: "HMAC-SHA256.", Secret: "c2VjcmV0"}, err: "unsupported algorithm"},
+        {name: "unknown algorithm", key: TSIG{Name: "key.", Algorithm: "hmac-md5.sig-alg.reg.int.", Secret: "c2VjcmV0"}, err: "unsupported algorithm"},
+        {name: "bad secret", key: TSIG{Name: "key.", Algorithm: "hmac-sha256.", Secret: "not base64!"}, err: "invalid secret"},
+        {name: "empty secret", key: TSIG{Name: "key.", Algorithm: "hmac-sha256."}, err: "invalid secret"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            err := tt.key.Validate()
+            if tt.err == "" {
+                if err != nil {
+                    t.Fatal(err)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.err) {
+                t.Fatalf("got error %v, want %q", err, tt.err)
+            }
+        })
+    }
+}
@@ -0,0 +1,31 @@
+package dns
+
+import (
+    "encoding/hex"
+    "log/slog"
+    "sync/atomic"
+)
+
+// logger for the dns package, slog.Default() unless set with SetLogger
+var customLogger atomic.Pointer[slog.Logger]
+
+// set the logger used by the dns package. wire dumps are logged at debug
+// level, secrets are never logged.
+func SetLogger(l *slog.Logger) {
+    customLogger.Store(l)
+}
+
+// returns the current logger
+func logger() *slog.Logger {
+    if l := customLogger.Load(); l != nil {
+        return l
+    }
+    return slog.Default()
+}
+
+// bytes logged as hex, only formatted when the log level is enabled
+type wire []byte
+
+func (w wire) LogValue() slog.Value {
+    return slog.StringValue(hex.EncodeToString(w))
+}
@@ -0,0 +1,84 @@
+package dns
+
+import (
+    "context"
+    "encoding/binary"
+    "golang.org/x/net/dns/dnsmessage"
+    "github.com/samchelini/dns-manager/jsend"
+    "net/http"
+    "time"
+)
+
+// build a recursive query for a single name and type, with an opt record unless edns is nil
+func NewLookupQuery(ctx context.Context, name string, t dnsmessage.Type, edns *EDNS) ([]byte, *jsend.Response) {
+    qName, err := dnsmessage.NewName(name)
+    if err != nil {
+        logger().WarnContext(ctx, "error parsing name", "name", name, "error", err)
+        return nil, jsend.Fail(name, err.Error(), nil, http.StatusBadRequest)
+    }
+
+    buf := make([]byte, 0)
+    b := dnsmessage.NewBuilder(buf, dnsmessage.Header{
+        ID: binary.BigEndian.Uint16(generateId()),
+        Response: false,
+        RecursionDesired: true,
+    })
+    b.EnableCompression()
+
+    err = b.StartQuestions()
+    if err != nil {
+        logger().ErrorContext(ctx, "error starting questions", "error", err)
+        return nil, jsend.Error(name, err.Error(), nil, http.StatusInternalServerError)
+    }
+
+    err = b.Question(
+        dnsmessage.Question{
+            Name: qName,
+            Type: t,
+            Class: dnsmessage.ClassINET,
+        },
+    )
+    if err != nil {
+        logger().ErrorContext(ctx, "error adding question", "error", err)
+        return nil, jsend.Fail(name, err.Error(), nil, http.StatusBadRequest)
+    }
+
+    query, err := b.Finish()
+    if err != nil {
+        logger().ErrorContext(ctx, "error building message", "error", err)
+        return nil, jsend.Error(name, err.Error(), nil, http.StatusInternalServerError)
+    }
+    query, err = appendOPT(query, edns)
+    if err != nil {
+        logger().ErrorContext(ctx, "error adding opt record", "error", err)
+        return nil, jsend.Error(name, err.Error(), nil, http.StatusInternalServerError)
+    }
+
+    return query, nil
+}
+
+// look up a name on nameserver and return the parsed answer message
+func (c *Client) Lookup(ctx context.Context, name string, t dnsmessage.Type, nameserver string) (*dnsmessage.Message, *jsend.Response) {
+    query, jerr := NewLookupQuery(ctx, name, t, c.EDNS)
+    if jerr != nil {
+        return nil, jerr
+    }
+    start := time.Now()
+    answer, err := c.exchange(ctx, query, nameserver)
+    observeQuery(ctx, query, nameserver, [][]byte{answer}, err, start)
+    if err != nil {
+        return nil, jsend.Error(nameserver, err.Error(), nil, http.StatusBadGateway)
+    }
+
+    var msg dnsmessage.Message
+    err = msg.Unpack(answer)
+    if err != nil {
+        logger().WarnContext(ctx, "error parsing answer", "server", nameserver, "error", err)
+        return nil, jsend.Error(nameserver, err.Error(), nil, http.StatusInternalServerError)
+    }
+    if jerr := rCodeResponse(ctx, answer, nameserver); jerr != nil {
+        return nil, jerr
+    }
+
+    return &msg, nil
+}
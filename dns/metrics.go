@@ -0,0 +1,198 @@
+package dns
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "sync/atomic"
+    "time"
+    "golang.org/x/net/dns/dnsmessage"
+    "github.com/samchelini/dns-manager/metrics"
+)
+
+// upstream metrics, zone is the question name of the query when it is a
+// known zone
+var (
+    dnsQueries = metrics.NewCounterVec("dns_queries_total", "DNS queries sent to upstreams by operation, zone, server and rcode.", "op", "zone", "server", "rcode")
+    dnsQueryDuration = metrics.NewHistogramVec("dns_query_duration_seconds", "Latency of DNS queries and zone transfers.", metrics.DefaultBuckets, "op", "zone", "server")
+    dnsSentBytes = metrics.NewCounterVec("dns_sent_bytes_total", "Bytes of DNS messages sent to upstreams.", "op", "server")
+    dnsReceivedBytes = metrics.NewCounterVec("dns_received_bytes_total", "Bytes of DNS messages received from upstreams.", "op", "server")
+    dnsTSIGFailures = metrics.NewCounterVec("dns_tsig_failures_total", "Signed updates rejected by upstreams, by TSIG error.", "zone", "server", "error")
+    dnsZoneRecords = metrics.NewGaugeVec("dns_zone_records", "Records in the last zone transfer.", "zone")
+    dnsZoneLastTransfer = metrics.NewGaugeVec("dns_zone_last_transfer_timestamp_seconds", "Unix time of the last successful zone transfer.", "zone")
+    dnsZoneSerial = metrics.NewGaugeVec("dns_zone_soa_serial", "SOA serial of the last successful zone transfer.", "zone")
+)
+
+// zones labelled by name in metrics, other names are labelled "other" since
+// they come from callers and would create unbounded series
+var metricZones atomic.Pointer[map[string]bool]
+
+// set the zones labelled by name in metrics
+func SetMetricZones(zones []string) {
+    set := make(map[string]bool, len(zones))
+    for _, zone := range zones {
+        set[canonicalName(strings.ToLower(zone))] = true
+    }
+    metricZones.Store(&set)
+}
+
+// returns the zone label for a question name
+func metricZone(name string) string {
+    if set := metricZones.Load(); set != nil && (*set)[name] {
+        return name
+    }
+    return "other"
+}
+
+// tsig error codes (rfc 8945)
+var tsigErrorName = map[uint16]string{
+    16: "BADSIG",
+    17: "BADKEY",
+    18: "BADTIME",
+    22: "BADTRUNC",
+}
+
+// returns the operation and zone of a query for metric labels
+func queryLabels(query []byte) (string, string) {
+    var p dnsmessage.Parser
+    h, err := p.Start(query)
+    if err != nil {
+        return "unknown", ""
+    }
+    q, err := p.Question()
+    if err != nil {
+        return "unknown", ""
+    }
+    zone := metricZone(strings.ToLower(q.Name.String()))
+    switch {
+    case h.OpCode == opCodeUpdate:
+        return "update", zone
+    case q.Type == dnsmessage.TypeAXFR:
+        return "axfr", zone
+    }
+    return "lookup", zone
+}
+
+// record metrics for one attempt of a query on server
+func observeQuery(ctx context.Context, query []byte, server string, answers [][]byte, err error, start time.Time) {
+    op, zone := queryLabels(query)
+    dnsQueryDuration.With(op, zone, server).Observe(time.Since(start).Seconds())
+    dnsSentBytes.With(op, server).Add(float64(len(query)))
+    if err != nil {
+        rCode := "error"
+        var netErr net.Error
+        if errors.As(err, &netErr) && netErr.Timeout() {
+            rCode = "timeout"
+        }
+        dnsQueries.With(op, zone, server, rCode).Inc()
+        return
+    }
+    for _, answer := range answers {
+        dnsReceivedBytes.With(op, server).Add(float64(len(answer)))
+    }
+
+    rCode, _ := answerRCode(ctx, answers[0])
+    name, ok := rCodeName[rCode]
+    if !ok {
+        name = fmt.Sprintf("RCODE%d", rCode)
+    }
+    dnsQueries.With(op, zone, server, name).Inc()
+
+    switch {
+    case op == "update" && rCode == RCodeNotAuthorized:
+        name := "NOTAUTH"
+        if code := tsigError(answers[0]); code != 0 {
+            name = tsigErrorName[code]
+            if name == "" {
+                name = fmt.Sprintf("TSIG%d", code)
+            }
+        }
+        dnsTSIGFailures.With(zone, server, name).Inc()
+    case op == "axfr" && rCode == dnsmessage.RCodeSuccess && zone != "other":
+        observeTransfer(zone, answers)
+    }
+}
+
+// record the record count and soa serial of a successful zone transfer
+func observeTransfer(zone string, answers [][]byte) {
+    records := 0
+    var serial uint32
+    for i, answer := range answers {
+        var p dnsmessage.Parser
+        if _, err := p.Start(answer); err != nil || p.SkipAllQuestions() != nil {
+            return
+        }
+        for {
+            rh, err := p.AnswerHeader()
+            if err == dnsmessage.ErrSectionDone {
+                break
+            }
+            if err != nil {
+                return
+            }
+            records++
+            if i == 0 && records == 1 && rh.Type == dnsmessage.TypeSOA {
+                soa, err := p.SOAResource()
+                if err != nil {
+                    return
+                }
+                serial = soa.Serial
+                continue
+            }
+            if err := p.SkipAnswer(); err != nil {
+                return
+            }
+        }
+    }
+
+    // the soa record is sent at the start and the end of a transfer
+    dnsZoneRecords.With(zone).Set(float64(max(records - 1, 0)))
+    dnsZoneSerial.With(zone).Set(float64(serial))
+    dnsZoneLastTransfer.With(zone).Set(float64(time.Now().Unix()))
+}
+
+// returns the error field of the tsig record of an answer, 0 if it has none
+func tsigError(answer []byte) uint16 {
+    var p dnsmessage.Parser
+    if _, err := p.Start(answer); err != nil {
+        return 0
+    }
+    if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+        return 0
+    }
+    for {
+        h, err := p.AdditionalHeader()
+        if err != nil {
+            return 0
+        }
+        if h.Type != typeTSIG {
+            if p.SkipAdditional() != nil {
+                return 0
+            }
+            continue
+        }
+        r, err := p.UnknownResource()
+        if err != nil {
+            return 0
+        }
+
+        // algorithm name, time signed, fudge, mac, original id, error
+        data := r.Data
+        i := 0
+        for i < len(data) && data[i] != 0 {
+            i += int(data[i]) + 1
+        }
+        i += 1 + 6 + 2
+        if i + 2 > len(data) {
+            return 0
+        }
+        i += 2 + int(binary.BigEndian.Uint16(data[i:])) + 2
+        if i + 2 > len(data) {
+            return 0
+        }
+        return binary.BigEndian.Uint16(data[i:])
+    }
+}
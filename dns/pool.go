@@ -0,0 +1,314 @@
+package dns
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+// error returned to queries still waiting when a pooled connection is closed
+var errConnClosed = errors.New("connection closed before answer was received")
+
+// persistent tcp or tls connections to one upstream. queries are pipelined on the
+// connections and answers are matched to queries by message id (rfc 7766)
+type connPool struct {
+    client  *Client
+    address string
+    mu      sync.Mutex
+    conns   []*pooledConn
+    dialing int
+    dialed  *sync.Cond  // signalled when a dial finishes
+}
+
+// a pooled connection and the queries waiting for an answer on it
+type pooledConn struct {
+    pool        *connPool
+    conn        net.Conn
+    writeMu     sync.Mutex
+    mu          sync.Mutex
+    pending     map[uint16]pendingQuery
+    closed      bool
+    lastUsed    time.Time
+    idle        *time.Timer
+}
+
+// a query waiting for its answer on a pooled connection
+type pendingQuery struct {
+    ctx     context.Context
+    answer  chan []byte
+}
+
+// returns the connection pool for an upstream
+func (c *Client) pool(address string) *connPool {
+    c.poolsMu.Lock()
+    defer c.poolsMu.Unlock()
+    if c.pools == nil {
+        c.pools = make(map[string]*connPool)
+    }
+    p, ok := c.pools[address]
+    if !ok {
+        p = &connPool{client: c, address: address}
+        p.dialed = sync.NewCond(&p.mu)
+        c.pools[address] = p
+    }
+    return p
+}
+
+// close all pooled and cached connections, failing queries still waiting on them
+func (c *Client) Close() {
+    c.doqMu.Lock()
+    dials := c.doqConns
+    c.doqConns = nil
+    c.doqMu.Unlock()
+    for _, d := range dials {
+        // dials still in progress close their own connection
+        select {
+        case <-d.done:
+            if d.err == nil {
+                d.conn.CloseWithError(doqNoError, "")
+            }
+        default:
+        }
+    }
+
+    c.poolsMu.Lock()
+    pools := c.pools
+    c.pools = nil
+    c.poolsMu.Unlock()
+    for _, p := range pools {
+        p.mu.Lock()
+        conns := p.conns
+        p.mu.Unlock()
+        for _, pc := range conns {
+            pc.close(errConnClosed)
+        }
+    }
+}
+
+// send query on a pooled connection and wait for the answer with the same id
+func (p *connPool) exchange(ctx context.Context, query []byte) ([]byte, error) {
+    c := p.client
+    id := binary.BigEndian.Uint16(query)
+
+    // get a connection with the query registered on it
+    pc, answer, err := p.acquire(ctx, id)
+    if err != nil {
+        logger().WarnContext(ctx, "error creating connection", "server", p.address, "error", err)
+        return nil, &exchangeError{server: p.address, sent: false, err: err}
+    }
+    if pc == nil {
+        // every connection is waiting on a query with the same id
+        answers, err := c.roundTrip(ctx, query, p.address, false)
+        if err != nil {
+            return nil, err
+        }
+        return answers[0], nil
+    }
+
+    // send query
+    pc.writeMu.Lock()
+    pc.conn.SetWriteDeadline(c.readDeadline(ctx))
+    err = writeMessage(ctx, pc.conn, query)
+    pc.writeMu.Unlock()
+    if err != nil {
+        logger().WarnContext(ctx, "error sending query", "server", p.address, "error", err)
+        pc.close(err)
+        return nil, &exchangeError{server: p.address, sent: true, err: contextError(ctx, err)}
+    }
+
+    // wait for the answer
+    var timeout <-chan time.Time
+    if c.ReadTimeout > 0 {
+        timer := time.NewTimer(c.ReadTimeout)
+        defer timer.Stop()
+        timeout = timer.C
+    }
+    select {
+    case msg, ok := <-answer:
+        if !ok {
+            return nil, &exchangeError{server: p.address, sent: true, err: errConnClosed}
+        }
+        logger().DebugContext(ctx, "received message", "server", p.address, "length", len(msg), "wire", wire(msg))
+        return msg, nil
+    case <-ctx.Done():
+        pc.cancel(id)
+        return nil, &exchangeError{server: p.address, sent: true, err: ctx.Err()}
+    case <-timeout:
+        pc.cancel(id)
+        return nil, &exchangeError{server: p.address, sent: true, err: os.ErrDeadlineExceeded}
+    }
+}
+
+// pick the least busy connection without a query using id, dialing a new one
+// while all connections are busy and the pool is not full. returns a nil
+// connection when every connection already has a query with the same id.
+func (p *connPool) acquire(ctx context.Context, id uint16) (*pooledConn, chan []byte, error) {
+    p.mu.Lock()
+    best, bestPending := p.leastBusy(id)
+    for best == nil && p.dialing > 0 && len(p.conns) + p.dialing >= p.client.MaxConns {
+        p.dialed.Wait()
+        best, bestPending = p.leastBusy(id)
+    }
+    full := len(p.conns) + p.dialing >= p.client.MaxConns
+    if best != nil && (bestPending == 0 || full) {
+        p.mu.Unlock()
+        if answer, ok := best.register(ctx, id); ok {
+            return best, answer, nil
+        }
+        return p.acquire(ctx, id)
+    }
+    if full {
+        p.mu.Unlock()
+        return nil, nil, nil
+    }
+    p.dialing++
+    p.mu.Unlock()
+
+    // dial a new connection
+    logger().DebugContext(ctx, "opening pooled connection", "server", p.address)
+    conn, err := p.client.dial(ctx, p.address)
+    p.mu.Lock()
+    p.dialing--
+    p.dialed.Broadcast()
+    if err != nil {
+        p.mu.Unlock()
+        return nil, nil, err
+    }
+    pc := &pooledConn{
+        pool:       p,
+        conn:       conn,
+        pending:    make(map[uint16]pendingQuery),
+        lastUsed:   time.Now(),
+    }
+    if p.client.IdleTimeout > 0 {
+        pc.idle = time.AfterFunc(p.client.IdleTimeout, pc.closeIfIdle)
+    }
+    answer, _ := pc.register(ctx, id)
+    p.conns = append(p.conns, pc)
+    p.mu.Unlock()
+
+    go pc.readLoop()
+    return pc, answer, nil
+}
+
+// returns the open connection with the fewest queries waiting that has no
+// query using id, and its number of waiting queries. p.mu must be held.
+func (p *connPool) leastBusy(id uint16) (*pooledConn, int) {
+    var best *pooledConn
+    bestPending := 0
+    for _, pc := range p.conns {
+        pc.mu.Lock()
+        _, inUse := pc.pending[id]
+        pending := len(pc.pending)
+        closed := pc.closed
+        pc.mu.Unlock()
+        if !closed && !inUse && (best == nil || pending < bestPending) {
+            best, bestPending = pc, pending
+        }
+    }
+    return best, bestPending
+}
+
+// remove a closed connection from the pool
+func (p *connPool) remove(pc *pooledConn) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    for i, conn := range p.conns {
+        if conn == pc {
+            p.conns = append(p.conns[:i], p.conns[i + 1:]...)
+            return
+        }
+    }
+}
+
+// register a query id waiting for an answer
+func (pc *pooledConn) register(ctx context.Context, id uint16) (chan []byte, bool) {
+    pc.mu.Lock()
+    defer pc.mu.Unlock()
+    if _, inUse := pc.pending[id]; pc.closed || inUse {
+        return nil, false
+    }
+    answer := make(chan []byte, 1)
+    pc.pending[id] = pendingQuery{ctx: ctx, answer: answer}
+    pc.lastUsed = time.Now()
+    return answer, true
+}
+
+// stop waiting for an answer, a late answer is dropped
+func (pc *pooledConn) cancel(id uint16) {
+    pc.mu.Lock()
+    defer pc.mu.Unlock()
+    delete(pc.pending, id)
+    pc.lastUsed = time.Now()
+}
+
+// read answers and hand each to the query with the same id
+func (pc *pooledConn) readLoop() {
+    for {
+        msg, err := readMessage(pc.conn)
+        if err != nil {
+            pc.close(err)
+            return
+        }
+        id := binary.BigEndian.Uint16(msg)
+        pc.mu.Lock()
+        query, ok := pc.pending[id]
+        delete(pc.pending, id)
+        pc.lastUsed = time.Now()
+        pc.mu.Unlock()
+
+        // late answers to cancelled queries have no request left to log with
+        if !ok {
+            logger().Warn("dropping answer with unknown id", "id", id, "server", pc.pool.address)
+            continue
+        }
+        query.answer <- msg
+    }
+}
+
+// close the connection once nothing has used it for the idle timeout
+func (pc *pooledConn) closeIfIdle() {
+    pc.mu.Lock()
+    idleFor := time.Since(pc.lastUsed)
+    busy := len(pc.pending) > 0
+    closed := pc.closed
+    pc.mu.Unlock()
+
+    timeout := pc.pool.client.IdleTimeout
+    if closed {
+        return
+    }
+    if busy || idleFor < timeout {
+        pc.idle.Reset(max(timeout - idleFor, time.Millisecond))
+        return
+    }
+    logger().Debug("closing idle connection", "server", pc.pool.address)
+    pc.close(errConnClosed)
+}
+
+// close the connection and fail every query still waiting on it
+func (pc *pooledConn) close(err error) {
+    pc.mu.Lock()
+    if pc.closed {
+        pc.mu.Unlock()
+        return
+    }
+    pc.closed = true
+    pending := pc.pending
+    pc.pending = nil
+    pc.mu.Unlock()
+
+    if pc.idle != nil {
+        pc.idle.Stop()
+    }
+    pc.conn.Close()
+    pc.pool.remove(pc)
+    for _, query := range pending {
+        logger().WarnContext(query.ctx, "closing connection with query waiting", "server", pc.pool.address, "waiting", len(pending), "error", err)
+        close(query.answer)
+    }
+}
@@ -0,0 +1,376 @@
+package dns
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// a local tcp dns server running serve on each connection it accepts
+type tcpServer struct {
+    address     string
+    accepted    atomic.Int32
+    mu          sync.Mutex
+    conns       []net.Conn
+}
+
+func newTCPServer(t *testing.T, serve func(conn net.Conn)) *tcpServer {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := &tcpServer{address: ln.Addr().String()}
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            s.accepted.Add(1)
+            s.mu.Lock()
+            s.conns = append(s.conns, conn)
+            s.mu.Unlock()
+            go func() {
+                defer conn.Close()
+                serve(conn)
+            }()
+        }
+    }()
+    t.Cleanup(func() {
+        ln.Close()
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        for _, conn := range s.conns {
+            conn.Close()
+        }
+    })
+    return s
+}
+
+// returns a pooling client for the test server, closed when the test ends
+func newPoolClient(t *testing.T, maxConns int) *Client {
+    c := &Client{DialTimeout: time.Second, ReadTimeout: 5 * time.Second, MaxConns: maxConns}
+    t.Cleanup(c.Close)
+    return c
+}
+
+// returns a lookup query with id
+func queryWithID(t *testing.T, id uint16) []byte {
+    query := testQuery(t, false)
+    binary.BigEndian.PutUint16(query, id)
+    return query
+}
+
+// returns query answered, with the response bit set
+func answerTo(query []byte) []byte {
+    answer := append([]byte{}, query...)
+    answer[2] |= 0x80
+    return answer
+}
+
+// reads n queries from conn
+func readQueries(conn net.Conn, n int) ([][]byte, error) {
+    queries := make([][]byte, 0, n)
+    for len(queries) < n {
+        query, err := readMessage(conn)
+        if err != nil {
+            return nil, err
+        }
+        queries = append(queries, query)
+    }
+    return queries, nil
+}
+
+// send queries concurrently and return the answers or errors in order
+func exchangeAll(c *Client, ctx context.Context, address string, queries [][]byte) ([][]byte, []error) {
+    answers := make([][]byte, len(queries))
+    errs := make([]error, len(queries))
+    var wg sync.WaitGroup
+    for i, query := range queries {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            answers[i], errs[i] = c.pool(address).exchange(ctx, query)
+        }()
+    }
+    wg.Wait()
+    return answers, errs
+}
+
+func TestPoolOutOfOrderAnswers(t *testing.T) {
+    // answers every three queries in reverse order
+    server := newTCPServer(t, func(conn net.Conn) {
+        for {
+            queries, err := readQueries(conn, 3)
+            if err != nil {
+                return
+            }
+            for i := len(queries) - 1; i >= 0; i-- {
+                writeMessage(context.Background(), conn, answerTo(queries[i]))
+            }
+        }
+    })
+    c := newPoolClient(t, 1)
+
+    queries := [][]byte{queryWithID(t, 1), queryWithID(t, 2), queryWithID(t, 3)}
+    answers, errs := exchangeAll(c, context.Background(), server.address, queries)
+    for i := range queries {
+        if errs[i] != nil {
+            t.Fatalf("query %d: %s", i, errs[i])
+        }
+        if got, want := binary.BigEndian.Uint16(answers[i]), binary.BigEndian.Uint16(queries[i]); got != want {
+            t.Fatalf("query %d with id %d got the answer with id %d", i, want, got)
+        }
+    }
+    if n := server.accepted.Load(); n != 1 {
+        t.Fatalf("got %d connections, want the queries pipelined on 1", n)
+    }
+}
+
+func TestPoolSpreadsQueries(t *testing.T) {
+    // holds every answer until release is closed
+    release := make(chan struct{})
+    server := newTCPServer(t, func(conn net.Conn) {
+        for {
+            query, err := readMessage(conn)
+            if err != nil {
+                return
+            }
+            go func() {
+                <-release
+                writeMessage(context.Background(), conn, answerTo(query))
+            }()
+        }
+    })
+    c := newPoolClient(t, 2)
+
+    // a busy connection gets a second one dialed while the pool has room,
+    // then queries go to the least busy connection
+    errs := make(chan error, 4)
+    for i := 1; i <= 4; i++ {
+        query := queryWithID(t, uint16(i))
+        go func() {
+            _, err := c.pool(server.address).exchange(context.Background(), query)
+            errs <- err
+        }()
+        waitPending(t, c, server.address, i)
+    }
+    p := c.pool(server.address)
+    p.mu.Lock()
+    for _, pc := range p.conns {
+        pc.mu.Lock()
+        if len(pc.pending) != 2 {
+            t.Errorf("got %d queries on a connection, want 2 on each", len(pc.pending))
+        }
+        pc.mu.Unlock()
+    }
+    p.mu.Unlock()
+    close(release)
+    for i := 0; i < 4; i++ {
+        if err := <-errs; err != nil {
+            t.Fatal(err)
+        }
+    }
+    if n := server.accepted.Load(); n != 2 {
+        t.Fatalf("got %d connections, want 2", n)
+    }
+}
+
+// wait until n queries are waiting on the pool of address
+func waitPending(t *testing.T, c *Client, address string, n int) {
+    t.Helper()
+    deadline := time.Now().Add(2 * time.Second)
+    for pendingQueries(c, address) < n {
+        if time.Now().After(deadline) {
+            t.Fatalf("got %d queries waiting, want %d", pendingQueries(c, address), n)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+// returns the number of queries waiting on the pool of address
+func pendingQueries(c *Client, address string) int {
+    p := c.pool(address)
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    n := 0
+    for _, pc := range p.conns {
+        pc.mu.Lock()
+        n += len(pc.pending)
+        pc.mu.Unlock()
+    }
+    return n
+}
+
+func TestPoolSameIDUsesDedicatedConnection(t *testing.T) {
+    // answers the first query on a connection only after the second connection
+    // was opened, so both queries are in flight together
+    second := make(chan struct{})
+    server := newTCPServer(t, func(conn net.Conn) {
+        query, err := readMessage(conn)
+        if err != nil {
+            return
+        }
+        select {
+        case <-second:
+        default:
+            close(second)
+        }
+        writeMessage(context.Background(), conn, answerTo(query))
+    })
+    c := newPoolClient(t, 1)
+
+    answers, errs := exchangeAll(c, context.Background(), server.address, [][]byte{queryWithID(t, 7), queryWithID(t, 7)})
+    for i := range answers {
+        if errs[i] != nil {
+            t.Fatalf("query %d: %s", i, errs[i])
+        }
+        if binary.BigEndian.Uint16(answers[i]) != 7 {
+            t.Fatalf("query %d got answer %x", i, answers[i])
+        }
+    }
+    if n := server.accepted.Load(); n != 2 {
+        t.Fatalf("got %d connections, want a pooled and a dedicated one", n)
+    }
+}
+
+func TestPoolCancelInFlight(t *testing.T) {
+    // answers the first query late, after the client gave up on it
+    cancelled := make(chan struct{})
+    server := newTCPServer(t, func(conn net.Conn) {
+        first := true
+        for {
+            query, err := readMessage(conn)
+            if err != nil {
+                return
+            }
+            if first {
+                first = false
+                <-cancelled
+            }
+            writeMessage(context.Background(), conn, answerTo(query))
+        }
+    })
+    c := newPoolClient(t, 1)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+    _, err := c.pool(server.address).exchange(ctx, queryWithID(t, 1))
+    var exErr *exchangeError
+    if !errors.As(err, &exErr) || !exErr.sent || !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("got error %v, want a sent deadline exceeded exchangeError", err)
+    }
+    if n := pendingQueries(c, server.address); n != 0 {
+        t.Fatalf("got %d queries waiting after cancel, want 0", n)
+    }
+    close(cancelled)
+
+    // the late answer is dropped and the connection keeps working
+    answer, err := c.pool(server.address).exchange(context.Background(), queryWithID(t, 2))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if binary.BigEndian.Uint16(answer) != 2 {
+        t.Fatalf("got answer with id %d, want 2", binary.BigEndian.Uint16(answer))
+    }
+    if n := server.accepted.Load(); n != 1 {
+        t.Fatalf("got %d connections, want 1", n)
+    }
+}
+
+func TestPoolDroppedConnection(t *testing.T) {
+    // drops the connection without answering the first query
+    var dropped atomic.Bool
+    server := newTCPServer(t, func(conn net.Conn) {
+        for {
+            query, err := readMessage(conn)
+            if err != nil {
+                return
+            }
+            if dropped.CompareAndSwap(false, true) {
+                return
+            }
+            writeMessage(context.Background(), conn, answerTo(query))
+        }
+    })
+    c := newPoolClient(t, 1)
+
+    _, err := c.pool(server.address).exchange(context.Background(), queryWithID(t, 1))
+    var exErr *exchangeError
+    if !errors.As(err, &exErr) || !exErr.sent || !errors.Is(err, errConnClosed) {
+        t.Fatalf("got error %v, want a sent errConnClosed exchangeError", err)
+    }
+
+    // the closed connection is replaced
+    if _, err := c.pool(server.address).exchange(context.Background(), queryWithID(t, 2)); err != nil {
+        t.Fatal(err)
+    }
+    if n := server.accepted.Load(); n != 2 {
+        t.Fatalf("got %d connections, want 2", n)
+    }
+}
+
+func TestPoolCloseIdle(t *testing.T) {
+    closed := make(chan struct{})
+    server := newTCPServer(t, func(conn net.Conn) {
+        for {
+            query, err := readMessage(conn)
+            if err != nil {
+                close(closed)
+                return
+            }
+            writeMessage(context.Background(), conn, answerTo(query))
+        }
+    })
+    c := newPoolClient(t, 1)
+    c.IdleTimeout = 50 * time.Millisecond
+
+    if _, err := c.pool(server.address).exchange(context.Background(), queryWithID(t, 1)); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case <-closed:
+    case <-time.After(2 * time.Second):
+        t.Fatal("idle connection was not closed")
+    }
+    if n := pendingQueries(c, server.address); n != 0 {
+        t.Fatalf("got %d queries waiting, want 0", n)
+    }
+    p := c.pool(server.address)
+    p.mu.Lock()
+    conns := len(p.conns)
+    p.mu.Unlock()
+    if conns != 0 {
+        t.Fatalf("got %d pooled connections after the idle timeout, want 0", conns)
+    }
+}
+
+func TestClientCloseFailsWaitingQueries(t *testing.T) {
+    // never answers
+    server := newTCPServer(t, func(conn net.Conn) {
+        readQueries(conn, 2)
+    })
+    c := newPoolClient(t, 1)
+
+    done := make(chan error)
+    go func() {
+        _, err := c.pool(server.address).exchange(context.Background(), queryWithID(t, 1))
+        done <- err
+    }()
+    waitPending(t, c, server.address, 1)
+    c.Close()
+    select {
+    case err := <-done:
+        if !errors.Is(err, errConnClosed) {
+            t.Fatalf("got error %v, want errConnClosed", err)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("waiting query was not failed by Close")
+    }
+}
@@ -0,0 +1,114 @@
+package dns
+
+import (
+    "context"
+    "fmt"
+    "golang.org/x/net/dns/dnsmessage"
+    "github.com/samchelini/dns-manager/jsend"
+    "net/http"
+)
+
+// rcodes not defined by dnsmessage, including extended rcodes carried in the opt record
+const (
+    RCodeYXDomain       dnsmessage.RCode = 6
+    RCodeYXRRSet        dnsmessage.RCode = 7
+    RCodeNXRRSet        dnsmessage.RCode = 8
+    RCodeNotAuthorized  dnsmessage.RCode = 9
+    RCodeNotZone        dnsmessage.RCode = 10
+    RCodeBadVers        dnsmessage.RCode = 16
+    RCodeBadCookie      dnsmessage.RCode = 23
+)
+
+// rcode mnemonics
+var rCodeName = map[dnsmessage.RCode]string{
+    dnsmessage.RCodeSuccess:         "NOERROR",
+    dnsmessage.RCodeFormatError:     "FORMERR",
+    dnsmessage.RCodeServerFailure:   "SERVFAIL",
+    dnsmessage.RCodeNameError:       "NXDOMAIN",
+    dnsmessage.RCodeNotImplemented:  "NOTIMP",
+    dnsmessage.RCodeRefused:         "REFUSED",
+    RCodeYXDomain:                   "YXDOMAIN",
+    RCodeYXRRSet:                    "YXRRSET",
+    RCodeNXRRSet:                    "NXRRSET",
+    RCodeNotAuthorized:              "NOTAUTH",
+    RCodeNotZone:                    "NOTZONE",
+    RCodeBadVers:                    "BADVERS",
+    RCodeBadCookie:                  "BADCOOKIE",
+}
+
+// http status for each rcode, anything else is a bad gateway
+var rCodeHttpStatus = map[dnsmessage.RCode]int{
+    dnsmessage.RCodeFormatError:     http.StatusBadRequest,
+    dnsmessage.RCodeNameError:       http.StatusNotFound,
+    dnsmessage.RCodeNotImplemented:  http.StatusNotImplemented,
+    dnsmessage.RCodeRefused:         http.StatusForbidden,
+    RCodeYXDomain:                   http.StatusConflict,
+    RCodeYXRRSet:                    http.StatusConflict,
+    RCodeNXRRSet:                    http.StatusNotFound,
+    RCodeNotAuthorized:              http.StatusForbidden,
+    RCodeNotZone:                    http.StatusBadRequest,
+}
+
+// details of a failed answer, sent as jsend data
+type DNSError struct {
+    RCode           int             `json:"rcode"`
+    RCodeName       string          `json:"rcodeName"`
+    ExtendedRCode   int             `json:"extendedRcode"`
+    ExtendedErrors  []ExtendedError `json:"extendedErrors,omitempty"`
+    Server          string          `json:"server,omitempty"`
+}
+
+// returns the rcode of an answer, including the extended bits from the opt record
+func answerRCode(ctx context.Context, answer []byte) (dnsmessage.RCode, *EDNSAnswer) {
+    rCode := dnsmessage.RCode(answer[3] & 0xf)
+    e, err := ParseEDNS(answer)
+    if err != nil {
+        logger().WarnContext(ctx, "error parsing opt record", "error", err)
+    }
+    if e != nil {
+        rCode |= dnsmessage.RCode(e.ExtendedRCode) << 4
+    }
+    return rCode, e
+}
+
+// returns a jsend response describing an answer with an error rcode, or nil
+// when the answer succeeded. client errors such as REFUSED are failures,
+// server errors are errors.
+func rCodeResponse(ctx context.Context, answer []byte, server string) *jsend.Response {
+    rCode, e := answerRCode(ctx, answer)
+    if rCode == dnsmessage.RCodeSuccess {
+        return nil
+    }
+
+    // describe the rcode and any extended errors
+    dnsErr := &DNSError{
+        RCode:      int(rCode),
+        RCodeName:  rCodeName[rCode],
+        Server:     server,
+    }
+    if dnsErr.RCodeName == "" {
+        dnsErr.RCodeName = fmt.Sprintf("RCODE%d", rCode)
+    }
+    message, ok := rCodeError[rCode]
+    if !ok {
+        message = fmt.Sprintf("%s: the name server returned an error.", dnsErr.RCodeName)
+    }
+    if e != nil {
+        dnsErr.ExtendedRCode = int(e.ExtendedRCode)
+        dnsErr.ExtendedErrors = e.ExtendedErrors
+        for _, ede := range e.ExtendedErrors {
+            message += " extended error: " + ede.String()
+        }
+    }
+    logger().InfoContext(ctx, "dns error", "rcode", int(rCode), "server", server, "message", message)
+
+    code := int(rCode)
+    status, ok := rCodeHttpStatus[rCode]
+    if !ok {
+        status = http.StatusBadGateway
+    }
+    if status < http.StatusInternalServerError {
+        return jsend.Fail(dnsErr, message, &code, status)
+    }
+    return jsend.Error(dnsErr, message, &code, status)
+}
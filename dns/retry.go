@@ -0,0 +1,153 @@
+package dns
+
+import (
+    "context"
+    "errors"
+    "math/rand/v2"
+    "golang.org/x/net/dns/dnsmessage"
+    "github.com/samchelini/dns-manager/jsend"
+    "net/http"
+    "time"
+)
+
+// opcode used by dynamic updates
+const opCodeUpdate = 5
+
+// how queries are retried across upstreams
+type RetryPolicy struct {
+    Attempts    int             // total attempts across all upstreams
+    BaseDelay   time.Duration   // backoff before the second attempt
+    MaxDelay    time.Duration   // upper bound on the backoff
+}
+
+// default retry policy
+var DefaultRetryPolicy = RetryPolicy{
+    Attempts:   3,
+    BaseDelay:  100 * time.Millisecond,
+    MaxDelay:   2 * time.Second,
+}
+
+// returns the backoff before an attempt, doubled each attempt with jitter in [d/2, d)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+    d := min(p.BaseDelay << min(attempt - 1, 16), p.MaxDelay)
+    if d <= 0 {
+        return 0
+    }
+    return d / 2 + rand.N(d / 2 + 1)
+}
+
+// send query to the zone upstreams and return the answer
+func (c *Client) Send(ctx context.Context, query []byte, upstreams *Upstreams) ([]byte, *jsend.Response) {
+    answers, err, _ := c.withRetry(ctx, query, upstreams, false)
+    if err != nil {
+        return nil, err
+    }
+    return answers[0], nil
+}
+
+// send an update to the zone upstreams and return the answer. unanswered is
+// true when the update failed after reaching a server without an answer, so
+// the server may have applied it.
+func (c *Client) SendUpdate(ctx context.Context, query []byte, upstreams *Upstreams) (answer []byte, jerr *jsend.Response, unanswered bool) {
+    answers, jerr, unanswered := c.withRetry(ctx, query, upstreams, false)
+    if jerr != nil {
+        return nil, jerr, unanswered
+    }
+    return answers[0], nil, false
+}
+
+// send a zone transfer query to the zone upstreams and return every answer message
+func (c *Client) Transfer(ctx context.Context, query []byte, upstreams *Upstreams) ([][]byte, *jsend.Response) {
+    answers, err, _ := c.withRetry(ctx, query, upstreams, true)
+    return answers, err
+}
+
+// send query to the zone upstreams, failing over to the next upstream and
+// retrying with backoff on timeouts, connection errors and SERVFAIL.
+// answers with an error rcode are returned as a jsend response.
+// updates are not idempotent, so they are only retried when the query never
+// reached a server; any failure after sending is returned as is and reported
+// as unanswered.
+func (c *Client) withRetry(ctx context.Context, query []byte, upstreams *Upstreams, xfr bool) ([][]byte, *jsend.Response, bool) {
+    servers := upstreams.Ordered()
+    if len(servers) == 0 {
+        return nil, jsend.Error(nil, "no upstream nameservers configured", nil, http.StatusInternalServerError), false
+    }
+    update := len(query) > 2 && dnsmessage.OpCode(query[2] >> 3 & 0xf) == opCodeUpdate
+    policy := c.Retry
+    ctx, cancel := c.withTimeout(ctx)
+    defer cancel()
+
+    var answers [][]byte
+    var err error
+    var server string
+    for attempt := 0; attempt < max(policy.Attempts, 1); attempt++ {
+        if attempt > 0 {
+            delay := policy.backoff(attempt)
+            logger().InfoContext(ctx, "retrying query", "delay", delay, "attempt", attempt + 1, "attempts", policy.Attempts)
+            timer := time.NewTimer(delay)
+            select {
+            case <-ctx.Done():
+                timer.Stop()
+                return nil, jsend.Error(server, ctx.Err().Error(), nil, http.StatusGatewayTimeout), false
+            case <-timer.C:
+            }
+        }
+
+        server = servers[attempt % len(servers)]
+        sent := c.withOptions(query, server)
+        start := time.Now()
+        if xfr {
+            answers, err = c.transport(server).transfer(ctx, sent)
+        } else {
+            var answer []byte
+            answer, err = c.transport(server).exchange(ctx, sent)
+            answers = [][]byte{answer}
+        }
+        if err != nil {
+            // the caller going away or the overall timeout running out says
+            // nothing about the upstream, so it is neither marked nor counted
+            if ctx.Err() != nil {
+                break
+            }
+            observeQuery(ctx, sent, server, answers, err, start)
+            upstreams.markFailure(server)
+            var exErr *exchangeError
+            if update && errors.As(err, &exErr) && exErr.sent {
+                logger().WarnContext(ctx, "not retrying update after ambiguous failure", "server", server, "error", err)
+                break
+            }
+            logger().WarnContext(ctx, "upstream failed", "server", server, "error", err)
+            continue
+        }
+
+        observeQuery(ctx, sent, server, answers, err, start)
+        c.keepServerCookie(server, answers[0])
+
+        // servfail marks the upstream as unhealthy, updates are returned as is rather than resent
+        if dnsmessage.RCode(answers[0][3] & 0xf) == dnsmessage.RCodeServerFailure {
+            upstreams.markFailure(server)
+            if update {
+                break
+            }
+            logger().WarnContext(ctx, "upstream returned SERVFAIL", "server", server)
+            continue
+        }
+        upstreams.markSuccess(server)
+        break
+    }
+
+    if err != nil {
+        // an update may have been applied unless it is known not to have been sent
+        var exErr *exchangeError
+        unanswered := update && !(errors.As(err, &exErr) && !exErr.sent)
+        if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+            return nil, jsend.Error(server, err.Error(), nil, http.StatusGatewayTimeout), unanswered
+        }
+        return nil, jsend.Error(server, err.Error(), nil, http.StatusBadGateway), unanswered
+    }
+    if jerr := rCodeResponse(ctx, answers[0], server); jerr != nil {
+        return nil, jerr, false
+    }
+    return answers, nil, false
+}
@@ -0,0 +1,129 @@
+package dns
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "strings"
+    "sync"
+    "testing"
+    "golang.org/x/net/dns/dnsmessage"
+    "github.com/samchelini/dns-manager/jsend"
+)
+
+// result of one scripted exchange, an answer with rcode or err
+type fakeResult struct {
+    rCode   dnsmessage.RCode
+    err     error
+}
+
+// upstreams answering from a script, counting the queries each was sent
+type fakeUpstreams struct {
+    mu      sync.Mutex
+    script  map[string][]fakeResult
+    calls   map[string]int
+}
+
+// a transport to one of the fake upstreams
+type fakeTransport struct {
+    upstreams   *fakeUpstreams
+    server      string
+}
+
+// returns a client whose queries are answered by the fake upstreams
+func (f *fakeUpstreams) client() *Client {
+    return &Client{
+        Retry: RetryPolicy{Attempts: 3},
+        newTransport: func(address string) transport {
+            return &fakeTransport{upstreams: f, server: address}
+        },
+    }
+}
+
+func (t *fakeTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+    f := t.upstreams
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    n := f.calls[t.server]
+    f.calls[t.server]++
+    script := f.script[t.server]
+    if len(script) == 0 {
+        return nil, errors.New("no answer scripted")
+    }
+    result := script[min(n, len(script) - 1)]
+    if result.err != nil {
+        return nil, result.err
+    }
+    answer := answerTo(query)
+    answer[3] = answer[3] &^ 0xf | byte(result.rCode)
+    return answer, nil
+}
+
+func (t *fakeTransport) transfer(ctx context.Context, query []byte) ([][]byte, error) {
+    answer, err := t.exchange(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    return [][]byte{answer}, nil
+}
+
+func TestWithRetry(t *testing.T) {
+    sentErr := &exchangeError{sent: true, err: errors.New("connection reset")}
+    dialErr := &exchangeError{sent: false, err: errors.New("connection refused")}
+    servfail := fakeResult{rCode: dnsmessage.RCodeServerFailure}
+    success := fakeResult{}
+
+    tests := []struct {
+        name        string
+        update      bool
+        a, b        []fakeResult
+        callsA      int
+        callsB      int
+        status      int     // http status of the error, 0 when answered
+        unanswered  bool
+        heldDown    bool    // the first upstream is held down afterwards
+    }{
+        {name: "lookup answered", a: []fakeResult{success}, callsA: 1},
+        {name: "lookup fails over after error", a: []fakeResult{{err: sentErr}}, b: []fakeResult{success}, callsA: 1, callsB: 1, heldDown: true},
+        {name: "lookup fails over after servfail", a: []fakeResult{servfail}, b: []fakeResult{success}, callsA: 1, callsB: 1, heldDown: true},
+        {name: "lookup retried on every attempt", a: []fakeResult{servfail}, b: []fakeResult{servfail}, callsA: 2, callsB: 1, status: http.StatusBadGateway, heldDown: true},
+        {name: "update answered", update: true, a: []fakeResult{success}, callsA: 1},
+        {name: "update not resent after sending", update: true, a: []fakeResult{{err: sentErr}}, b: []fakeResult{success}, callsA: 1, status: http.StatusBadGateway, unanswered: true, heldDown: true},
+        {name: "update resent when never sent", update: true, a: []fakeResult{{err: dialErr}}, b: []fakeResult{success}, callsA: 1, callsB: 1, heldDown: true},
+        {name: "update not resent after servfail", update: true, a: []fakeResult{servfail}, b: []fakeResult{success}, callsA: 1, status: http.StatusBadGateway, heldDown: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f := &fakeUpstreams{
+                script: map[string][]fakeResult{"a:53": tt.a, "b:53": tt.b},
+                calls:  make(map[string]int),
+            }
+            upstreams := NewUpstreams([]string{"a:53", "b:53"})
+            c := f.client()
+
+            var jerr *jsend.Response
+            var unanswered bool
+            if tt.update {
+                _, jerr, unanswered = c.SendUpdate(context.Background(), testQuery(t, true), upstreams)
+            } else {
+                _, jerr = c.Send(context.Background(), testQuery(t, false), upstreams)
+            }
+
+            if f.calls["a:53"] != tt.callsA || f.calls["b:53"] != tt.callsB {
+                t.Errorf("got %d queries to a and %d to b, want %d and %d", f.calls["a:53"], f.calls["b:53"], tt.callsA, tt.callsB)
+            }
+            if tt.status == 0 && jerr != nil {
+                t.Errorf("got error %s", *jerr.Message)
+            }
+            if tt.status != 0 && (jerr == nil || jerr.HttpCode != tt.status) {
+                t.Errorf("got error %+v, want status %d", jerr, tt.status)
+            }
+            if unanswered != tt.unanswered {
+                t.Errorf("got unanswered %v, want %v", unanswered, tt.unanswered)
+            }
+            if heldDown := strings.Join(upstreams.Ordered(), ",") == "b:53,a:53"; heldDown != tt.heldDown {
+                t.Errorf("got upstream order %v, want a held down %v", upstreams.Ordered(), tt.heldDown)
+            }
+        })
+    }
+}
@@ -0,0 +1,224 @@
+package dns
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "golang.org/x/net/dns/dnsmessage"
+    "os"
+    "strings"
+    "time"
+)
+
+// dnssec algorithm numbers supported for sig(0)
+const (
+    AlgorithmRSASHA256          uint8 = 8
+    AlgorithmECDSAP256SHA256    uint8 = 13
+    AlgorithmED25519            uint8 = 15
+)
+
+// record type used by sig(0)
+const typeSIG dnsmessage.Type = 24
+
+// KEY record flags for a host key used to sign transactions, as created by
+// dnssec-keygen -T KEY -n HOST
+const keyFlagsHost uint16 = 0x0200
+
+// how far the sig(0) validity period reaches around the signing time
+const sig0Fudge = 300 * time.Second
+
+// private key signing updates with sig(0) (rfc 2931)
+type Sig0Key struct {
+    Name        string          // key owner name, the signer name in the SIG record
+    Algorithm   uint8           // dnssec algorithm number
+    signer      crypto.Signer
+}
+
+// load a PEM encoded Ed25519, ECDSA P-256 or RSA private key from a file
+// (PKCS #8, SEC 1 or PKCS #1) for signing updates as name
+func LoadSig0Key(name string, keyFile string) (*Sig0Key, error) {
+    data, err := os.ReadFile(keyFile)
+    if err != nil {
+        return nil, fmt.Errorf("error reading key file: %s", err)
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("no PEM data found in key file %s", keyFile)
+    }
+
+    // parse the private key
+    var key any
+    switch block.Type {
+    case "PRIVATE KEY":
+        key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+    case "EC PRIVATE KEY":
+        key, err = x509.ParseECPrivateKey(block.Bytes)
+    case "RSA PRIVATE KEY":
+        key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+    default:
+        return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("error parsing key file: %s", err)
+    }
+    return NewSig0Key(name, key)
+}
+
+// create a sig(0) key from an ed25519, ecdsa p-256 or rsa private key
+func NewSig0Key(name string, key any) (*Sig0Key, error) {
+    if !strings.HasSuffix(name, ".") {
+        name += "."
+    }
+    if _, err := dnsmessage.NewName(name); err != nil {
+        return nil, fmt.Errorf("invalid key name %q: %s", name, err)
+    }
+    k := &Sig0Key{Name: name}
+    switch key := key.(type) {
+    case ed25519.PrivateKey:
+        k.Algorithm, k.signer = AlgorithmED25519, key
+    case *ecdsa.PrivateKey:
+        if key.Curve != elliptic.P256() {
+            return nil, errors.New("unsupported ECDSA curve, only P-256 is supported")
+        }
+        k.Algorithm, k.signer = AlgorithmECDSAP256SHA256, key
+    case *rsa.PrivateKey:
+        k.Algorithm, k.signer = AlgorithmRSASHA256, key
+    default:
+        return nil, fmt.Errorf("unsupported key type %T", key)
+    }
+    return k, nil
+}
+
+// returns the public key in dnskey wire format
+func (k *Sig0Key) publicKey() []byte {
+    switch pub := k.signer.Public().(type) {
+    case ed25519.PublicKey:
+        return pub
+    case *ecdsa.PublicKey:
+        // x and y, each padded to 32 bytes (rfc 6605)
+        key := make([]byte, 64)
+        pub.X.FillBytes(key[:32])
+        pub.Y.FillBytes(key[32:])
+        return key
+    case *rsa.PublicKey:
+        // exponent length, exponent and modulus (rfc 3110)
+        exponent := big32(pub.E)
+        key := make([]byte, 0)
+        if len(exponent) < 256 {
+            key = append(key, byte(len(exponent)))
+        } else {
+            key = append(key, 0)
+            key = binary.BigEndian.AppendUint16(key, uint16(len(exponent)))
+        }
+        key = append(key, exponent...)
+        return append(key, pub.N.Bytes()...)
+    }
+    return nil
+}
+
+// returns the rdata of the matching KEY record
+func (k *Sig0Key) keyData() []byte {
+    data := binary.BigEndian.AppendUint16(nil, keyFlagsHost)
+    data = append(data, 3, k.Algorithm)
+    return append(data, k.publicKey()...)
+}
+
+// returns the key tag of the matching KEY record (rfc 4034 appendix b)
+func (k *Sig0Key) KeyTag() uint16 {
+    var sum uint32
+    for i, b := range k.keyData() {
+        if i & 1 == 0 {
+            sum += uint32(b) << 8
+        } else {
+            sum += uint32(b)
+        }
+    }
+    sum += sum >> 16 & 0xffff
+    return uint16(sum)
+}
+
+// returns the KEY record to add to the zone so the server can verify updates,
+// in zone file format
+func (k *Sig0Key) KEYRecord(ttl uint32) string {
+    return fmt.Sprintf("%s %d IN KEY %d 3 %d %s", k.Name, ttl, keyFlagsHost, k.Algorithm, base64.StdEncoding.EncodeToString(k.publicKey()))
+}
+
+// sign a finished message by appending a SIG(0) record to the additional section
+func (k *Sig0Key) Sign(msg []byte) ([]byte, error) {
+    if len(msg) < 12 {
+        return nil, errors.New("message is shorter than a dns header")
+    }
+
+    // sig rdata without the signature
+    now := time.Now()
+    data := binary.BigEndian.AppendUint16(nil, 0) // type covered
+    data = append(data, k.Algorithm, 0) // algorithm, labels
+    data = binary.BigEndian.AppendUint32(data, 0) // original ttl
+    data = binary.BigEndian.AppendUint32(data, uint32(now.Add(sig0Fudge).Unix())) // expiration
+    data = binary.BigEndian.AppendUint32(data, uint32(now.Add(-sig0Fudge).Unix())) // inception
+    data = binary.BigEndian.AppendUint16(data, k.KeyTag())
+    data = append(data, nameToWire(strings.ToLower(dnsmessage.MustNewName(k.Name).String()))...)
+
+    // sign the rdata followed by the message before the sig record is added
+    signed := append(append(make([]byte, 0, len(data) + len(msg)), data...), msg...)
+    signature, err := k.sign(signed)
+    if err != nil {
+        return nil, fmt.Errorf("error signing message: %s", err)
+    }
+    data = append(data, signature...)
+
+    // sig record: root name, type, class any, ttl 0
+    rr := []byte{0}
+    rr = binary.BigEndian.AppendUint16(rr, uint16(typeSIG))
+    rr = binary.BigEndian.AppendUint16(rr, uint16(dnsmessage.ClassANY))
+    rr = binary.BigEndian.AppendUint32(rr, 0)
+    rr = binary.BigEndian.AppendUint16(rr, uint16(len(data)))
+    rr = append(rr, data...)
+
+    // add record and bump the additional count
+    out := append(append(make([]byte, 0, len(msg) + len(rr)), msg...), rr...)
+    binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(out[10:]) + 1)
+    return out, nil
+}
+
+// sign data with the algorithm of the key
+func (k *Sig0Key) sign(data []byte) ([]byte, error) {
+    switch k.Algorithm {
+    case AlgorithmED25519:
+        return k.signer.Sign(rand.Reader, data, crypto.Hash(0))
+    case AlgorithmECDSAP256SHA256:
+        // r and s, each padded to 32 bytes (rfc 6605)
+        digest := sha256.Sum256(data)
+        r, s, err := ecdsa.Sign(rand.Reader, k.signer.(*ecdsa.PrivateKey), digest[:])
+        if err != nil {
+            return nil, err
+        }
+        signature := make([]byte, 64)
+        r.FillBytes(signature[:32])
+        s.FillBytes(signature[32:])
+        return signature, nil
+    case AlgorithmRSASHA256:
+        digest := sha256.Sum256(data)
+        return k.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+    }
+    return nil, fmt.Errorf("unsupported algorithm %d", k.Algorithm)
+}
+
+// big endian bytes of a positive int without leading zeros
+func big32(n int) []byte {
+    b := binary.BigEndian.AppendUint32(nil, uint32(n))
+    for len(b) > 1 && b[0] == 0 {
+        b = b[1:]
+    }
+    return b
+}
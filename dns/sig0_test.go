@@ -0,0 +1,158 @@
+package dns
+
+import (
+    "bytes"
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/binary"
+    "math/big"
+    "testing"
+    "time"
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+// returns the public key encoded in dnskey wire format for algorithm
+func parsePublicKey(t *testing.T, algorithm uint8, key []byte) crypto.PublicKey {
+    t.Helper()
+    switch algorithm {
+    case AlgorithmED25519:
+        return ed25519.PublicKey(key)
+    case AlgorithmECDSAP256SHA256:
+        return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(key[:32]), Y: new(big.Int).SetBytes(key[32:])}
+    case AlgorithmRSASHA256:
+        n, key := int(key[0]), key[1:]
+        if n == 0 {
+            n, key = int(binary.BigEndian.Uint16(key)), key[2:]
+        }
+        return &rsa.PublicKey{E: int(new(big.Int).SetBytes(key[:n]).Int64()), N: new(big.Int).SetBytes(key[n:])}
+    }
+    t.Fatalf("unsupported algorithm %d", algorithm)
+    return nil
+}
+
+// returns whether signature over data verifies with pub
+func verifySignature(algorithm uint8, pub crypto.PublicKey, data []byte, signature []byte) bool {
+    digest := sha256.Sum256(data)
+    switch algorithm {
+    case AlgorithmED25519:
+        return ed25519.Verify(pub.(ed25519.PublicKey), data, signature)
+    case AlgorithmECDSAP256SHA256:
+        r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+        return len(signature) == 64 && ecdsa.Verify(pub.(*ecdsa.PublicKey), digest[:], r, s)
+    case AlgorithmRSASHA256:
+        return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+    }
+    return false
+}
+
+func TestSig0Sign(t *testing.T) {
+    _, edKey, _ := ed25519.GenerateKey(rand.Reader)
+    ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+    tests := []struct {
+        name        string
+        key         any
+        algorithm   uint8
+    }{
+        {name: "ed25519", key: edKey, algorithm: AlgorithmED25519},
+        {name: "ecdsa p-256", key: ecKey, algorithm: AlgorithmECDSAP256SHA256},
+        {name: "rsa", key: rsaKey, algorithm: AlgorithmRSASHA256},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            k, err := NewSig0Key("Update.Example.com", tt.key)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if k.Algorithm != tt.algorithm {
+                t.Fatalf("got algorithm %d, want %d", k.Algorithm, tt.algorithm)
+            }
+            record := &Record{Name: "host.example.com.", Type: "TypeA", TTL: 300, Data: map[string]any{"address": "192.0.2.1"}}
+            b, _, err := newUpdateBuilder(context.Background(), "example.com.", OpAdd, []*Record{record})
+            if err != nil {
+                t.Fatal(err)
+            }
+            msg, err := b.Finish()
+            if err != nil {
+                t.Fatal(err)
+            }
+            signed, err := k.Sign(msg)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            // the message is kept and one record is added to the additional count
+            if got, want := binary.BigEndian.Uint16(signed[10:]), binary.BigEndian.Uint16(msg[10:]) + 1; got != want {
+                t.Fatalf("got additional count %d, want %d", got, want)
+            }
+            if !bytes.Equal(signed[12:len(msg)], msg[12:]) {
+                t.Fatal("message before the sig record was changed")
+            }
+
+            // sig record: root name, type SIG, class ANY, ttl 0
+            rr := signed[len(msg):]
+            if rr[0] != 0 || binary.BigEndian.Uint16(rr[1:]) != uint16(typeSIG) || binary.BigEndian.Uint16(rr[3:]) != uint16(dnsmessage.ClassANY) || binary.BigEndian.Uint32(rr[5:]) != 0 {
+                t.Fatalf("got sig record header %x", rr[:11])
+            }
+            data := rr[11:]
+            if int(binary.BigEndian.Uint16(rr[9:])) != len(data) {
+                t.Fatalf("got rdata length %d, want %d", binary.BigEndian.Uint16(rr[9:]), len(data))
+            }
+
+            // rdata fields before the signer name
+            if data[2] != tt.algorithm || binary.BigEndian.Uint16(data[16:]) != k.KeyTag() {
+                t.Fatalf("got algorithm %d and key tag %d, want %d and %d", data[2], binary.BigEndian.Uint16(data[16:]), tt.algorithm, k.KeyTag())
+            }
+            expiration, inception := time.Unix(int64(binary.BigEndian.Uint32(data[8:])), 0), time.Unix(int64(binary.BigEndian.Uint32(data[12:])), 0)
+            if now := time.Now(); !inception.Before(now) || !expiration.After(now) {
+                t.Fatalf("got validity %s to %s, want it to cover now", inception, expiration)
+            }
+            signer := nameToWire("update.example.com.")
+            if !bytes.HasPrefix(data[18:], signer) {
+                t.Fatalf("got signer %x, want the lowercased key name %x", data[18:], signer)
+            }
+
+            // the signature covers the rdata before it followed by the unsigned message
+            fields := 18 + len(signer)
+            covered := append(append([]byte{}, data[:fields]...), msg...)
+            pub := parsePublicKey(t, tt.algorithm, k.publicKey())
+            if !verifySignature(tt.algorithm, pub, covered, data[fields:]) {
+                t.Fatal("signature does not verify with the public key")
+            }
+            if verifySignature(tt.algorithm, pub, append(covered, 0), data[fields:]) {
+                t.Fatal("signature verifies over a different message")
+            }
+        })
+    }
+}
+
+func TestSig0KeyTag(t *testing.T) {
+    // ed25519 example from rfc 8080 section 6. its DNSKEY with flags 257 has
+    // key tag 3613, the host KEY with flags 512 sums 255 more
+    seed, _ := base64.StdEncoding.DecodeString("ODIyNjAzODQ2MjgwODAxMjI2NDUxOTAyMDQxNDIyNjI=")
+    k, err := NewSig0Key("example.com.", ed25519.NewKeyFromSeed(seed))
+    if err != nil {
+        t.Fatal(err)
+    }
+    pub := "l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4="
+    wire, _ := base64.StdEncoding.DecodeString(pub)
+
+    // KEY rdata: host flags, protocol 3, algorithm and public key
+    want := append([]byte{0x02, 0x00, 3, AlgorithmED25519}, wire...)
+    if !bytes.Equal(k.keyData(), want) {
+        t.Fatalf("got KEY rdata %x, want %x", k.keyData(), want)
+    }
+    if tag := k.KeyTag(); tag != 3868 {
+        t.Fatalf("got key tag %d, want 3868", tag)
+    }
+    if record := k.KEYRecord(3600); record != "example.com. 3600 IN KEY 512 3 15 " + pub {
+        t.Fatalf("got record %q", record)
+    }
+}
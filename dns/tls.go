@@ -0,0 +1,97 @@
+package dns
+
+import (
+    "context"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+)
+
+// upstream address prefix for dns over tls (rfc 7858)
+const (
+    tlsScheme   = "tls://"
+    tlsPort     = "853"
+)
+
+// build a tls config for dns over tls upstreams. caFile replaces the system
+// roots, certFile and keyFile set a client certificate, and pins are base64
+// sha256 hashes of a SubjectPublicKeyInfo, one of which must be in the chain.
+// every argument is optional.
+func NewTLSConfig(caFile string, certFile string, keyFile string, pins []string) (*tls.Config, error) {
+    config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+    // custom ca bundle
+    if caFile != "" {
+        caData, err := os.ReadFile(caFile)
+        if err != nil {
+            return nil, fmt.Errorf("error reading CA file: %s", err)
+        }
+        config.RootCAs = x509.NewCertPool()
+        if !config.RootCAs.AppendCertsFromPEM(caData) {
+            return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+        }
+    }
+
+    // client certificate
+    if certFile != "" || keyFile != "" {
+        cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+        if err != nil {
+            return nil, fmt.Errorf("error loading client certificate: %s", err)
+        }
+        config.Certificates = []tls.Certificate{cert}
+    }
+
+    // spki pinning
+    if len(pins) > 0 {
+        pinned := make(map[string]bool)
+        for _, pin := range pins {
+            hash, err := base64.StdEncoding.DecodeString(pin)
+            if err != nil || len(hash) != sha256.Size {
+                return nil, fmt.Errorf("invalid SPKI pin %q: expected base64 encoded sha256 hash", pin)
+            }
+            pinned[string(hash)] = true
+        }
+        config.VerifyConnection = func(cs tls.ConnectionState) error {
+            for _, chain := range cs.VerifiedChains {
+                for _, cert := range chain {
+                    hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+                    if pinned[string(hash[:])] {
+                        return nil
+                    }
+                }
+            }
+            return errors.New("no certificate in the chain matches a pinned SPKI")
+        }
+    }
+
+    return config, nil
+}
+
+// returns the SPKI pin for a certificate, in the format NewTLSConfig accepts
+func SPKIPin(cert *x509.Certificate) string {
+    hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+    return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// dial an upstream over tcp, or over tls for tls:// addresses
+func (c *Client) dial(ctx context.Context, address string) (net.Conn, error) {
+    dialer := &net.Dialer{Timeout: c.DialTimeout}
+    host, ok := strings.CutPrefix(address, tlsScheme)
+    if !ok {
+        return dialer.DialContext(ctx, "tcp", address)
+    }
+
+    // default to the dns over tls port
+    if _, _, err := net.SplitHostPort(host); err != nil {
+        host = net.JoinHostPort(strings.Trim(host, "[]"), tlsPort)
+    }
+    logger().DebugContext(ctx, "dialing over tls", "server", host)
+    tlsDialer := &tls.Dialer{NetDialer: dialer, Config: c.TLSConfig}
+    return tlsDialer.DialContext(ctx, "tcp", host)
+}
@@ -0,0 +1,51 @@
+package dns
+
+import (
+    "context"
+    "strings"
+)
+
+// carries dns messages to one upstream
+type transport interface {
+    // send a query and return the answer
+    exchange(ctx context.Context, query []byte) ([]byte, error)
+    // send a zone transfer query and return every answer message
+    transfer(ctx context.Context, query []byte) ([][]byte, error)
+}
+
+// returns the transport for an upstream address
+func (c *Client) transport(address string) transport {
+    if c.newTransport != nil {
+        return c.newTransport(address)
+    }
+    if strings.HasPrefix(address, dohScheme) {
+        return &dohTransport{client: c, url: address}
+    }
+    if host, ok := strings.CutPrefix(address, doqScheme); ok {
+        return &doqTransport{client: c, address: host}
+    }
+    return &streamTransport{client: c, address: address}
+}
+
+// dns over tcp or tls, with length prefixed messages on a stream
+type streamTransport struct {
+    client  *Client
+    address string
+}
+
+// send a query on a pooled connection, or on a dedicated one when pooling is disabled
+func (t *streamTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+    if t.client.MaxConns > 0 {
+        return t.client.pool(t.address).exchange(ctx, query)
+    }
+    answers, err := t.client.roundTrip(ctx, query, t.address, false)
+    if err != nil {
+        return nil, err
+    }
+    return answers[0], nil
+}
+
+// zone transfers always get a dedicated connection
+func (t *streamTransport) transfer(ctx context.Context, query []byte) ([][]byte, error) {
+    return t.client.roundTrip(ctx, query, t.address, true)
+}
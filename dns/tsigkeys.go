@@ -0,0 +1,110 @@
+package dns
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/sha512"
+    "encoding/base64"
+    "fmt"
+    "hash"
+    "sort"
+    "strings"
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+// hmac algorithms supported for tsig, keyed by canonical algorithm name
+var tsigAlgorithms = map[string]func() hash.Hash{
+    "hmac-sha1.":   sha1.New,
+    "hmac-sha224.": sha256.New224,
+    "hmac-sha256.": sha256.New,
+    "hmac-sha384.": sha512.New384,
+    "hmac-sha512.": sha512.New,
+}
+
+// returns the supported tsig algorithm names
+func TSIGAlgorithms() []string {
+    names := make([]string, 0, len(tsigAlgorithms))
+    for name := range tsigAlgorithms {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// returns the hash function for a tsig algorithm, hmac-sha256 if unknown
+func tsigHash(algorithm string) func() hash.Hash {
+    if h, ok := tsigAlgorithms[canonicalName(strings.ToLower(algorithm))]; ok {
+        return h
+    }
+    return sha256.New
+}
+
+// returns name with a trailing dot
+func canonicalName(name string) string {
+    if strings.HasSuffix(name, ".") {
+        return name
+    }
+    return name + "."
+}
+
+// generate a tsig key with a random secret as long as the algorithm's digest
+func GenerateTSIG(name string, algorithm string) (*TSIG, error) {
+    name = canonicalName(strings.ToLower(name))
+    if _, err := dnsmessage.NewName(name); err != nil || name == "." {
+        return nil, fmt.Errorf("invalid key name %q", name)
+    }
+    algorithm = canonicalName(strings.ToLower(algorithm))
+    h, ok := tsigAlgorithms[algorithm]
+    if !ok {
+        return nil, fmt.Errorf("unsupported algorithm %q, expected one of %s", algorithm, strings.Join(TSIGAlgorithms(), ", "))
+    }
+
+    secret := make([]byte, h().Size())
+    if _, err := rand.Read(secret); err != nil {
+        return nil, fmt.Errorf("error generating secret: %s", err)
+    }
+    return &TSIG{
+        Name:       name,
+        Algorithm:  algorithm,
+        Secret:     base64.StdEncoding.EncodeToString(secret),
+    }, nil
+}
+
+// returns a key block for BIND named.conf
+func (t *TSIG) BindConfig() string {
+    return fmt.Sprintf("key \"%s\" {\n\talgorithm %s;\n\tsecret \"%s\";\n};\n", strings.TrimSuffix(t.Name, "."), strings.TrimSuffix(t.Algorithm, "."), t.Secret)
+}
+
+// returns a key section for knot.conf
+func (t *TSIG) KnotConfig() string {
+    return fmt.Sprintf("key:\n  - id: %s\n    algorithm: %s\n    secret: %s\n", t.Name, strings.TrimSuffix(t.Algorithm, "."), t.Secret)
+}
+
+// returns the pdnsutil command importing the key into PowerDNS
+func (t *TSIG) PowerDNSConfig() string {
+    return fmt.Sprintf("pdnsutil import-tsig-key %s %s %s\n", strings.TrimSuffix(t.Name, "."), strings.TrimSuffix(t.Algorithm, "."), t.Secret)
+}
+
+// check that the key has a supported algorithm and a valid secret. names are
+// checked as they are signed with, lowercase and ending in a dot.
+func (t *TSIG) Validate() error {
+    if _, err := dnsmessage.NewName(t.Name); err != nil || t.Name != canonicalName(strings.ToLower(t.Name)) || t.Name == "." {
+        return fmt.Errorf("invalid key name %q, expected a lowercase name ending in a dot", t.Name)
+    }
+    if _, ok := tsigAlgorithms[t.Algorithm]; !ok {
+        return fmt.Errorf("unsupported algorithm %q, expected one of %s", t.Algorithm, strings.Join(TSIGAlgorithms(), ", "))
+    }
+    if _, err := base64.StdEncoding.DecodeString(t.Secret); err != nil || t.Secret == "" {
+        return fmt.Errorf("invalid secret for key %q: expected base64", t.Name)
+    }
+    return nil
+}
+
+// sum a message with the key's hmac algorithm
+func (t *TSIG) mac(key []byte, msg []byte) []byte {
+    mac := hmac.New(tsigHash(t.Algorithm), key)
+    mac.Write(msg)
+    return mac.Sum(nil)
+}
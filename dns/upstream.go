@@ -0,0 +1,103 @@
+package dns
+
+import (
+    "sort"
+    "sync"
+    "time"
+)
+
+// how long a failing upstream is skipped for, doubled per consecutive failure
+const (
+    upstreamHoldDown    = 5 * time.Second
+    upstreamMaxHoldDown = 5 * time.Minute
+)
+
+// an upstream nameserver and its recent health
+type upstream struct {
+    address     string
+    failures    int         // consecutive failures
+    lastFailure time.Time
+}
+
+// returns true while a failing upstream should not get the first attempt
+func (u *upstream) down(now time.Time) bool {
+    if u.failures == 0 {
+        return false
+    }
+    holdDown := upstreamHoldDown << min(u.failures - 1, 6)
+    return now.Before(u.lastFailure.Add(min(holdDown, upstreamMaxHoldDown)))
+}
+
+// upstream nameservers for a zone, ordered by health
+type Upstreams struct {
+    mu      sync.Mutex
+    servers []*upstream
+}
+
+// create upstreams from nameserver addresses in order of preference
+func NewUpstreams(addresses []string) *Upstreams {
+    u := &Upstreams{}
+    for _, address := range addresses {
+        u.servers = append(u.servers, &upstream{address: address})
+    }
+    return u
+}
+
+// returns the upstream addresses, healthy servers first in configured order,
+// followed by failing servers with the fewest consecutive failures first
+func (u *Upstreams) Ordered() []string {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+
+    now := time.Now()
+    servers := make([]*upstream, len(u.servers))
+    copy(servers, u.servers)
+    sort.SliceStable(servers, func(i, j int) bool {
+        iDown, jDown := servers[i].down(now), servers[j].down(now)
+        if iDown != jDown {
+            return !iDown
+        }
+        return iDown && servers[i].failures < servers[j].failures
+    })
+
+    addresses := make([]string, len(servers))
+    for i, server := range servers {
+        addresses[i] = server.address
+    }
+    return addresses
+}
+
+// returns the upstream addresses in configured order
+func (u *Upstreams) Addresses() []string {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+
+    addresses := make([]string, len(u.servers))
+    for i, server := range u.servers {
+        addresses[i] = server.address
+    }
+    return addresses
+}
+
+// record a successful exchange with an upstream
+func (u *Upstreams) markSuccess(address string) {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    for _, server := range u.servers {
+        if server.address == address {
+            server.failures = 0
+        }
+    }
+}
+
+// record a failed exchange with an upstream
+func (u *Upstreams) markFailure(address string) {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    for _, server := range u.servers {
+        if server.address == address {
+            server.failures++
+            server.lastFailure = time.Now()
+        }
+    }
+}
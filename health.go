@@ -0,0 +1,263 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "golang.org/x/net/dns/dnsmessage"
+    "github.com/samchelini/dns-manager/dns"
+    "github.com/samchelini/dns-manager/jsend"
+)
+
+var (
+    readyCacheTTL   = 10 * time.Second  // how long a readiness result is reused
+    readyTimeout    = 5 * time.Second   // limit on all readiness checks together
+)
+
+// soa check of one upstream
+type upstreamReadiness struct {
+    Server      string  `json:"server"`
+    Ready       bool    `json:"ready"`
+    Serial      uint32  `json:"serial,omitempty"`
+    LatencyMs   float64 `json:"latencyMs"`
+    Error       string  `json:"error,omitempty"`
+}
+
+// no-op signed update of a zone
+type signingReadiness struct {
+    Key     string  `json:"key,omitempty"`
+    Primary bool    `json:"primary"`       // the key is the zone's primary tsig key
+    Ready   bool    `json:"ready"`
+    Error   string  `json:"error,omitempty"`
+}
+
+// readiness of one zone
+type zoneReadiness struct {
+    Zone        string              `json:"zone"`
+    Ready       bool                `json:"ready"`
+    Upstreams   []upstreamReadiness `json:"upstreams"`
+    Signing     signingReadiness    `json:"signing"`
+    Error       string              `json:"error,omitempty"`
+}
+
+// readiness of the server, sent as jsend data
+type readiness struct {
+    Ready   bool            `json:"ready"`
+    Checked time.Time       `json:"checked"`
+    Zones   []zoneReadiness `json:"zones"`
+}
+
+// the last readiness result, checks run at most once per readyCacheTTL
+var (
+    readyMu     sync.Mutex
+    lastReady   *readiness
+)
+
+// liveness, the process is serving requests
+func getHealth(w http.ResponseWriter, r *http.Request) {
+    sendResponse(w, jsend.Success(map[string]string{"status": "ok"}, nil, nil, http.StatusOK))
+}
+
+// readiness, every checked zone answers soa queries on each upstream and
+// accepts a signed update
+func getReady(w http.ResponseWriter, r *http.Request) {
+    result := checkReadiness()
+    if !result.Ready {
+        sendResponse(w, jsend.Fail(result, "not ready", nil, http.StatusServiceUnavailable))
+        return
+    }
+    sendResponse(w, jsend.Success(result, nil, nil, http.StatusOK))
+}
+
+// returns the zones to check: zones with their own upstreams or tsig keys,
+// and the zones in READY_ZONES
+func readinessZones() []string {
+    return configuredZones(splitList(os.Getenv("READY_ZONES")))
+}
+
+// returns the zones labelled by name in metrics: zones with their own
+// upstreams, tsig keys or change quota, and the zones in METRIC_ZONES
+func metricZones() []string {
+    extra := splitList(os.Getenv("METRIC_ZONES"))
+    if quota := current().changeQuota; quota != nil {
+        for zone := range quota.Zones {
+            extra = append(extra, zone)
+        }
+    }
+    return configuredZones(extra)
+}
+
+// returns the zones with their own upstreams or tsig keys and the extra
+// zones, sorted and without duplicates
+func configuredZones(extra []string) []string {
+    zones := make(map[string]string)
+    add := func(zone string) {
+        key := strings.ToLower(strings.TrimSuffix(zone, ".")) + "."
+        if _, ok := zones[key]; !ok {
+            zones[key] = zone
+        }
+    }
+    for zone := range current().zoneUpstreams {
+        add(zone)
+    }
+    if tsigKeys != nil {
+        for _, zone := range tsigKeys.Zones() {
+            add(zone)
+        }
+    }
+    for _, zone := range extra {
+        add(zone)
+    }
+
+    names := make([]string, 0, len(zones))
+    for _, zone := range zones {
+        names = append(names, zone)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// returns the cached readiness, or checks every zone in parallel when the
+// result has expired. checks run without the request context since the
+// result is shared.
+func checkReadiness() *readiness {
+    readyMu.Lock()
+    defer readyMu.Unlock()
+    if lastReady != nil && time.Since(lastReady.Checked) < readyCacheTTL {
+        return lastReady
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+    defer cancel()
+    zones := readinessZones()
+    result := &readiness{Ready: true, Checked: time.Now(), Zones: make([]zoneReadiness, len(zones))}
+    var wg sync.WaitGroup
+    for i, zone := range zones {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            result.Zones[i] = checkZone(ctx, zone)
+        }()
+    }
+    wg.Wait()
+    for _, zone := range result.Zones {
+        if !zone.Ready {
+            result.Ready = false
+            slog.Warn("zone is not ready", "zone", zone.Zone, "error", zone.Error, "signing", zone.Signing.Error)
+        }
+    }
+    lastReady = result
+    return result
+}
+
+// check that each upstream of a zone answers its soa and that the zone
+// accepts an update signed with the current key
+func checkZone(ctx context.Context, zone string) zoneReadiness {
+    result := zoneReadiness{Zone: zone, Upstreams: make([]upstreamReadiness, 0)}
+    upstreams, jerr := upstreamsFor(ctx, zone)
+    if jerr != nil {
+        result.Error = *jerr.Message
+        return result
+    }
+
+    servers := upstreams.Addresses()
+    result.Upstreams = make([]upstreamReadiness, len(servers))
+    var wg sync.WaitGroup
+    for i, server := range servers {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            result.Upstreams[i] = checkSOA(ctx, zone, server)
+        }()
+    }
+    result.Signing = checkSigning(ctx, zone, upstreams)
+    wg.Wait()
+
+    result.Ready = result.Signing.Ready
+    for _, upstream := range result.Upstreams {
+        if !upstream.Ready {
+            result.Ready = false
+            result.Error = fmt.Sprintf("upstream %s: %s", upstream.Server, upstream.Error)
+        }
+    }
+    if !result.Signing.Ready && result.Error == "" {
+        result.Error = "signing: " + result.Signing.Error
+    }
+    return result
+}
+
+// look up the soa of a zone on one upstream
+func checkSOA(ctx context.Context, zone string, server string) upstreamReadiness {
+    result := upstreamReadiness{Server: server}
+    start := time.Now()
+    msg, jerr := dnsClient.Lookup(ctx, zone, dnsmessage.TypeSOA, server)
+    result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+    if jerr != nil {
+        result.Error = *jerr.Message
+        return result
+    }
+    for _, answer := range msg.Answers {
+        if soa, ok := answer.Body.(*dnsmessage.SOAResource); ok {
+            result.Ready = true
+            result.Serial = soa.Serial
+            return result
+        }
+    }
+    result.Error = "no SOA record in answer"
+    return result
+}
+
+// send a signed update with a prerequisite that is never met. YXRRSET
+// means the server verified the signature and changed nothing. like record
+// updates, older tsig keys are tried when the primary key is rejected.
+func checkSigning(ctx context.Context, zone string, upstreams *dns.Upstreams) signingReadiness {
+    var result signingReadiness
+    if sig0Key != nil {
+        result.Key, result.Primary = sig0Key.Name, true
+        query, err := dns.NewUpdateQuerySig0(ctx, zone, dns.OpCheck, nil, sig0Key)
+        if err != nil {
+            result.Error = err.Error()
+            return result
+        }
+        _, jerr := dnsClient.Send(ctx, query, upstreams)
+        result.Ready, result.Error = signedCheckResult(jerr)
+        return result
+    }
+
+    keys := tsigKeys.Keys(zone)
+    if len(keys) == 0 {
+        result.Error = "no tsig keys configured for zone"
+        return result
+    }
+    for i, key := range keys {
+        result.Key, result.Primary = key.Name, i == 0
+        query, err := dns.NewUpdateQuery(ctx, zone, dns.OpCheck, nil, &key)
+        if err != nil {
+            result.Error = err.Error()
+            return result
+        }
+        _, jerr := dnsClient.Send(ctx, query, upstreams)
+        result.Ready, result.Error = signedCheckResult(jerr)
+        if result.Ready || jerr == nil || jerr.Code == nil || *jerr.Code != int(dns.RCodeNotAuthorized) {
+            break
+        }
+    }
+    return result
+}
+
+// returns whether a no-op update was answered with YXRRSET, or why not
+func signedCheckResult(jerr *jsend.Response) (bool, string) {
+    if jerr == nil {
+        return false, "update was accepted without checking the prerequisite"
+    }
+    if jerr.Code != nil && *jerr.Code == int(dns.RCodeYXRRSet) {
+        return true, ""
+    }
+    return false, *jerr.Message
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+    "github.com/samchelini/dns-manager/auth"
+)
+
+// how often the certificate files are checked for changes
+const certCheckInterval = 5 * time.Second
+
+// https settings, nil when serving plain http
+var serverTLS *tls.Config
+
+// whether verified client certificates authenticate requests
+var clientCerts bool
+
+// roles granted to client certificates by organizational unit, set from
+// TLS_CLIENT_ROLE_MAP. units without a mapping grant nothing, since anyone
+// the client ca issues a certificate to may pick their own units.
+var clientRoleMap map[string][]string
+
+// tls versions accepted by TLS_MIN_VERSION
+var tlsVersions = map[string]uint16{
+    "1.2": tls.VersionTLS12,
+    "1.3": tls.VersionTLS13,
+}
+
+// serving certificate that is reloaded when its files change
+type certReloader struct {
+    certFile    string
+    keyFile     string
+    mu          sync.Mutex
+    cert        *tls.Certificate
+    modTime     time.Time
+    checked     time.Time
+}
+
+// load a certificate and key, failing if they cannot be read
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+    c := &certReloader{certFile: certFile, keyFile: keyFile}
+    if err := c.reload(); err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+// returns the newest modification time of the certificate files
+func (c *certReloader) modified() (time.Time, error) {
+    var latest time.Time
+    for _, file := range []string{c.certFile, c.keyFile} {
+        info, err := os.Stat(file)
+        if err != nil {
+            return time.Time{}, err
+        }
+        if info.ModTime().After(latest) {
+            latest = info.ModTime()
+        }
+    }
+    return latest, nil
+}
+
+func (c *certReloader) reload() error {
+    modTime, err := c.modified()
+    if err != nil {
+        return fmt.Errorf("error reading certificate: %s", err)
+    }
+    cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+    if err != nil {
+        return fmt.Errorf("error loading certificate: %s", err)
+    }
+    c.cert, c.modTime = &cert, modTime
+    return nil
+}
+
+// tls.Config.GetCertificate, reloading the certificate when the files changed.
+// the current certificate is kept when the new files cannot be loaded, e.g.
+// while they are being replaced.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if time.Since(c.checked) < certCheckInterval {
+        return c.cert, nil
+    }
+    c.checked = time.Now()
+    if modTime, err := c.modified(); err == nil && !modTime.Equal(c.modTime) {
+        if err := c.reload(); err != nil {
+            slog.Warn("error reloading certificate, keeping the current one", "error", err)
+        } else {
+            slog.Info("reloaded certificate", "file", c.certFile)
+        }
+    }
+    return c.cert, nil
+}
+
+// build the server tls config from the certificate, minimum version and
+// client ca settings
+func newServerTLSConfig(certFile string, keyFile string, minVersion string, clientCAFile string, clientAuth string) (*tls.Config, error) {
+    if certFile == "" || keyFile == "" {
+        return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE are both required")
+    }
+    certs, err := newCertReloader(certFile, keyFile)
+    if err != nil {
+        return nil, err
+    }
+    config := &tls.Config{
+        GetCertificate: certs.GetCertificate,
+        MinVersion:     tls.VersionTLS12,
+    }
+    if minVersion != "" {
+        version, ok := tlsVersions[minVersion]
+        if !ok {
+            return nil, fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, got %q", minVersion)
+        }
+        config.MinVersion = version
+    }
+
+    // client certificates
+    if clientCAFile == "" {
+        if clientAuth != "" {
+            return nil, errors.New("TLS_CLIENT_AUTH requires TLS_CLIENT_CA_FILE")
+        }
+        return config, nil
+    }
+    data, err := os.ReadFile(clientCAFile)
+    if err != nil {
+        return nil, fmt.Errorf("error reading TLS_CLIENT_CA_FILE: %s", err)
+    }
+    config.ClientCAs = x509.NewCertPool()
+    if !config.ClientCAs.AppendCertsFromPEM(data) {
+        return nil, fmt.Errorf("no certificates found in TLS_CLIENT_CA_FILE %s", clientCAFile)
+    }
+    switch clientAuth {
+    case "", "require":
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+    case "optional":
+        config.ClientAuth = tls.VerifyClientCertIfGiven
+    default:
+        return nil, fmt.Errorf("TLS_CLIENT_AUTH must be require or optional, got %q", clientAuth)
+    }
+    return config, nil
+}
+
+// returns the identity of a verified client certificate, or nil. the subject
+// is the first SAN, or the deprecated common name when it has none; roles
+// come from organizational units mapped in TLS_CLIENT_ROLE_MAP.
+func certIdentity(r *http.Request) *auth.Identity {
+    if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+        return nil
+    }
+    cert := r.TLS.VerifiedChains[0][0]
+    var name string
+    switch {
+    case len(cert.DNSNames) > 0:
+        name = cert.DNSNames[0]
+    case len(cert.URIs) > 0:
+        name = cert.URIs[0].String()
+    case len(cert.EmailAddresses) > 0:
+        name = cert.EmailAddresses[0]
+    case cert.Subject.CommonName != "":
+        name = cert.Subject.CommonName
+    default:
+        return nil
+    }
+    var roles []string
+    for _, unit := range cert.Subject.OrganizationalUnit {
+        roles = append(roles, clientRoleMap[unit]...)
+    }
+    return &auth.Identity{
+        Subject:    "cert:" + strings.TrimSpace(name),
+        Method:     "cert",
+        Roles:      roles,
+    }
+}
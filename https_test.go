@@ -0,0 +1,80 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+)
+
+func TestCertIdentity(t *testing.T) {
+    clientRoleMap = map[string][]string{"dns-ops": {"admin"}, "build": {"writer", "reader"}}
+    t.Cleanup(func() { clientRoleMap = nil })
+    uri, _ := url.Parse("spiffe://example.com/deployer")
+
+    tests := []struct {
+        name    string
+        cert    *x509.Certificate
+        subject string
+        roles   string
+    }{
+        {
+            name:       "dns name before common name",
+            cert:       &x509.Certificate{Subject: pkix.Name{CommonName: "admin"}, DNSNames: []string{"ci.example.com"}},
+            subject:    "cert:ci.example.com",
+        },
+        {
+            name:       "uri",
+            cert:       &x509.Certificate{URIs: []*url.URL{uri}},
+            subject:    "cert:spiffe://example.com/deployer",
+        },
+        {
+            name:       "email",
+            cert:       &x509.Certificate{EmailAddresses: []string{"alice@example.com"}},
+            subject:    "cert:alice@example.com",
+        },
+        {
+            name:       "common name without san",
+            cert:       &x509.Certificate{Subject: pkix.Name{CommonName: " deployer "}},
+            subject:    "cert:deployer",
+        },
+        {
+            name:       "mapped units",
+            cert:       &x509.Certificate{Subject: pkix.Name{CommonName: "ci", OrganizationalUnit: []string{"build", "dns-ops"}}},
+            subject:    "cert:ci",
+            roles:      "writer,reader,admin",
+        },
+        {
+            name:       "unmapped units grant nothing",
+            cert:       &x509.Certificate{Subject: pkix.Name{CommonName: "ci", OrganizationalUnit: []string{"admin", "writer"}}},
+            subject:    "cert:ci",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "/", nil)
+            r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}
+            id := certIdentity(r)
+            if id == nil {
+                t.Fatal("got no identity")
+            }
+            if id.Subject != tt.subject || strings.Join(id.Roles, ",") != tt.roles {
+                t.Fatalf("got %s with roles %v, want %s with roles %s", id.Subject, id.Roles, tt.subject, tt.roles)
+            }
+        })
+    }
+
+    // unverified connections and certificates without a name have no identity
+    r := httptest.NewRequest("GET", "/", nil)
+    r.TLS = &tls.ConnectionState{}
+    if id := certIdentity(r); id != nil {
+        t.Fatalf("got identity %+v for an unverified connection", id)
+    }
+    r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+    if id := certIdentity(r); id != nil {
+        t.Fatalf("got identity %+v for a certificate without a name", id)
+    }
+}
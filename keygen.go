@@ -0,0 +1,94 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "net/http"
+    "os"
+    "github.com/samchelini/dns-manager/dns"
+    "github.com/samchelini/dns-manager/jsend"
+)
+
+// default algorithm for generated tsig keys
+const defaultTSIGAlgorithm = "hmac-sha256."
+
+// request body for generating a tsig key
+type tsigKeyRequest struct {
+    Name        string  `json:"name"`
+    Algorithm   string  `json:"algorithm"`
+}
+
+// generated tsig key with ready-to-paste server configs
+type tsigKeyResponse struct {
+    Key         *dns.TSIG   `json:"key"`         // TSIG_FILE format
+    Bind        string      `json:"bind"`
+    Knot        string      `json:"knot"`
+    PowerDNS    string      `json:"powerdns"`
+}
+
+func newTSIGKeyResponse(key *dns.TSIG) tsigKeyResponse {
+    return tsigKeyResponse{
+        Key:        key,
+        Bind:       key.BindConfig(),
+        Knot:       key.KnotConfig(),
+        PowerDNS:   key.PowerDNSConfig(),
+    }
+}
+
+// generate a tsig key
+func createTSIGKey(w http.ResponseWriter, r *http.Request) {
+    var req tsigKeyRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        sendResponse(w, jsend.Fail(nil, "invalid request body: " + err.Error(), nil, bodyErrorStatus(err)))
+        return
+    }
+    if req.Algorithm == "" {
+        req.Algorithm = defaultTSIGAlgorithm
+    }
+
+    key, err := dns.GenerateTSIG(req.Name, req.Algorithm)
+    if err != nil {
+        data := map[string]any{"algorithms": dns.TSIGAlgorithms()}
+        sendResponse(w, jsend.Fail(data, err.Error(), nil, http.StatusBadRequest))
+        return
+    }
+    sendResponse(w, jsend.Success(newTSIGKeyResponse(key), nil, nil, http.StatusCreated))
+}
+
+// keygen subcommand: print a fresh tsig key in the requested format
+func keygen(args []string) error {
+    flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+    name := flags.String("name", "", "key name, e.g. dns-manager.")
+    algorithm := flags.String("algorithm", defaultTSIGAlgorithm, "hmac algorithm")
+    format := flags.String("format", "json", "output format: json, bind, knot, powerdns or all")
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+    if *name == "" {
+        return fmt.Errorf("-name is required")
+    }
+
+    key, err := dns.GenerateTSIG(*name, *algorithm)
+    if err != nil {
+        return err
+    }
+    switch *format {
+    case "json":
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "    ")
+        return enc.Encode(key)
+    case "bind":
+        fmt.Print(key.BindConfig())
+    case "knot":
+        fmt.Print(key.KnotConfig())
+    case "powerdns":
+        fmt.Print(key.PowerDNSConfig())
+    case "all":
+        data, _ := json.MarshalIndent(key, "", "    ")
+        fmt.Printf("# TSIG_FILE\n%s\n\n# BIND named.conf\n%s\n# Knot knot.conf\n%s\n# PowerDNS\n%s", data, key.BindConfig(), key.KnotConfig(), key.PowerDNSConfig())
+    default:
+        return fmt.Errorf("unknown format %q, expected json, bind, knot, powerdns or all", *format)
+    }
+    return nil
+}
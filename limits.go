@@ -0,0 +1,83 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "math"
+    "net/http"
+    "strconv"
+    "time"
+    "github.com/samchelini/dns-manager/auth"
+    "github.com/samchelini/dns-manager/jsend"
+    "github.com/samchelini/dns-manager/metrics"
+    "github.com/samchelini/dns-manager/ratelimit"
+)
+
+var rateLimited = metrics.NewCounterVec("http_rate_limited_total", "Requests rejected by a rate limit or quota.", "limit")
+
+// details of a rejected request, sent as jsend data
+type rateLimitError struct {
+    Limit       string  `json:"limit"`
+    Zone        string  `json:"zone,omitempty"`
+    Used        int     `json:"used,omitempty"`
+    Allowed     int     `json:"allowed,omitempty"`
+    RetryAfter  int     `json:"retryAfter"`
+}
+
+// returns the rate limit key of a request: the authenticated subject, or the
+// client ip for anonymous callers
+func rateLimitKey(r *http.Request) string {
+    if id := auth.FromContext(r.Context()); id != nil {
+        return id.Subject
+    }
+    return "ip:" + clientIP(r)
+}
+
+// returns a 429 fail with the Retry-After header set, rounded up to whole seconds
+func tooManyRequests(w http.ResponseWriter, data *rateLimitError, retryAfter time.Duration, message string) *jsend.Response {
+    data.RetryAfter = int(math.Ceil(retryAfter.Seconds()))
+    w.Header().Set("Retry-After", strconv.Itoa(data.RetryAfter))
+    rateLimited.With(data.Limit).Inc()
+    return jsend.Fail(data, message, nil, http.StatusTooManyRequests)
+}
+
+// limits the requests of each caller with the token bucket of a budget,
+// "read" or "write". runs after authentication so tokens are limited rather
+// than the addresses they are used from.
+func rateLimitHandler(name string, handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        limiter := current().readLimiter
+        if name == "write" {
+            limiter = current().writeLimiter
+        }
+        if limiter == nil {
+            handler.ServeHTTP(w, r)
+            return
+        }
+        key := rateLimitKey(r)
+        if ok, wait := limiter.Allow(key); !ok {
+            slog.InfoContext(r.Context(), "rate limited", "limit", name, "key", key, "retryAfter", wait)
+            message := fmt.Sprintf("%s rate limit of %d per %s exceeded", name, limiter.Limit, limiter.Period)
+            sendResponse(w, tooManyRequests(w, &rateLimitError{Limit: name}, wait, message))
+            return
+        }
+        handler.ServeHTTP(w, r)
+    })
+}
+
+// count a change against the zone's daily quota, returns the quota charged
+// or a 429 fail when it is used up. the change must be refunded to the
+// returned quota if it is not made.
+func takeChangeQuota(w http.ResponseWriter, r *http.Request, zone string) (*ratelimit.Quota, *jsend.Response) {
+    changeQuota := current().changeQuota
+    if changeQuota == nil {
+        return nil, nil
+    }
+    if ok, wait := changeQuota.Take(zone); !ok {
+        used, allowed := changeQuota.Usage(zone)
+        slog.InfoContext(r.Context(), "daily change quota exceeded", "zone", zone, "allowed", allowed)
+        message := fmt.Sprintf("daily quota of %d changes for zone %s exceeded", allowed, zone)
+        return nil, tooManyRequests(w, &rateLimitError{Limit: "quota", Zone: zone, Used: used, Allowed: allowed}, wait, message)
+    }
+    return changeQuota, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestTooManyRequestsRetryAfter(t *testing.T) {
+    tests := []struct {
+        wait    time.Duration
+        header  string
+    }{
+        {wait: time.Nanosecond, header: "1"},
+        {wait: 500 * time.Millisecond, header: "1"},
+        {wait: time.Second, header: "1"},
+        {wait: 1500 * time.Millisecond, header: "2"},
+        {wait: 23 * time.Hour + time.Millisecond, header: "82801"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.wait.String(), func(t *testing.T) {
+            w := httptest.NewRecorder()
+            data := &rateLimitError{Limit: "write"}
+            response := tooManyRequests(w, data, tt.wait, "rate limit exceeded")
+            if got := w.Header().Get("Retry-After"); got != tt.header {
+                t.Errorf("got Retry-After %q, want %q", got, tt.header)
+            }
+            if strconv.Itoa(data.RetryAfter) != tt.header {
+                t.Errorf("got retryAfter %d in the response data, want %s", data.RetryAfter, tt.header)
+            }
+            if response.HttpCode != http.StatusTooManyRequests {
+                t.Errorf("got status %d, want 429", response.HttpCode)
+            }
+        })
+    }
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "time"
+    "github.com/samchelini/dns-manager/metrics"
+    "github.com/samchelini/dns-manager/uuid"
+)
+
+// header carrying the request id, taken from the client when present
+const requestIDHeader = "X-Request-ID"
+
+// longest inbound request id that is kept, longer ids are replaced
+const maxRequestIDLength = 128
+
+// context key for the request id
+type requestIDKey struct{}
+
+// returns the request id of a request context, or "" outside a request
+func requestID(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+    return id
+}
+
+// returns the inbound request id if it is usable, otherwise a new one
+func newRequestID(r *http.Request) string {
+    id := r.Header.Get(requestIDHeader)
+    if id == "" || len(id) > maxRequestIDLength {
+        return uuid.V4()
+    }
+    for _, c := range id {
+        if c <= ' ' || c > '~' {
+            return uuid.V4()
+        }
+    }
+    return id
+}
+
+// http request metrics by route pattern, method and status
+var (
+    httpRequestDuration = metrics.NewHistogramVec("http_request_duration_seconds", "HTTP request latency.", metrics.DefaultBuckets, "route", "method", "status")
+    httpResponseSize = metrics.NewHistogramVec("http_response_size_bytes", "HTTP response body size.", []float64{100, 1000, 10000, 100000, 1000000, 10000000}, "route", "method", "status")
+)
+
+// methods used as metric labels, anything else is counted as "other"
+var knownMethods = map[string]bool{
+    http.MethodGet:     true,
+    http.MethodHead:    true,
+    http.MethodPost:    true,
+    http.MethodPut:     true,
+    http.MethodPatch:   true,
+    http.MethodDelete:  true,
+    http.MethodOptions: true,
+}
+
+// extend http.ResponseWriter to record the response code and bytes sent
+type extendedResponseWriter struct {
+    w           http.ResponseWriter
+    statusCode  int
+    bytes       int
+}
+
+func (erw *extendedResponseWriter) Header() http.Header {
+    return erw.w.Header()
+}
+
+// records the first final status code, informational codes may be sent before it
+func (erw *extendedResponseWriter) WriteHeader(statusCode int) {
+    if erw.statusCode == 0 && statusCode >= http.StatusOK {
+        erw.statusCode = statusCode
+    }
+    erw.w.WriteHeader(statusCode)
+}
+
+// writing without WriteHeader sends 200, like net/http
+func (erw *extendedResponseWriter) Write(data []byte) (int, error) {
+    if erw.statusCode == 0 {
+        erw.statusCode = http.StatusOK
+    }
+    n, err := erw.w.Write(data)
+    erw.bytes += n
+    return n, err
+}
+
+// flush buffered data to the client when the underlying writer supports it
+func (erw *extendedResponseWriter) Flush() {
+    if f, ok := erw.w.(http.Flusher); ok {
+        if erw.statusCode == 0 {
+            erw.statusCode = http.StatusOK
+        }
+        f.Flush()
+    }
+}
+
+// returns the underlying writer for http.ResponseController
+func (erw *extendedResponseWriter) Unwrap() http.ResponseWriter {
+    return erw.w
+}
+
+// returns the recorded status, 200 if the handler wrote nothing
+func (erw *extendedResponseWriter) status() int {
+    if erw.statusCode == 0 {
+        return http.StatusOK
+    }
+    return erw.statusCode
+}
+
+// slog handler adding the request id from the context to every record,
+// including records logged by the dns package
+type requestIDHandler struct {
+    slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+    if id := requestID(ctx); id != "" {
+        r.AddAttrs(slog.String("requestId", id))
+    }
+    return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+    return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// create a logger writing json or text records at level
+func newLogger(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+    options := &slog.HandlerOptions{Level: level}
+    switch format {
+    case "", "json":
+        return slog.New(requestIDHandler{slog.NewJSONHandler(w, options)}), nil
+    case "text":
+        return slog.New(requestIDHandler{slog.NewTextHandler(w, options)}), nil
+    }
+    return nil, fmt.Errorf("unknown log format %q, expected json or text", format)
+}
+
+// returns the client ip of a request
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// logs and measures http requests as structured access log records and
+// metrics by route, and adds the request id to the request context and
+// response headers
+func logHandler(mux *http.ServeMux) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        id := newRequestID(r)
+        r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+        erw := &extendedResponseWriter{w: w}
+        erw.Header().Set(requestIDHeader, id)
+
+        // the matched pattern keeps the route label bounded
+        _, route := mux.Handler(r)
+        if route == "" {
+            route = "unmatched"
+        }
+        mux.ServeHTTP(erw, r)
+        latency := time.Since(start)
+        status := erw.status()
+
+        // path values are set on r by the mux while routing
+        attrs := []slog.Attr{
+            slog.String("method", r.Method),
+            slog.String("path", r.URL.Path),
+            slog.String("route", route),
+            slog.String("proto", r.Proto),
+            slog.String("clientIp", clientIP(r)),
+            slog.Int("status", status),
+            slog.Int("bytes", erw.bytes),
+            slog.Float64("latencyMs", float64(latency.Microseconds()) / 1000),
+        }
+        if zone := r.PathValue("zone"); zone != "" {
+            attrs = append(attrs, slog.String("zone", zone))
+        }
+        slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+        method := r.Method
+        if !knownMethods[method] {
+            method = "other"
+        }
+        httpRequestDuration.With(route, method, strconv.Itoa(status)).Observe(latency.Seconds())
+        httpResponseSize.With(route, method, strconv.Itoa(status)).Observe(float64(erw.bytes))
+    })
+}
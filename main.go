@@ -2,44 +2,34 @@ package main
 
 import ( 
     "log"
+    "log/slog"
+    "context"
     "net/http"
     "os"
+    "github.com/samchelini/dns-manager/auth"
     "github.com/samchelini/dns-manager/dns"
     "github.com/samchelini/dns-manager/jsend"
-    "github.com/samchelini/dns-manager/uuid"
+    "github.com/samchelini/dns-manager/metrics"
     "encoding/json"
+    "errors"
     "fmt"
+    "slices"
+    "strconv"
     "strings"
+    "sync"
     "time"
 )
 
 // global variables
 var (
     port = "8080"   // default port
-    tsig dns.TSIG   // tsig data
-)
-
-// extend http.ResponseWriter to include response code and bytes sent
-type extendedResponseWriter struct {
-    w http.ResponseWriter
-    statusCode int
-    bytes int
-}
-
-func (erw *extendedResponseWriter) Header() http.Header {
-    return erw.w.Header()
-}
-
-func (erw *extendedResponseWriter) WriteHeader(statusCode int) {
-    erw.statusCode = statusCode
-    erw.w.WriteHeader(statusCode)
-}
-
-func (erw *extendedResponseWriter) Write(data []byte) (int, error) {
-    erw.bytes = len(data)
-    return erw.w.Write(data)
-}
+    tsigKeys *dns.TSIGKeyring   // tsig keys by zone
+    sig0Key *dns.Sig0Key    // sig(0) key, used instead of tsig when set
+    dnsClient = dns.DefaultClient   // client used for all dns queries
 
+    discoveredUpstreams = make(map[string]*dns.Upstreams)       // primaries discovered via DNS_RESOLVER
+    discoveredMu        sync.Mutex
+)
 
 type Response[T any] struct {
     Resources   []T     `json:"resources"`
@@ -53,17 +43,62 @@ type ResponseV2[T any] struct {
     Code        *int    `json:"code,omitempty"`
 }
 
-// logs http requests
-func logHandler(handler http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        time := time.Now().Format("[02/Jan/2006:15:04:05 -0700]")
-        clientIp := strings.Trim(r.RemoteAddr[:strings.LastIndex(r.RemoteAddr, ":")], "[]")
-        log.Printf("received request: %s %s %s", clientIp, r.Method, r.URL)
-        erw := &extendedResponseWriter{w: w}
-        erw.Header().Set("X-Request-ID", uuid.V4())
-	    handler.ServeHTTP(erw, r)
-        log.Printf("completed request: %s - %s \"%s %s %s\" %d %d", clientIp, time, r.Method, r.URL.Path, r.Proto, erw.statusCode, erw.bytes)
-    })
+// returns the upstreams for a zone: the zone's DNS_ZONE_SERVERS entry, the
+// DNS_SERVER list, or the primary discovered through DNS_RESOLVER
+func upstreamsFor(ctx context.Context, zone string) (*dns.Upstreams, *jsend.Response) {
+    s := current()
+    if u, ok := s.zoneUpstreams[zone]; ok {
+        return u, nil
+    }
+    if s.defaultUpstreams != nil {
+        return s.defaultUpstreams, nil
+    }
+    if os.Getenv("DNS_RESOLVER") == "" {
+        return nil, jsend.Fail(zone, "no upstream nameservers configured for zone", nil, http.StatusNotFound)
+    }
+    primary, err := dnsClient.DiscoverPrimary(ctx, zone, os.Getenv("DNS_RESOLVER"))
+    if err != nil {
+        return nil, err
+    }
+
+    // keep health of discovered primaries until the primary changes
+    discoveredMu.Lock()
+    defer discoveredMu.Unlock()
+    u, ok := discoveredUpstreams[zone]
+    if !ok || u.Addresses()[0] != primary {
+        u = dns.NewUpstreams([]string{primary})
+        discoveredUpstreams[zone] = u
+    }
+    return u, nil
+}
+
+// split a comma separated list
+func splitList(list string) []string {
+    items := make([]string, 0)
+    for _, item := range strings.Split(list, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+// parse per zone upstreams in "zone=host:port,host:port;zone=host:port" format
+func parseZoneServers(zoneServers string) (map[string]*dns.Upstreams, error) {
+    upstreams := make(map[string]*dns.Upstreams)
+    for _, entry := range strings.Split(zoneServers, ";") {
+        if strings.TrimSpace(entry) == "" {
+            continue
+        }
+        zone, list, ok := strings.Cut(entry, "=")
+        zone = strings.TrimSpace(zone)
+        servers := splitList(list)
+        if !ok || zone == "" || len(servers) == 0 {
+            return nil, fmt.Errorf("invalid entry %q, expected zone=host:port[,host:port]", entry)
+        }
+        upstreams[zone] = dns.NewUpstreams(servers)
+    }
+    return upstreams, nil
 }
 
 // sets headers, encodes, and sends response
@@ -79,48 +114,86 @@ func getRecords(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
     response := Response[dns.Record]{}
     zone := r.PathValue("zone")
-    log.Printf("zone: %s", zone)
+    slog.DebugContext(r.Context(), "building message", "zone", zone)
 
-    // build and send query
-    log.Println("building message...")
-    query, err := dns.NewAxfrQuery(zone)
+    // check the policy, then build and send query
+    if jerr := authorize(r, auth.ActionRead, zone, "", ""); jerr != nil {
+        sendResponse(w, jerr)
+        return
+    }
+    query, err := dns.NewAxfrQuery(r.Context(), zone)
     if err != nil {
         errString := err.Error()
         response.Error = &errString
         w.WriteHeader(http.StatusBadRequest)
+    } else if upstreams, jerr := upstreamsFor(r.Context(), zone); jerr != nil {
+        response.Error = jerr.Message
+        w.WriteHeader(jerr.HttpCode)
+    } else if answers, jerr := dnsClient.Transfer(r.Context(), query, upstreams); jerr != nil {
+        response.Error = jerr.Message
+        w.WriteHeader(jerr.HttpCode)
     } else {
-        answer := dns.SendQuery(query, os.Getenv("DNS_SERVER"))
-        records := dns.GetAllRecords(answer)
-        response.Resources = records
-        w.WriteHeader(http.StatusOK)
+        response.Resources = make([]dns.Record, 0)
+        for _, answer := range answers {
+            records, jerr := dns.GetAllRecords(r.Context(), answer)
+            if jerr != nil {
+                response.Resources = nil
+                response.Error = jerr.Message
+                break
+            }
+            response.Resources = append(response.Resources, records...)
+        }
+        if response.Error != nil {
+            w.WriteHeader(http.StatusBadGateway)
+        } else {
+            w.WriteHeader(http.StatusOK)
+        }
     }
 
     // return response
     json.NewEncoder(w).Encode(response)
 }
 
+// transfer a zone from its upstreams and return its records
+func zoneRecords(ctx context.Context, zone string) ([]dns.Record, *jsend.Response) {
+    query, err := dns.NewAxfrQueryV2(ctx, zone, dnsClient.EDNS)
+    if err != nil {
+        return nil, err
+    }
+    upstreams, err := upstreamsFor(ctx, zone)
+    if err != nil {
+        return nil, err
+    }
+    answers, err := dnsClient.Transfer(ctx, query, upstreams)
+    if err != nil {
+        return nil, err
+    }
+
+    // get list of records from answers
+    records := make([]dns.Record, 0)
+    for _, answer := range answers {
+        answerRecords, err := dns.GetAllRecordsV2(ctx, answer)
+        if err != nil {
+            return nil, err
+        }
+        records = append(records, answerRecords...)
+    }
+    return records, nil
+}
+
 // get all records from a zone (v2)
 func getRecordsV2(w http.ResponseWriter, r *http.Request) {
     // set headers and get zone from path
     w.Header().Set("Content-Type", "application/json")
     zone := r.PathValue("zone")
-    log.Printf("zone: %s", zone)
+    slog.DebugContext(r.Context(), "building message", "zone", zone)
 
-    // build and send query
-    log.Println("building message...")
-    query, err := dns.NewAxfrQueryV2(zone)
-    if err != nil {
-        sendResponse(w, err)
-        return
-    }
-    answer, err := dns.SendQueryV2(query, os.Getenv("DNS_SERVER"))
-    if err != nil {
-        sendResponse(w, err)
+    // check the policy, then build and send query
+    if jerr := authorize(r, auth.ActionRead, zone, "", ""); jerr != nil {
+        sendResponse(w, jerr)
         return
     }
-
-    // get list of records from answer
-    records, err := dns.GetAllRecordsV2(answer)
+    records, err := zoneRecords(r.Context(), zone)
     if err != nil {
         sendResponse(w, err)
         return
@@ -130,6 +203,43 @@ func getRecordsV2(w http.ResponseWriter, r *http.Request) {
     sendResponse(w, jsend.Success(records, nil, nil, http.StatusOK))
 }
 
+// sign an update of records and send it to the zone upstreams. build errors
+// are returned as err, dns errors as jerr. unanswered is set when the update
+// reached a server without an answer, so it may have been applied.
+func sendUpdate(ctx context.Context, zone string, op dns.Op, records []*dns.Record, upstreams *dns.Upstreams) (jerr *jsend.Response, unanswered bool, err error) {
+    var query []byte
+    if sig0Key != nil {
+        query, err = dns.NewUpdateQuerySig0(ctx, zone, op, records, sig0Key)
+        if err == nil {
+            _, jerr, unanswered = dnsClient.SendUpdate(ctx, query, upstreams)
+        }
+        return jerr, unanswered, err
+    }
+
+    // sign with the primary key, falling back to older keys the server may
+    // still accept while a rotation is in progress
+    keys := tsigKeys.Keys(zone)
+    if len(keys) == 0 {
+        return jsend.Fail(zone, "no tsig keys configured for zone", nil, http.StatusNotFound), false, nil
+    }
+    for i, key := range keys {
+        query, err = dns.NewUpdateQuery(ctx, zone, op, records, &key)
+        if err != nil {
+            break
+        }
+        _, jerr, unanswered = dnsClient.SendUpdate(ctx, query, upstreams)
+        if jerr == nil {
+            tsigKeys.MarkUsed(zone, key, i == 0)
+            break
+        }
+        if jerr.Code == nil || *jerr.Code != int(dns.RCodeNotAuthorized) || i == len(keys) - 1 {
+            break
+        }
+        slog.WarnContext(ctx, "tsig key was not accepted, trying older key", "zone", zone, "key", key.Name, "next", keys[i + 1].Name)
+    }
+    return jerr, unanswered, err
+}
+
 // create or delete dns record in a zone
 func updateRecord(w http.ResponseWriter, r *http.Request) {
     var rec dns.Record
@@ -138,70 +248,199 @@ func updateRecord(w http.ResponseWriter, r *http.Request) {
     // decode provided json record to record object
     err := json.NewDecoder(r.Body).Decode(&rec)
     if err != nil {
-        log.Println("error decoding: %s", err)
+        slog.InfoContext(r.Context(), "error decoding record", "error", err)
         errString := err.Error()
         response.Error = &errString
-        w.WriteHeader(http.StatusBadRequest)
+        w.WriteHeader(bodyErrorStatus(err))
+        json.NewEncoder(w).Encode(response)
+        return
     }
 
-    log.Printf("zone: %s", r.PathValue("zone"))
+    slog.DebugContext(r.Context(), "updating record", "zone", r.PathValue("zone"), "name", rec.Name, "type", rec.Type)
 
     // create query based on method type
-    var query []byte
+    var op dns.Op
     switch r.Method {
     case "POST":
-        query, err = dns.NewUpdateQuery(r.PathValue("zone"), dns.OpAdd, &rec, &tsig)
+        op = dns.OpAdd
     case "DELETE": 
-        query, err = dns.NewUpdateQuery(r.PathValue("zone"), dns.OpDelete, &rec, &tsig)
+        op = dns.OpDelete
     default:
         w.WriteHeader(http.StatusMethodNotAllowed)
         return
     }
 
-    // send query and write response
-    dns.SendQuery(query, os.Getenv("DNS_SERVER"))
+    // only types updates support, a delete of any other type used to delete every rrset of the name
+    if !slices.Contains(dns.UpdateTypes, rec.Type) {
+        errString := fmt.Sprintf("unsupported record type %q, updates support %s", rec.Type, strings.Join(dns.UpdateTypes, ", "))
+        response.Error = &errString
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(response)
+        return
+    }
+    action := auth.ActionCreate
+    if op == dns.OpDelete {
+        action = auth.ActionDelete
+    }
+    if jerr := authorize(r, action, r.PathValue("zone"), rec.Name, rec.Type); jerr != nil {
+        sendResponse(w, jerr)
+        return
+    }
+
+    // find upstreams for the zone
+    zone := r.PathValue("zone")
+    upstreams, jerr := upstreamsFor(r.Context(), zone)
+    if jerr != nil {
+        response.Error = jerr.Message
+        w.WriteHeader(jerr.HttpCode)
+        json.NewEncoder(w).Encode(response)
+        return
+    }
+
+    // count the change against the zone's daily quota
+    quota, jerr := takeChangeQuota(w, r, zone)
+    if jerr != nil {
+        sendResponse(w, jerr)
+        return
+    }
+
+    // send query and write response. the change is refunded to the quota it
+    // was taken from, which a reload may have replaced, unless the server
+    // may have made it
+    jerr, unanswered, err := sendUpdate(r.Context(), zone, op, []*dns.Record{&rec}, upstreams)
+    if quota != nil && (err != nil || jerr != nil && !unanswered) {
+        quota.Refund(zone)
+    }
+    if err != nil {
+        errString := err.Error()
+        response.Error = &errString
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(response)
+        return
+    }
+    if jerr != nil {
+        response.Error = jerr.Message
+        w.WriteHeader(jerr.HttpCode)
+        json.NewEncoder(w).Encode(response)
+        return
+    }
     response.Resources = append(response.Resources, rec)
     json.NewEncoder(w).Encode(response)
 }
 
 func parseEnv() error {
+    // set up logging first
+    if err := setupLogging(); err != nil {
+        return err
+    }
+
     // get env vars
     p := os.Getenv("PORT")
-    dnsServer := os.Getenv("DNS_SERVER")
     tsigFile := os.Getenv("TSIG_FILE")
+    sig0KeyFile := os.Getenv("SIG0_KEY_FILE")
+    sig0KeyName := os.Getenv("SIG0_KEY_NAME")
 
     // store any missing required env vars here
     missing := make([]string, 0)
 
     // check required env vars
-    if dnsServer == "" {
-        missing = append(missing, "DNS_SERVER")
+    if os.Getenv("DNS_SERVER") == "" && os.Getenv("DNS_RESOLVER") == "" && os.Getenv("DNS_ZONE_SERVERS") == "" {
+        missing = append(missing, "DNS_SERVER, DNS_RESOLVER or DNS_ZONE_SERVERS")
     }
-    if tsigFile == "" {
-        missing = append(missing, "TSIG_FILE")
+    if tsigFile == "" && sig0KeyFile == "" {
+        missing = append(missing, "TSIG_FILE or SIG0_KEY_FILE")
+    }
+    if sig0KeyFile != "" && sig0KeyName == "" {
+        missing = append(missing, "SIG0_KEY_NAME")
     }
     if len(missing) != 0 {
         missingString, _ := json.Marshal(missing)
         return fmt.Errorf("required env vars are missing: %s", missingString)
     }
 
-    // try to open TSIG file
-    _, err := os.Open(tsigFile)
-    if err != nil {
-        return fmt.Errorf("error opening TSIG_FILE: %s", err)
+    // load the update signing key, tsig keys are reloaded when the file
+    // changes or on SIGHUP
+    if err := parseKeys(); err != nil {
+        return err
+    }
+    if tsigKeys != nil {
+        interval := defaultTSIGReloadInterval
+        if v := os.Getenv("TSIG_RELOAD_INTERVAL"); v != "" {
+            var err error
+            interval, err = time.ParseDuration(v)
+            if err != nil {
+                return fmt.Errorf("error parsing TSIG_RELOAD_INTERVAL: %s", err)
+            }
+        }
+        go watchTSIGFile(tsigFile, interval)
     }
 
-    // try to read TSIG file
-    tsigData, err := os.ReadFile(tsigFile)
-    if err != nil {
-        return fmt.Errorf("error reading TSIG_FILE: %s", err)
+    // set up the dns client
+    if err := parseDNSClient(); err != nil {
+        return err
+    }
+
+    // check http server limits
+    var err error
+    timeouts := map[string]*time.Duration{
+        "HTTP_READ_HEADER_TIMEOUT": &httpServer.ReadHeaderTimeout,
+        "HTTP_READ_TIMEOUT":        &httpServer.ReadTimeout,
+        "HTTP_WRITE_TIMEOUT":       &httpServer.WriteTimeout,
+        "HTTP_IDLE_TIMEOUT":        &httpServer.IdleTimeout,
+        "SHUTDOWN_TIMEOUT":         &shutdownTimeout,
+        "READY_CACHE_TTL":          &readyCacheTTL,
+        "READY_TIMEOUT":            &readyTimeout,
+    }
+    for name, timeout := range timeouts {
+        if value := os.Getenv(name); value != "" {
+            *timeout, err = time.ParseDuration(value)
+            if err != nil {
+                return fmt.Errorf("error parsing %s: %s", name, err)
+            }
+        }
+    }
+    if v := os.Getenv("HTTP_MAX_BODY_BYTES"); v != "" {
+        maxBodyBytes, err = strconv.ParseInt(v, 10, 64)
+        if err != nil || maxBodyBytes <= 0 {
+            return fmt.Errorf("error parsing HTTP_MAX_BODY_BYTES: must be a positive number of bytes")
+        }
+    }
+    if v := os.Getenv("HTTP_MAX_HEADER_BYTES"); v != "" {
+        httpServer.MaxHeaderBytes, err = strconv.Atoi(v)
+        if err != nil || httpServer.MaxHeaderBytes <= 0 {
+            return fmt.Errorf("error parsing HTTP_MAX_HEADER_BYTES: must be a positive number of bytes")
+        }
+    }
+
+    // check https
+    if certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"); certFile != "" || keyFile != "" {
+        serverTLS, err = newServerTLSConfig(certFile, keyFile, os.Getenv("TLS_MIN_VERSION"), os.Getenv("TLS_CLIENT_CA_FILE"), os.Getenv("TLS_CLIENT_AUTH"))
+        if err != nil {
+            return fmt.Errorf("error configuring https: %s", err)
+        }
+        log.Printf("serving https with certificate %s", certFile)
+        if serverTLS.ClientCAs != nil {
+            clientCerts = true
+            log.Printf("verifying client certificates against %s", os.Getenv("TLS_CLIENT_CA_FILE"))
+        }
+    }
+    if roleMap := os.Getenv("TLS_CLIENT_ROLE_MAP"); roleMap != "" {
+        if !clientCerts {
+            return errors.New("TLS_CLIENT_ROLE_MAP requires TLS_CLIENT_CA_FILE")
+        }
+        clientRoleMap, err = parseRoleMap(roleMap)
+        if err != nil {
+            return fmt.Errorf("error parsing TLS_CLIENT_ROLE_MAP: %s", err)
+        }
     }
 
-    // try to unmarshal TSIG data to TSIG object
-    err = json.Unmarshal(tsigData, &tsig)
+    // parse the settings that can be reloaded
+    s, err := parseSettings(nil)
     if err != nil {
-        return fmt.Errorf("error unmarshalling TSIG_FILE: %s", err)
+        return err
     }
+    live.Store(s)
+    dns.SetMetricZones(metricZones())
 
     // check PORT
     if p == "" {
@@ -214,17 +453,165 @@ func parseEnv() error {
     return nil
 }
 
+// load the sig(0) key or the tsig keys from SIG0_KEY_FILE or TSIG_FILE
+func parseKeys() error {
+    tsigFile := os.Getenv("TSIG_FILE")
+    sig0KeyFile := os.Getenv("SIG0_KEY_FILE")
+    sig0KeyName := os.Getenv("SIG0_KEY_NAME")
+    if tsigFile == "" && sig0KeyFile == "" {
+        return errors.New("TSIG_FILE or SIG0_KEY_FILE is required to sign updates")
+    }
+    if sig0KeyFile != "" && sig0KeyName == "" {
+        return errors.New("SIG0_KEY_NAME is required with SIG0_KEY_FILE")
+    }
+
+    // log the KEY record the zone needs to verify the sig(0) key
+    if sig0KeyFile != "" {
+        var err error
+        sig0Key, err = dns.LoadSig0Key(sig0KeyName, sig0KeyFile)
+        if err != nil {
+            return fmt.Errorf("error loading SIG0_KEY_FILE: %s", err)
+        }
+        log.Printf("signing updates with SIG(0) key %s, add this KEY record to each zone: %s", sig0Key.Name, sig0Key.KEYRecord(3600))
+        return nil
+    }
+    keys, err := dns.LoadTSIGKeys(tsigFile)
+    if err != nil {
+        return fmt.Errorf("error loading TSIG_FILE: %s", err)
+    }
+    tsigKeys = dns.NewTSIGKeyring(keys)
+    return nil
+}
+
+// set up the dns client from the DNS_* env vars
+func parseDNSClient() error {
+    // check dns client timeouts
+    var err error
+    timeouts := map[string]*time.Duration{
+        "DNS_DIAL_TIMEOUT": &dnsClient.DialTimeout,
+        "DNS_READ_TIMEOUT": &dnsClient.ReadTimeout,
+        "DNS_TIMEOUT":      &dnsClient.Timeout,
+        "DNS_IDLE_TIMEOUT": &dnsClient.IdleTimeout,
+    }
+    for name, timeout := range timeouts {
+        if value := os.Getenv(name); value != "" {
+            *timeout, err = time.ParseDuration(value)
+            if err != nil {
+                return fmt.Errorf("error parsing %s: %s", name, err)
+            }
+        }
+    }
+
+    // check dns connection pool size
+    if maxConns := os.Getenv("DNS_MAX_CONNS"); maxConns != "" {
+        dnsClient.MaxConns, err = strconv.Atoi(maxConns)
+        if err != nil {
+            return fmt.Errorf("error parsing DNS_MAX_CONNS: %s", err)
+        }
+    }
+
+    // check dns over tls settings, used by tls:// upstreams
+    var pins []string
+    if pinList := os.Getenv("DNS_TLS_SPKI_PINS"); pinList != "" {
+        pins = splitList(pinList)
+    }
+    dnsClient.TLSConfig, err = dns.NewTLSConfig(os.Getenv("DNS_TLS_CA_FILE"), os.Getenv("DNS_TLS_CERT_FILE"), os.Getenv("DNS_TLS_KEY_FILE"), pins)
+    if err != nil {
+        return fmt.Errorf("error loading DNS over TLS settings: %s", err)
+    }
+
+    // check dns over https method, used by https:// upstreams
+    switch method := strings.ToUpper(os.Getenv("DNS_DOH_METHOD")); method {
+    case "", http.MethodPost, http.MethodGet:
+        dnsClient.DoHMethod = method
+    default:
+        return fmt.Errorf("DNS_DOH_METHOD must be GET or POST, got %q", method)
+    }
+
+    // check edns settings
+    edns := *dns.DefaultEDNS
+    ednsInts := map[string]*int{
+        "DNS_EDNS_UDP_SIZE":     &edns.UDPSize,
+        "DNS_EDNS_PADDING":      &edns.Padding,
+    }
+    for name, value := range ednsInts {
+        if v := os.Getenv(name); v != "" {
+            *value, err = strconv.Atoi(v)
+            if err != nil {
+                return fmt.Errorf("error parsing %s: %s", name, err)
+            }
+        }
+    }
+    ednsBools := map[string]*bool{
+        "DNS_EDNS_DNSSEC_OK":    &edns.DNSSECOK,
+        "DNS_EDNS_COOKIE":       &edns.Cookie,
+    }
+    for name, value := range ednsBools {
+        if v := os.Getenv(name); v != "" {
+            *value, err = strconv.ParseBool(v)
+            if err != nil {
+                return fmt.Errorf("error parsing %s: %s", name, err)
+            }
+        }
+    }
+    dnsClient.EDNS = &edns
+    if v := os.Getenv("DNS_EDNS"); v != "" {
+        enabled, err := strconv.ParseBool(v)
+        if err != nil {
+            return fmt.Errorf("error parsing DNS_EDNS: %s", err)
+        }
+        if !enabled {
+            dnsClient.EDNS = nil
+        }
+    }
+
+    return nil
+}
+
 func main() {
+    if err := runCommand(); err != nil {
+        // diff already printed the differences
+        if !errors.Is(err, errZoneDiffers) {
+            slog.Error(err.Error())
+        }
+        os.Exit(1)
+    }
+}
+
+// run the api server with the config file and env vars
+func runServer() error {
+    // apply the config file, env vars override it
+    configFile := os.Getenv("CONFIG_FILE")
+    if configFile != "" {
+        config, err := loadConfig(configFile)
+        if err != nil {
+            return fmt.Errorf("error loading CONFIG_FILE: %s", err)
+        }
+        applyConfigEnv(config.Env())
+    }
+
     // parse environment variables
     err := parseEnv()
     if err != nil {
-        log.Fatalf("error parsing env vars: %s", err)
+        return fmt.Errorf("error parsing env vars: %s", err)
+    }
+    if configFile != "" {
+        log.Printf("loaded config from %s, reloaded on SIGHUP", configFile)
+        go watchConfigFile(configFile)
     }
 
-    http.HandleFunc("GET /api/v1/records/{zone}", getRecords)
-    http.HandleFunc("GET /api/v2/records/{zone}", getRecordsV2)
-    http.HandleFunc("POST /api/v1/records/{zone}", updateRecord)
-    http.HandleFunc("DELETE /api/v1/records/{zone}", updateRecord)
-    log.Printf("listening on port %s ...", port)
-    log.Fatal(http.ListenAndServe(":" + port, logHandler(http.DefaultServeMux)))
+    // every api route requires authentication when it is enabled
+    mux := http.NewServeMux()
+    mux.Handle("GET /api/v1/records/{zone}", authHandler(rateLimitHandler("read", http.HandlerFunc(getRecords))))
+    mux.Handle("GET /api/v2/records/{zone}", authHandler(rateLimitHandler("read", http.HandlerFunc(getRecordsV2))))
+    mux.Handle("POST /api/v1/records/{zone}", authHandler(rateLimitHandler("write", http.HandlerFunc(updateRecord))))
+    mux.Handle("DELETE /api/v1/records/{zone}", authHandler(rateLimitHandler("write", http.HandlerFunc(updateRecord))))
+    mux.Handle("POST /api/v2/tsig/keys", authHandler(http.HandlerFunc(createTSIGKey)))
+    mux.Handle("GET /api/v2/tsig/usage", authHandler(http.HandlerFunc(getTSIGKeyUsage)))
+    mux.Handle("GET /metrics", authHandler(metrics.Handler()))
+
+    // probes are never authenticated
+    mux.HandleFunc("GET /healthz", getHealth)
+    mux.HandleFunc("GET /readyz", getReady)
+    return serve(mux)
 }
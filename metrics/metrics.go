@@ -0,0 +1,325 @@
+package metrics
+
+import (
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// default histogram buckets in seconds, the same as the prometheus client
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// a metric family that can write itself in the prometheus text format
+type collector interface {
+    write(w io.Writer)
+}
+
+// collection of metrics served together
+type Registry struct {
+    mu          sync.Mutex
+    collectors  []collector
+}
+
+// registry used by the package level constructors
+var DefaultRegistry = &Registry{}
+
+func (r *Registry) register(c collector) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.collectors = append(r.collectors, c)
+}
+
+// write every metric in the prometheus text exposition format
+func (r *Registry) Expose(w io.Writer) {
+    r.mu.Lock()
+    collectors := append([]collector(nil), r.collectors...)
+    r.mu.Unlock()
+    for _, c := range collectors {
+        c.write(w)
+    }
+}
+
+// returns a handler serving the registry to prometheus
+func (r *Registry) Handler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        r.Expose(w)
+    })
+}
+
+// returns a handler serving the default registry
+func Handler() http.Handler {
+    return DefaultRegistry.Handler()
+}
+
+// float stored in a uint64 so it can be updated atomically
+type atomicFloat struct {
+    bits atomic.Uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+    for {
+        old := f.bits.Load()
+        if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old) + v)) {
+            return
+        }
+    }
+}
+
+func (f *atomicFloat) set(v float64) {
+    f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) get() float64 {
+    return math.Float64frombits(f.bits.Load())
+}
+
+// metric family with one child per set of label values
+type vec[T any] struct {
+    name        string
+    help        string
+    kind        string
+    labels      []string
+    newChild    func() *T
+    mu          sync.Mutex
+    children    map[string]*T
+    values      map[string][]string
+}
+
+func newVec[T any](name string, help string, kind string, labels []string, newChild func() *T) *vec[T] {
+    return &vec[T]{
+        name:       name,
+        help:       help,
+        kind:       kind,
+        labels:     labels,
+        newChild:   newChild,
+        children:   make(map[string]*T),
+        values:     make(map[string][]string),
+    }
+}
+
+// returns the child for label values, creating it on first use
+func (v *vec[T]) with(values []string) *T {
+    if len(values) != len(v.labels) {
+        panic(fmt.Sprintf("metric %s: expected %d label values, got %d", v.name, len(v.labels), len(values)))
+    }
+    key := strings.Join(values, "\xff")
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    child, ok := v.children[key]
+    if !ok {
+        child = v.newChild()
+        v.children[key] = child
+        v.values[key] = append([]string(nil), values...)
+    }
+    return child
+}
+
+// calls f for each child and its label values in label order
+func (v *vec[T]) each(f func(values []string, child *T)) {
+    v.mu.Lock()
+    keys := make([]string, 0, len(v.children))
+    for key := range v.children {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    children := make([]*T, len(keys))
+    values := make([][]string, len(keys))
+    for i, key := range keys {
+        children[i], values[i] = v.children[key], v.values[key]
+    }
+    v.mu.Unlock()
+    for i := range keys {
+        f(values[i], children[i])
+    }
+}
+
+func (v *vec[T]) header(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, helpEscaper.Replace(v.help), v.name, v.kind)
+}
+
+// escapes help text for the text format
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// escapes label values for the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// format label pairs as {name="value",...}
+func formatLabels(names []string, values []string, extra ...string) string {
+    pairs := make([]string, 0, len(names) + len(extra) / 2)
+    for i, name := range names {
+        pairs = append(pairs, name + "=\"" + labelEscaper.Replace(values[i]) + "\"")
+    }
+    for i := 0; i + 1 < len(extra); i += 2 {
+        pairs = append(pairs, extra[i] + "=\"" + labelEscaper.Replace(extra[i + 1]) + "\"")
+    }
+    if len(pairs) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// format a sample value
+func formatValue(v float64) string {
+    switch {
+    case math.IsInf(v, 1):
+        return "+Inf"
+    case math.IsInf(v, -1):
+        return "-Inf"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// value that only goes up
+type Counter struct {
+    value atomicFloat
+}
+
+func (c *Counter) Inc() {
+    c.value.add(1)
+}
+
+// add v, which must not be negative
+func (c *Counter) Add(v float64) {
+    if v < 0 {
+        return
+    }
+    c.value.add(v)
+}
+
+// counters partitioned by labels
+type CounterVec struct {
+    vec *vec[Counter]
+}
+
+// create a counter family in the default registry
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+    c := &CounterVec{vec: newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+    DefaultRegistry.register(c)
+    return c
+}
+
+// returns the counter for label values
+func (c *CounterVec) With(values ...string) *Counter {
+    return c.vec.with(values)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+    c.vec.header(w)
+    c.vec.each(func(values []string, child *Counter) {
+        fmt.Fprintf(w, "%s%s %s\n", c.vec.name, formatLabels(c.vec.labels, values), formatValue(child.value.get()))
+    })
+}
+
+// value that can go up and down
+type Gauge struct {
+    value atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+    g.value.set(v)
+}
+
+func (g *Gauge) Add(v float64) {
+    g.value.add(v)
+}
+
+// gauges partitioned by labels
+type GaugeVec struct {
+    vec *vec[Gauge]
+}
+
+// create a gauge family in the default registry
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+    g := &GaugeVec{vec: newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+    DefaultRegistry.register(g)
+    return g
+}
+
+// returns the gauge for label values
+func (g *GaugeVec) With(values ...string) *Gauge {
+    return g.vec.with(values)
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+    g.vec.header(w)
+    g.vec.each(func(values []string, child *Gauge) {
+        fmt.Fprintf(w, "%s%s %s\n", g.vec.name, formatLabels(g.vec.labels, values), formatValue(child.value.get()))
+    })
+}
+
+// observations counted in cumulative buckets. the counts and sum are kept
+// under one lock so a scrape sees them all from the same observations.
+type Histogram struct {
+    buckets []float64
+    mu      sync.Mutex
+    counts  []uint64
+    count   uint64
+    sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+    i := sort.SearchFloat64s(h.buckets, v)
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if i < len(h.counts) {
+        h.counts[i]++
+    }
+    h.count++
+    h.sum += v
+}
+
+// returns the cumulative bucket counts, count and sum read together
+func (h *Histogram) snapshot() ([]uint64, uint64, float64) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    cumulative := make([]uint64, len(h.counts))
+    var total uint64
+    for i, n := range h.counts {
+        total += n
+        cumulative[i] = total
+    }
+    return cumulative, h.count, h.sum
+}
+
+// histograms partitioned by labels
+type HistogramVec struct {
+    vec *vec[Histogram]
+}
+
+// create a histogram family with upper bucket bounds in the default registry
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+    buckets = append([]float64(nil), buckets...)
+    sort.Float64s(buckets)
+    h := &HistogramVec{}
+    h.vec = newVec(name, help, "histogram", labels, func() *Histogram {
+        return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+    })
+    DefaultRegistry.register(h)
+    return h
+}
+
+// returns the histogram for label values
+func (h *HistogramVec) With(values ...string) *Histogram {
+    return h.vec.with(values)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+    h.vec.header(w)
+    h.vec.each(func(values []string, child *Histogram) {
+        labels := formatLabels(h.vec.labels, values)
+        cumulative, count, sum := child.snapshot()
+        for i, bound := range child.buckets {
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.vec.name, formatLabels(h.vec.labels, values, "le", formatValue(bound)), cumulative[i])
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.vec.name, formatLabels(h.vec.labels, values, "le", "+Inf"), count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.vec.name, labels, formatValue(sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.vec.name, labels, count)
+    })
+}
@@ -0,0 +1,153 @@
+package metrics
+
+import (
+    "bufio"
+    "bytes"
+    "math"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// returns a registry holding the families built by add
+func testRegistry(add func(r *Registry)) *Registry {
+    r := &Registry{}
+    add(r)
+    return r
+}
+
+func TestExposeGolden(t *testing.T) {
+    var requests *CounterVec
+    var inflight *GaugeVec
+    var latency *HistogramVec
+    r := testRegistry(func(r *Registry) {
+        requests = &CounterVec{vec: newVec("requests_total", "Requests by\\nmethod.", "counter", []string{"method", "path"}, func() *Counter { return &Counter{} })}
+        inflight = &GaugeVec{vec: newVec("inflight", "Requests in flight.", "gauge", nil, func() *Gauge { return &Gauge{} })}
+        latency = &HistogramVec{vec: newVec("latency_seconds", "Request latency.", "histogram", []string{"op"}, func() *Histogram {
+            return &Histogram{buckets: []float64{0.1, 1}, counts: make([]uint64, 2)}
+        })}
+        r.register(requests)
+        r.register(inflight)
+        r.register(latency)
+    })
+
+    requests.With("GET", "/a").Inc()
+    requests.With("GET", "/a").Add(2.5)
+    requests.With("GET", "/a").Add(-1)
+    requests.With("POST", `/b"\` + "\n").Inc()
+    inflight.With().Set(3)
+    inflight.With().Add(-1)
+    latency.With("query").Observe(0.05)
+    latency.With("query").Observe(0.1)
+    latency.With("query").Observe(0.5)
+    latency.With("query").Observe(2)
+    latency.With("axfr").Observe(math.Inf(1))
+
+    want := `# HELP requests_total Requests by\\nmethod.
+# TYPE requests_total counter
+requests_total{method="GET",path="/a"} 3.5
+requests_total{method="POST",path="/b\"\\\n"} 1
+# HELP inflight Requests in flight.
+# TYPE inflight gauge
+inflight 2
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="axfr",le="0.1"} 0
+latency_seconds_bucket{op="axfr",le="1"} 0
+latency_seconds_bucket{op="axfr",le="+Inf"} 1
+latency_seconds_sum{op="axfr"} +Inf
+latency_seconds_count{op="axfr"} 1
+latency_seconds_bucket{op="query",le="0.1"} 2
+latency_seconds_bucket{op="query",le="1"} 3
+latency_seconds_bucket{op="query",le="+Inf"} 4
+latency_seconds_sum{op="query"} 2.65
+latency_seconds_count{op="query"} 4
+`
+    var buf bytes.Buffer
+    r.Expose(&buf)
+    if got := buf.String(); got != want {
+        t.Fatalf("got exposition:\n%s\nwant:\n%s", got, want)
+    }
+}
+
+func TestHelpEscaping(t *testing.T) {
+    r := testRegistry(func(r *Registry) {
+        r.register(&GaugeVec{vec: newVec("up", "Line one\nline two.", "gauge", nil, func() *Gauge { return &Gauge{} })})
+    })
+    var buf bytes.Buffer
+    r.Expose(&buf)
+    if !strings.HasPrefix(buf.String(), "# HELP up Line one\\nline two.\n# TYPE up gauge\n") {
+        t.Fatalf("got exposition:\n%s", buf.String())
+    }
+}
+
+func TestHandlerContentType(t *testing.T) {
+    r := testRegistry(func(r *Registry) {})
+    w := httptest.NewRecorder()
+    r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+    if got := w.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+        t.Fatalf("got content type %q", got)
+    }
+}
+
+func TestWithLabelCount(t *testing.T) {
+    c := &CounterVec{vec: newVec("c", "c", "counter", []string{"a", "b"}, func() *Counter { return &Counter{} })}
+    defer func() {
+        if recover() == nil {
+            t.Fatal("wrong label count did not panic")
+        }
+    }()
+    c.With("only one")
+}
+
+// every scrape taken while observations run shows a count equal to its
+// +Inf bucket
+func TestHistogramConsistentScrape(t *testing.T) {
+    var latency *HistogramVec
+    r := testRegistry(func(r *Registry) {
+        latency = &HistogramVec{vec: newVec("latency_seconds", "Latency.", "histogram", nil, func() *Histogram {
+            return &Histogram{buckets: []float64{0.5}, counts: make([]uint64, 1)}
+        })}
+        r.register(latency)
+    })
+    h := latency.With()
+
+    var wg sync.WaitGroup
+    stop := make(chan struct{})
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                select {
+                case <-stop:
+                    return
+                default:
+                    h.Observe(0.1)
+                    h.Observe(1)
+                }
+            }
+        }()
+    }
+    defer func() {
+        close(stop)
+        wg.Wait()
+    }()
+
+    for i := 0; i < 200; i++ {
+        var buf bytes.Buffer
+        r.Expose(&buf)
+        samples := make(map[string]string)
+        scanner := bufio.NewScanner(&buf)
+        for scanner.Scan() {
+            if name, value, ok := strings.Cut(scanner.Text(), " "); ok && !strings.HasPrefix(name, "#") {
+                samples[name] = value
+            }
+        }
+        inf, count := samples[`latency_seconds_bucket{le="+Inf"}`], samples["latency_seconds_count"]
+        if inf != count {
+            t.Fatalf("scrape %d: +Inf bucket %s and count %s differ", i, inf, count)
+        }
+    }
+}
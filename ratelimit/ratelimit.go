@@ -0,0 +1,213 @@
+package ratelimit
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// how often idle buckets are dropped
+const sweepInterval = time.Minute
+
+// token bucket rate limit kept separately for each key, e.g. a token or client ip
+type Limiter struct {
+    Limit   int             // bucket size, the number of requests allowed in a burst
+    Period  time.Duration   // time to refill the whole bucket
+    mu      sync.Mutex
+    buckets map[string]*bucket
+    swept   time.Time
+}
+
+type bucket struct {
+    tokens  float64
+    updated time.Time
+}
+
+// returns a limiter allowing limit requests per period for each key
+func NewLimiter(limit int, period time.Duration) *Limiter {
+    return &Limiter{Limit: limit, Period: period, buckets: make(map[string]*bucket)}
+}
+
+// parse a limit in "<requests>/<period>" format, e.g. "100/1m" or "5/s"
+func ParseLimit(s string) (*Limiter, error) {
+    n, p, ok := strings.Cut(s, "/")
+    if !ok {
+        return nil, fmt.Errorf("invalid limit %q, expected <requests>/<period>", s)
+    }
+    limit, err := strconv.Atoi(strings.TrimSpace(n))
+    if err != nil || limit <= 0 {
+        return nil, fmt.Errorf("invalid request count in limit %q", s)
+    }
+    p = strings.TrimSpace(p)
+    if p != "" && (p[0] < '0' || p[0] > '9') {
+        p = "1" + p
+    }
+    period, err := time.ParseDuration(p)
+    if err != nil || period <= 0 {
+        return nil, fmt.Errorf("invalid period in limit %q", s)
+    }
+    return NewLimiter(limit, period), nil
+}
+
+// refill rate in tokens per second
+func (l *Limiter) rate() float64 {
+    return float64(l.Limit) / l.Period.Seconds()
+}
+
+// take a token from the key's bucket. when the bucket is empty it returns
+// false and how long until a token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+    return l.allowAt(key, time.Now())
+}
+
+func (l *Limiter) allowAt(key string, now time.Time) (bool, time.Duration) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if now.Sub(l.swept) > sweepInterval {
+        l.sweep(now)
+    }
+
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &bucket{tokens: float64(l.Limit), updated: now}
+        l.buckets[key] = b
+    }
+    b.tokens = math.Min(float64(l.Limit), b.tokens + now.Sub(b.updated).Seconds() * l.rate())
+    b.updated = now
+    if b.tokens >= 1 {
+        b.tokens--
+        return true, 0
+    }
+    wait := time.Duration((1 - b.tokens) / l.rate() * float64(time.Second))
+    return false, wait
+}
+
+// drop buckets that have refilled, they are the same as a new bucket
+func (l *Limiter) sweep(now time.Time) {
+    for key, b := range l.buckets {
+        if b.tokens + now.Sub(b.updated).Seconds() * l.rate() >= float64(l.Limit) {
+            delete(l.buckets, key)
+        }
+    }
+    l.swept = now
+}
+
+// daily limits on changes for each zone, reset at midnight utc. counts are
+// kept in memory, so they restart with the process.
+type Quota struct {
+    Default int             // changes allowed per day in zones without their own limit, 0 is unlimited
+    Zones   map[string]int  // changes allowed per day by zone
+    mu      sync.Mutex
+    day     time.Time
+    used    map[string]int
+}
+
+// parse quotas in "<zone>=<changes>;..." format, "*" sets the default for
+// every other zone. 0 is unlimited, which exempts a zone from the default;
+// changes to a zone are blocked with the authorization policy, not a quota.
+func ParseQuota(s string) (*Quota, error) {
+    q := &Quota{Zones: make(map[string]int), used: make(map[string]int)}
+    for _, entry := range strings.Split(s, ";") {
+        if strings.TrimSpace(entry) == "" {
+            continue
+        }
+        zone, n, ok := strings.Cut(entry, "=")
+        zone = canonicalZone(zone)
+        limit, err := strconv.Atoi(strings.TrimSpace(n))
+        if !ok || zone == "" || err != nil || limit < 0 {
+            return nil, fmt.Errorf("invalid entry %q, expected zone=changes", entry)
+        }
+        if zone == "*." {
+            q.Default = limit
+        } else {
+            q.Zones[zone] = limit
+        }
+    }
+    if q.Default == 0 && len(q.Zones) == 0 {
+        return nil, errors.New("no quotas set")
+    }
+    return q, nil
+}
+
+// zone names are compared in lowercase with a trailing dot
+func canonicalZone(zone string) string {
+    zone = strings.ToLower(strings.TrimSpace(zone))
+    if zone != "" && !strings.HasSuffix(zone, ".") {
+        zone += "."
+    }
+    return zone
+}
+
+// returns the daily limit of a zone, 0 is unlimited
+func (q *Quota) limit(zone string) int {
+    if limit, ok := q.Zones[zone]; ok {
+        return limit
+    }
+    return q.Default
+}
+
+// start counting a new day when the date changed
+func (q *Quota) reset(now time.Time) {
+    day := now.UTC().Truncate(24 * time.Hour)
+    if !day.Equal(q.day) {
+        q.day = day
+        q.used = make(map[string]int)
+    }
+}
+
+// count a change to the zone. when the quota is used up it returns false
+// and how long until it resets.
+func (q *Quota) Take(zone string) (bool, time.Duration) {
+    return q.takeAt(zone, time.Now())
+}
+
+func (q *Quota) takeAt(zone string, now time.Time) (bool, time.Duration) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.reset(now)
+    zone = canonicalZone(zone)
+    limit := q.limit(zone)
+    if limit > 0 && q.used[zone] >= limit {
+        return false, q.day.Add(24 * time.Hour).Sub(now)
+    }
+    q.used[zone]++
+    return true, 0
+}
+
+// give back a change that was taken but not made
+func (q *Quota) Refund(zone string) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    zone = canonicalZone(zone)
+    if q.used[zone] > 0 {
+        q.used[zone]--
+    }
+}
+
+// carry today's counts over from a quota being replaced, so changing the
+// limits does not reset them
+func (q *Quota) Continue(prev *Quota) {
+    prev.mu.Lock()
+    day, used := prev.day, make(map[string]int, len(prev.used))
+    for zone, n := range prev.used {
+        used[zone] = n
+    }
+    prev.mu.Unlock()
+
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.day, q.used = day, used
+}
+
+// changes made to the zone today and its daily limit, 0 is unlimited
+func (q *Quota) Usage(zone string) (int, int) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.reset(time.Now())
+    zone = canonicalZone(zone)
+    return q.used[zone], q.limit(zone)
+}
@@ -0,0 +1,226 @@
+package ratelimit
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseLimit(t *testing.T) {
+    tests := []struct {
+        in      string
+        limit   int
+        period  time.Duration
+        err     bool
+    }{
+        {in: "100/1m", limit: 100, period: time.Minute},
+        {in: "5/s", limit: 5, period: time.Second},
+        {in: " 10 / 30s ", limit: 10, period: 30 * time.Second},
+        {in: "5", err: true},
+        {in: "0/s", err: true},
+        {in: "-1/s", err: true},
+        {in: "x/s", err: true},
+        {in: "5/", err: true},
+        {in: "5/0s", err: true},
+        {in: "5/-1s", err: true},
+        {in: "5/fortnight", err: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.in, func(t *testing.T) {
+            l, err := ParseLimit(tt.in)
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("got %d/%s, want an error", l.Limit, l.Period)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if l.Limit != tt.limit || l.Period != tt.period {
+                t.Fatalf("got %d/%s, want %d/%s", l.Limit, l.Period, tt.limit, tt.period)
+            }
+        })
+    }
+}
+
+func TestLimiterAllow(t *testing.T) {
+    start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+    // 2 requests per second, one token every 500ms
+    tests := []struct {
+        name    string
+        at      time.Duration
+        key     string
+        allowed bool
+        wait    time.Duration
+    }{
+        {name: "burst 1", at: 0, key: "a", allowed: true},
+        {name: "burst 2", at: 0, key: "a", allowed: true},
+        {name: "empty", at: 0, key: "a", wait: 500 * time.Millisecond},
+        {name: "other key", at: 0, key: "b", allowed: true},
+        {name: "half refilled", at: 250 * time.Millisecond, key: "a", wait: 250 * time.Millisecond},
+        {name: "refilled", at: 500 * time.Millisecond, key: "a", allowed: true},
+        {name: "empty again", at: 500 * time.Millisecond, key: "a", wait: 500 * time.Millisecond},
+        {name: "idle 1", at: 10 * time.Second, key: "a", allowed: true},
+        {name: "idle 2", at: 10 * time.Second, key: "a", allowed: true},
+        {name: "idle refill is capped at the burst", at: 10 * time.Second, key: "a", wait: 500 * time.Millisecond},
+    }
+    l := NewLimiter(2, time.Second)
+    for _, tt := range tests {
+        allowed, wait := l.allowAt(tt.key, start.Add(tt.at))
+        if allowed != tt.allowed || wait != tt.wait {
+            t.Errorf("%s: got %v, %s, want %v, %s", tt.name, allowed, wait, tt.allowed, tt.wait)
+        }
+    }
+}
+
+func TestLimiterSweep(t *testing.T) {
+    start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+    l := NewLimiter(10, time.Hour)
+    l.allowAt("refilled", start)
+    for i := 0; i < 10; i++ {
+        l.allowAt("busy", start.Add(50 * time.Minute))
+    }
+
+    // after the sweep interval only buckets that are not full are kept
+    l.allowAt("new", start.Add(55 * time.Minute))
+    if _, ok := l.buckets["refilled"]; ok {
+        t.Error("refilled bucket was not dropped")
+    }
+    if _, ok := l.buckets["busy"]; !ok {
+        t.Error("busy bucket was dropped")
+    }
+    if allowed, _ := l.allowAt("busy", start.Add(55 * time.Minute)); allowed {
+        t.Error("busy bucket was reset by the sweep")
+    }
+}
+
+func TestParseQuota(t *testing.T) {
+    tests := []struct {
+        in      string
+        def     int
+        zones   map[string]int
+        err     bool
+    }{
+        {in: "local.domain.=5000;*=1000", def: 1000, zones: map[string]int{"local.domain.": 5000}},
+        {in: " Local.Domain = 5 ; ", zones: map[string]int{"local.domain.": 5}},
+        {in: "*=10;internal.=0", def: 10, zones: map[string]int{"internal.": 0}},
+        {in: "", err: true},
+        {in: "*=0", err: true},
+        {in: "local.domain.", err: true},
+        {in: "=5", err: true},
+        {in: "local.domain.=-1", err: true},
+        {in: "local.domain.=x", err: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.in, func(t *testing.T) {
+            q, err := ParseQuota(tt.in)
+            if tt.err {
+                if err == nil {
+                    t.Fatalf("got %+v, want an error", q)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if q.Default != tt.def || len(q.Zones) != len(tt.zones) {
+                t.Fatalf("got default %d and zones %v, want %d and %v", q.Default, q.Zones, tt.def, tt.zones)
+            }
+            for zone, limit := range tt.zones {
+                if got, ok := q.Zones[zone]; !ok || got != limit {
+                    t.Fatalf("got zones %v, want %v", q.Zones, tt.zones)
+                }
+            }
+        })
+    }
+}
+
+func TestQuotaTake(t *testing.T) {
+    midnight := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        name    string
+        at      time.Time
+        zone    string
+        allowed bool
+        wait    time.Duration
+    }{
+        {name: "first", at: midnight.Add(-time.Minute), zone: "a.com.", allowed: true},
+        {name: "names are case insensitive", at: midnight.Add(-time.Minute), zone: "A.com", allowed: true},
+        {name: "used up", at: midnight.Add(-time.Minute), zone: "a.com.", wait: time.Minute},
+        {name: "default quota", at: midnight.Add(-30 * time.Second), zone: "other.com.", allowed: true},
+        {name: "default quota used up", at: midnight.Add(-30 * time.Second), zone: "other.com.", wait: 30 * time.Second},
+        {name: "unlimited zone", at: midnight.Add(-time.Second), zone: "free.com.", allowed: true},
+        {name: "unlimited zone again", at: midnight.Add(-time.Second), zone: "free.com.", allowed: true},
+        {name: "reset at midnight utc", at: midnight, zone: "a.com.", allowed: true},
+        {name: "reset for every zone", at: midnight, zone: "other.com.", allowed: true},
+        {name: "local time zones do not matter", at: midnight.Add(time.Hour).In(time.FixedZone("UTC-5", -5 * 3600)), zone: "a.com.", allowed: true},
+        {name: "used up on the new day", at: midnight.Add(time.Hour), zone: "a.com.", wait: 23 * time.Hour},
+    }
+    q, err := ParseQuota("a.com=2;free.com=0;*=1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, tt := range tests {
+        allowed, wait := q.takeAt(tt.zone, tt.at)
+        if allowed != tt.allowed || wait != tt.wait {
+            t.Errorf("%s: got %v, %s, want %v, %s", tt.name, allowed, wait, tt.allowed, tt.wait)
+        }
+    }
+}
+
+func TestQuotaRefund(t *testing.T) {
+    now := time.Now()
+    q, err := ParseQuota("a.com.=1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if allowed, _ := q.takeAt("a.com.", now); !allowed {
+        t.Fatal("first change was not allowed")
+    }
+    q.Refund("A.com")
+    if used, limit := q.Usage("a.com."); used != 0 || limit != 1 {
+        t.Fatalf("after refund got usage %d/%d, want 0/1", used, limit)
+    }
+    if allowed, _ := q.takeAt("a.com.", now); !allowed {
+        t.Fatal("refunded change was not allowed")
+    }
+
+    // refunds never go below zero
+    q.Refund("a.com.")
+    q.Refund("a.com.")
+    if used, _ := q.Usage("a.com."); used != 0 {
+        t.Fatalf("got usage %d after extra refunds, want 0", used)
+    }
+}
+
+func TestQuotaContinue(t *testing.T) {
+    now := time.Now()
+    prev, err := ParseQuota("a.com.=3;b.com.=3")
+    if err != nil {
+        t.Fatal(err)
+    }
+    prev.takeAt("a.com.", now)
+    prev.takeAt("a.com.", now)
+    prev.takeAt("b.com.", now)
+
+    // the new limits apply to the counts kept from the old quota
+    q, err := ParseQuota("a.com.=2;b.com.=5")
+    if err != nil {
+        t.Fatal(err)
+    }
+    q.Continue(prev)
+    if allowed, _ := q.takeAt("a.com.", now); allowed {
+        t.Error("a.com. was allowed past its new limit")
+    }
+    if used, limit := q.Usage("b.com."); used != 1 || limit != 5 {
+        t.Errorf("got b.com. usage %d/%d, want 1/5", used, limit)
+    }
+
+    // later changes to the old quota are not shared
+    prev.takeAt("b.com.", now)
+    if used, _ := q.Usage("b.com."); used != 1 {
+        t.Errorf("got b.com. usage %d after a change to the old quota, want 1", used)
+    }
+}
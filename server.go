@@ -0,0 +1,84 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+)
+
+// http server settings, overridden by the HTTP_* env vars. the write timeout
+// is longer than the default DNS_TIMEOUT so zone transfers can finish.
+var httpServer = &http.Server{
+    ReadHeaderTimeout:  10 * time.Second,
+    ReadTimeout:        30 * time.Second,
+    WriteTimeout:       90 * time.Second,
+    IdleTimeout:        120 * time.Second,
+    MaxHeaderBytes:     64 << 10,
+}
+
+var (
+    maxBodyBytes    int64 = 1 << 20             // request body limit
+    shutdownTimeout = 30 * time.Second          // how long in-flight requests may drain on shutdown
+)
+
+// returns the status for a request body that could not be decoded
+func bodyErrorStatus(err error) int {
+    var maxErr *http.MaxBytesError
+    if errors.As(err, &maxErr) {
+        return http.StatusRequestEntityTooLarge
+    }
+    return http.StatusBadRequest
+}
+
+// serve the api until the listener fails or SIGTERM or SIGINT is received.
+// on a signal the server stops accepting connections and waits up to
+// shutdownTimeout for in-flight requests, and the dns updates they are
+// sending, to finish before the dns connections are closed.
+func serve(mux *http.ServeMux) error {
+    httpServer.Addr = ":" + port
+    httpServer.Handler = http.MaxBytesHandler(logHandler(mux), maxBodyBytes)
+    httpServer.TLSConfig = serverTLS
+    httpServer.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+    defer signal.Stop(signals)
+
+    errs := make(chan error, 1)
+    go func() {
+        if serverTLS != nil {
+            slog.Info("listening for https", "port", port)
+            errs <- httpServer.ListenAndServeTLS("", "")
+        } else {
+            slog.Info("listening for http", "port", port)
+            errs <- httpServer.ListenAndServe()
+        }
+    }()
+
+    select {
+    case err := <-errs:
+        dnsClient.Close()
+        return err
+    case sig := <-signals:
+        slog.Info("shutting down, draining in-flight requests", "signal", sig.String(), "timeout", shutdownTimeout)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+    defer cancel()
+    err := httpServer.Shutdown(ctx)
+    if err != nil {
+        httpServer.Close()
+        err = fmt.Errorf("error draining requests: %s", err)
+    }
+    dnsClient.Close()
+    if err == nil {
+        slog.Info("shutdown complete")
+    }
+    return err
+}
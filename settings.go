@@ -0,0 +1,203 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "log/slog"
+    "os"
+    "strings"
+    "sync/atomic"
+    "time"
+    "github.com/samchelini/dns-manager/auth"
+    "github.com/samchelini/dns-manager/dns"
+    "github.com/samchelini/dns-manager/ratelimit"
+)
+
+// settings that are replaced as a whole when the config is reloaded, so a
+// request sees either the old or the new settings
+type settings struct {
+    defaultUpstreams    *dns.Upstreams                  // upstreams from DNS_SERVER
+    zoneUpstreams       map[string]*dns.Upstreams       // upstreams from DNS_ZONE_SERVERS
+    tokenStore          *auth.TokenStore                // bearer tokens, nil when not accepted
+    jwtVerifier         *auth.JWTVerifier               // jwt verifier for sso identities, nil when not accepted
+    policy              *auth.Policy                    // authorization policy, nil when every caller may do anything
+    readLimiter         *ratelimit.Limiter              // zone reads, each one a zone transfer
+    writeLimiter        *ratelimit.Limiter              // record changes
+    changeQuota         *ratelimit.Quota                // daily record changes by zone
+
+    // limit and jwt specs, so unchanged limits keep their state and an
+    // unchanged jwt verifier keeps its cached keys across reloads
+    readLimit, writeLimit, quota, jwt string
+}
+
+var live atomic.Pointer[settings]
+
+// returns the settings in use
+func current() *settings {
+    return live.Load()
+}
+
+// set up leveled logging from LOG_LEVEL and LOG_FORMAT, wire dumps are only
+// logged at debug level
+func setupLogging() error {
+    var level slog.Level
+    if v := os.Getenv("LOG_LEVEL"); v != "" {
+        if err := level.UnmarshalText([]byte(v)); err != nil {
+            return fmt.Errorf("error parsing LOG_LEVEL: %s", err)
+        }
+    }
+    logger, err := newLogger(os.Stderr, os.Getenv("LOG_FORMAT"), level)
+    if err != nil {
+        return fmt.Errorf("error parsing LOG_FORMAT: %s", err)
+    }
+    slog.SetDefault(logger)
+    dns.SetLogger(logger)
+    return nil
+}
+
+// parse the reloadable settings from env vars. rate limits and quotas that
+// did not change are kept from prev, so a reload does not reset them.
+func parseSettings(prev *settings) (*settings, error) {
+    s := &settings{
+        readLimit:  os.Getenv("RATE_LIMIT_READS"),
+        writeLimit: os.Getenv("RATE_LIMIT_WRITES"),
+        quota:      os.Getenv("ZONE_DAILY_CHANGE_QUOTA"),
+        jwt:        jwtSpec(),
+    }
+    if err := parseUpstreams(s); err != nil {
+        return nil, err
+    }
+
+    // check api authentication
+    var err error
+    if tokensFile := os.Getenv("AUTH_TOKENS_FILE"); tokensFile != "" {
+        s.tokenStore, err = auth.OpenTokenStore(tokensFile)
+        if err != nil {
+            return nil, fmt.Errorf("error loading AUTH_TOKENS_FILE: %s", err)
+        }
+        log.Printf("requiring bearer tokens from %s", tokensFile)
+    }
+    if prev != nil && prev.jwt == s.jwt {
+        s.jwtVerifier = prev.jwtVerifier
+    } else if jwks := os.Getenv("AUTH_JWT_JWKS"); jwks != "" {
+        issuer, audience := os.Getenv("AUTH_JWT_ISSUER"), os.Getenv("AUTH_JWT_AUDIENCE")
+        if issuer == "" || audience == "" {
+            return nil, errors.New("AUTH_JWT_ISSUER and AUTH_JWT_AUDIENCE are required with AUTH_JWT_JWKS")
+        }
+        ttl := time.Hour
+        if v := os.Getenv("AUTH_JWT_JWKS_TTL"); v != "" {
+            ttl, err = time.ParseDuration(v)
+            if err != nil {
+                return nil, fmt.Errorf("error parsing AUTH_JWT_JWKS_TTL: %s", err)
+            }
+        }
+        s.jwtVerifier = &auth.JWTVerifier{
+            Keys:       auth.NewJWKS(jwks, ttl),
+            Issuer:     issuer,
+            Audience:   audience,
+            RolesClaim: os.Getenv("AUTH_JWT_ROLES_CLAIM"),
+            Leeway:     time.Minute,
+        }
+        if roleMap := os.Getenv("AUTH_JWT_ROLE_MAP"); roleMap != "" {
+            s.jwtVerifier.RoleMap, err = parseRoleMap(roleMap)
+            if err != nil {
+                return nil, fmt.Errorf("error parsing AUTH_JWT_ROLE_MAP: %s", err)
+            }
+        }
+        log.Printf("accepting JWTs from issuer %s for audience %s, keys from %s", issuer, audience, jwks)
+    }
+    if s.tokenStore == nil && s.jwtVerifier == nil && !clientCerts {
+        log.Println("AUTH_TOKENS_FILE, AUTH_JWT_JWKS and TLS_CLIENT_CA_FILE env vars are not set, the api does not require authentication")
+    }
+    if policyFile := os.Getenv("AUTH_POLICY_FILE"); policyFile != "" {
+        s.policy, err = auth.LoadPolicy(policyFile)
+        if err != nil {
+            return nil, fmt.Errorf("error loading AUTH_POLICY_FILE: %s", err)
+        }
+        log.Printf("authorizing requests with %d policy rules from %s", len(s.policy.Rules), policyFile)
+    }
+
+    // check rate limits
+    if prev != nil && prev.readLimit == s.readLimit {
+        s.readLimiter = prev.readLimiter
+    } else if s.readLimit != "" {
+        s.readLimiter, err = ratelimit.ParseLimit(s.readLimit)
+        if err != nil {
+            return nil, fmt.Errorf("error parsing RATE_LIMIT_READS: %s", err)
+        }
+        log.Printf("limiting zone reads to %d per %s for each caller", s.readLimiter.Limit, s.readLimiter.Period)
+    }
+    if prev != nil && prev.writeLimit == s.writeLimit {
+        s.writeLimiter = prev.writeLimiter
+    } else if s.writeLimit != "" {
+        s.writeLimiter, err = ratelimit.ParseLimit(s.writeLimit)
+        if err != nil {
+            return nil, fmt.Errorf("error parsing RATE_LIMIT_WRITES: %s", err)
+        }
+        log.Printf("limiting record changes to %d per %s for each caller", s.writeLimiter.Limit, s.writeLimiter.Period)
+    }
+    if prev != nil && prev.quota == s.quota {
+        s.changeQuota = prev.changeQuota
+    } else if s.quota != "" {
+        s.changeQuota, err = ratelimit.ParseQuota(s.quota)
+        if err != nil {
+            return nil, fmt.Errorf("error parsing ZONE_DAILY_CHANGE_QUOTA: %s", err)
+        }
+        log.Printf("limiting daily record changes by zone: %s", s.quota)
+        if prev != nil && prev.changeQuota != nil {
+            s.changeQuota.Continue(prev.changeQuota)
+        }
+    }
+
+    return s, nil
+}
+
+// returns the AUTH_JWT_* env vars the jwt verifier is built from
+func jwtSpec() string {
+    var spec []string
+    for _, name := range []string{"AUTH_JWT_JWKS", "AUTH_JWT_ISSUER", "AUTH_JWT_AUDIENCE", "AUTH_JWT_JWKS_TTL", "AUTH_JWT_ROLES_CLAIM", "AUTH_JWT_ROLE_MAP"} {
+        spec = append(spec, name + "=" + os.Getenv(name))
+    }
+    return strings.Join(spec, "\n")
+}
+
+// parse DNS_SERVER and DNS_ZONE_SERVERS into the settings
+func parseUpstreams(s *settings) error {
+    dnsServer := os.Getenv("DNS_SERVER")
+    dnsResolver := os.Getenv("DNS_RESOLVER")
+    dnsZoneServers := os.Getenv("DNS_ZONE_SERVERS")
+    if dnsServer == "" && dnsResolver == "" && dnsZoneServers == "" {
+        return errors.New("DNS_SERVER, DNS_RESOLVER or DNS_ZONE_SERVERS is required")
+    }
+
+    // parse upstreams and log how nameservers are found
+    var err error
+    s.zoneUpstreams, err = parseZoneServers(dnsZoneServers)
+    if err != nil {
+        return fmt.Errorf("error parsing DNS_ZONE_SERVERS: %s", err)
+    }
+    for zone, upstreams := range s.zoneUpstreams {
+        log.Printf("using upstreams %s for zone %s", upstreams.Addresses(), zone)
+    }
+    if dnsServer != "" {
+        s.defaultUpstreams = dns.NewUpstreams(splitList(dnsServer))
+        log.Printf("using DNS_SERVER upstreams %s for all other zones", s.defaultUpstreams.Addresses())
+    } else if dnsResolver != "" {
+        log.Printf("DNS_SERVER env var is not set, discovering primaries via DNS_RESOLVER %s", dnsResolver)
+    }
+
+    // sig(0) signs the message id, which dns over quic rewrites to 0
+    if os.Getenv("SIG0_KEY_FILE") != "" {
+        addresses := splitList(dnsServer)
+        for _, upstreams := range s.zoneUpstreams {
+            addresses = append(addresses, upstreams.Addresses()...)
+        }
+        for _, address := range addresses {
+            if dns.IsQUIC(address) {
+                return fmt.Errorf("SIG0_KEY_FILE cannot sign updates sent to quic:// upstream %s, use TSIG_FILE", address)
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+    "github.com/samchelini/dns-manager/dns"
+    "github.com/samchelini/dns-manager/jsend"
+)
+
+// default interval for checking TSIG_FILE for changes
+const defaultTSIGReloadInterval = 10 * time.Second
+
+// reload tsig keys from file, keeping the current keys when the file is invalid
+func reloadTSIGKeys(file string) {
+    keys, err := dns.LoadTSIGKeys(file)
+    if err != nil {
+        log.Printf("error reloading TSIG_FILE, keeping current keys: %s", err)
+        return
+    }
+    tsigKeys.Set(keys)
+    dns.SetMetricZones(metricZones())
+    log.Printf("reloaded TSIG keys from %s", file)
+}
+
+// reload tsig keys on SIGHUP and whenever the file changes
+func watchTSIGFile(file string, interval time.Duration) {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+
+    var modTime time.Time
+    if info, err := os.Stat(file); err == nil {
+        modTime = info.ModTime()
+    }
+    var tick <-chan time.Time
+    if interval > 0 {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+
+    for {
+        select {
+        case <-hup:
+            log.Println("received SIGHUP")
+            reloadTSIGKeys(file)
+        case <-tick:
+            info, err := os.Stat(file)
+            if err != nil {
+                log.Printf("error checking TSIG_FILE: %s", err)
+                continue
+            }
+            if !info.ModTime().Equal(modTime) {
+                modTime = info.ModTime()
+                reloadTSIGKeys(file)
+            }
+        }
+    }
+}
+
+// report the tsig key used for the last successful update on each zone
+func getTSIGKeyUsage(w http.ResponseWriter, r *http.Request) {
+    if tsigKeys == nil {
+        sendResponse(w, jsend.Fail(nil, "updates are not signed with TSIG", nil, http.StatusNotFound))
+        return
+    }
+    sendResponse(w, jsend.Success(tsigKeys.LastUsed(), nil, nil, http.StatusOK))
+}